@@ -0,0 +1,19 @@
+package log_v1
+
+// NewDeadLetterRecord 処理に失敗したrecordを、デッドレターのログに書き込むレコードにする。
+// 値とキー、スキーマバージョン、圧縮の指定を引き継ぎ、元のトピックとオフセット、失敗した理由をヘッダーとして付与する。
+// 時刻と有効期間は引き継がないので、書き込んだ時刻から保持される
+func NewDeadLetterRecord(record *Record, sourceTopic, reason string) *Record {
+	return &Record{
+		Value:         record.Value,
+		Key:           record.Key,
+		SchemaVersion: record.SchemaVersion,
+		Codec:         record.Codec,
+		Compressed:    record.Compressed,
+		DeadLetter: &DeadLetter{
+			SourceTopic:  sourceTopic,
+			SourceOffset: record.Offset,
+			Error:        reason,
+		},
+	}
+}
@@ -2,6 +2,7 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
@@ -32,3 +33,344 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic: %q", e.Topic))
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTooManyTopics 作成できるトピックの数の上限に達したため、新しいトピックを作成できないことを示すエラー
+type ErrTooManyTopics struct {
+	Topic string
+	Max   int
+}
+
+func (e ErrTooManyTopics) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, fmt.Sprintf("cannot create topic %q: limit of %d topics reached", e.Topic, e.Max))
+}
+
+func (e ErrTooManyTopics) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetMismatch struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrOffsetMismatch) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("offset mismatch: expected %d, actual %d", e.Expected, e.Actual),
+	)
+
+	// クライアントが次に書き込むべきオフセットを取り出せるよう、実際のオフセットを付与
+	d := &errdetails.ErrorInfo{
+		Reason: "OFFSET_MISMATCH",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"actual_offset":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrOffsetMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrDiskFull データディレクトリのファイルシステムに空きがないことを示すエラー
+type ErrDiskFull struct {
+	Err error
+}
+
+func (e ErrDiskFull) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, fmt.Sprintf("disk full: %v", e.Err))
+}
+
+func (e ErrDiskFull) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrDiskFull) Unwrap() error {
+	return e.Err
+}
+
+// ErrReadOnlyFilesystem データディレクトリのファイルシステムが読み込み専用であることを示すエラー
+type ErrReadOnlyFilesystem struct {
+	Err error
+}
+
+func (e ErrReadOnlyFilesystem) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("read-only filesystem: %v", e.Err))
+}
+
+func (e ErrReadOnlyFilesystem) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrReadOnlyFilesystem) Unwrap() error {
+	return e.Err
+}
+
+type ErrSegmentNotFound struct {
+	BaseOffset uint64
+}
+
+func (e ErrSegmentNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("segment not found: %d", e.BaseOffset))
+}
+
+func (e ErrSegmentNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidRecord レコードがConfig.Validateによって拒否されたことを示すエラー
+type ErrInvalidRecord struct {
+	Err error
+}
+
+func (e ErrInvalidRecord) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid record: %v", e.Err))
+}
+
+func (e ErrInvalidRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrInvalidRecord) Unwrap() error {
+	return e.Err
+}
+
+// ErrIndexUnhealthy インデックスファイルの大きさがメモリにマップした大きさと一致しないことを示すエラー
+type ErrIndexUnhealthy struct {
+	Path   string
+	Size   int64
+	Mapped int
+}
+
+func (e ErrIndexUnhealthy) GRPCStatus() *status.Status {
+	return status.New(
+		codes.DataLoss,
+		fmt.Sprintf("index %s unhealthy: file size %d, mapped %d bytes", e.Path, e.Size, e.Mapped),
+	)
+}
+
+func (e ErrIndexUnhealthy) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrKeyNotFound struct {
+	Key []byte
+}
+
+func (e ErrKeyNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("key not found: %q", e.Key))
+}
+
+func (e ErrKeyNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordIDNotFound IDに一致するレコードが見つからなかったことを示すエラー
+type ErrRecordIDNotFound struct {
+	ID string
+}
+
+func (e ErrRecordIDNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("record id not found: %q", e.ID))
+}
+
+func (e ErrRecordIDNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNoMatchingRecord 条件を満たすレコードが見つからなかったことを示すエラー
+type ErrNoMatchingRecord struct {
+	From uint64
+}
+
+func (e ErrNoMatchingRecord) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("no matching record at or before offset %d", e.From))
+}
+
+func (e ErrNoMatchingRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetUnavailable オフセットを含むセグメントが壊れていて、読み出せないことを示すエラー
+type ErrOffsetUnavailable struct {
+	Offset uint64
+}
+
+func (e ErrOffsetUnavailable) GRPCStatus() *status.Status {
+	return status.New(codes.DataLoss, fmt.Sprintf("offset unavailable, segment is corrupt: %d", e.Offset))
+}
+
+func (e ErrOffsetUnavailable) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordTooLarge レコードが、領域を確保した1つのセグメントのストアに収まらない大きさであることを示すエラー
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d bytes, max %d bytes", e.Size, e.Max),
+	)
+
+	// クライアントが分割する大きさを決められるよう、上限を付与
+	d := &errdetails.ErrorInfo{
+		Reason: "RECORD_TOO_LARGE",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"size":     strconv.FormatUint(e.Size, 10),
+			"max_size": strconv.FormatUint(e.Max, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrCircuitOpen 書き込みの失敗が続いたため、ログが書き込みを一時的に受け付けていないことを示すエラー
+type ErrCircuitOpen struct {
+	// Err 遮断する原因になった最後のエラー
+	Err error
+}
+
+func (e ErrCircuitOpen) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, fmt.Sprintf("circuit open after repeated write failures: %v", e.Err))
+}
+
+func (e ErrCircuitOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrCircuitOpen) Unwrap() error {
+	return e.Err
+}
+
+// ErrLogLocked ログのディレクトリを別のプロセスやLogが書き込み用に開いていることを示すエラー
+type ErrLogLocked struct {
+	Dir string
+}
+
+func (e ErrLogLocked) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("log is locked by another writer: %s", e.Dir))
+}
+
+func (e ErrLogLocked) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogReadOnly 読み込み専用で開いたログに書き込もうとしたことを示すエラー
+type ErrLogReadOnly struct {
+	Dir string
+}
+
+func (e ErrLogReadOnly) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("log is opened read-only: %s", e.Dir))
+}
+
+func (e ErrLogReadOnly) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordExpired レコードの有効期間が過ぎていて、読み出せないことを示すエラー
+type ErrRecordExpired struct {
+	Offset uint64
+}
+
+func (e ErrRecordExpired) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("record expired: %d", e.Offset))
+}
+
+func (e ErrRecordExpired) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogClosed 閉じたログを操作しようとしたことを示すエラー
+type ErrLogClosed struct {
+	Dir string
+}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, fmt.Sprintf("log is closed: %s", e.Dir))
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrReadScanLimit 読み出すレコードのセグメントを探すときに、調べるセグメントの数が上限を超えたことを示すエラー
+type ErrReadScanLimit struct {
+	Offset uint64
+	Max    int
+}
+
+func (e ErrReadScanLimit) GRPCStatus() *status.Status {
+	return status.New(
+		codes.Internal,
+		fmt.Sprintf("read of offset %d scanned more than %d segments; check the segment size configuration", e.Offset, e.Max),
+	)
+}
+
+func (e ErrReadScanLimit) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetNotSynced フォロワーで、まだ同期されていないオフセットを読み出そうとしたことを示すエラー
+type ErrOffsetNotSynced struct {
+	Offset uint64
+	Synced uint64
+}
+
+func (e ErrOffsetNotSynced) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, fmt.Sprintf("offset not synced yet: %d, synced up to %d", e.Offset, e.Synced))
+}
+
+func (e ErrOffsetNotSynced) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrHighestMismatch AppendIfMatchで期待した最大のオフセットが、実際の最大のオフセットと一致しないことを示すエラー
+type ErrHighestMismatch struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrHighestMismatch) GRPCStatus() *status.Status {
+	return status.New(
+		codes.Aborted,
+		fmt.Sprintf("highest offset mismatch: expected %d, actual %d", e.Expected, e.Actual),
+	)
+}
+
+func (e ErrHighestMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -23,11 +23,27 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LogClient interface {
 	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
+	// レコードを追加し、書き込んだセグメントを安定したストレージに同期してからオフセットを返すRPC
+	ProduceSync(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
-	// クライアントがサーバにリクエストを送信し、一連のメッセージを読み出すためのストリームを受信するストリーミングRPC
-	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
+	// クライアントが最初にリクエストを送信し、一連のメッセージを受信しながら処理したオフセットをackとして送り返す双方向ストリーミングRPC
+	ConsumeStream(ctx context.Context, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	// クライアントとサーバの量が読み書き可能なストリームを使って、一連のメッセージを送信する双方向ストリーミングRPC
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
+	// サーバのバージョンと、有効になっているオプション機能の一覧を返すRPC
+	Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error)
+	// コンシューマグループが処理を終えたオフセットを記録するRPC
+	CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetResponse, error)
+	// コンシューマグループが最後にコミットしたオフセットを返すRPC
+	CommittedOffset(ctx context.Context, in *CommittedOffsetRequest, opts ...grpc.CallOption) (*CommittedOffsetResponse, error)
+	// ログの読み出せるオフセットの範囲を返すRPC
+	GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error)
+	// 書き込みの終わったセグメントのストアとインデックスをそのまま分割して送り、レプリカを作成させるサーバストリーミングRPC
+	ReplicateSegments(ctx context.Context, in *ReplicateSegmentsRequest, opts ...grpc.CallOption) (Log_ReplicateSegmentsClient, error)
+	// セグメントの切り替えや認可の拒否など、サーバの内部で発生したイベントを送り続けるデバッグ用のサーバストリーミングRPC
+	Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (Log_EventsClient, error)
+	// 処理に失敗したレコードに元のオフセットと理由を付与し、デッドレターのトピックに追加するRPC
+	ProduceDeadLetter(ctx context.Context, in *ProduceDeadLetterRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
 }
 
 type logClient struct {
@@ -47,6 +63,15 @@ func (c *logClient) Produce(ctx context.Context, in *ProduceRequest, opts ...grp
 	return out, nil
 }
 
+func (c *logClient) ProduceSync(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error) {
+	out := new(ProduceResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/ProduceSync", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *logClient) Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error) {
 	out := new(ConsumeResponse)
 	err := c.cc.Invoke(ctx, "/log.v1.Log/Consume", in, out, opts...)
@@ -56,22 +81,17 @@ func (c *logClient) Consume(ctx context.Context, in *ConsumeRequest, opts ...grp
 	return out, nil
 }
 
-func (c *logClient) ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error) {
+func (c *logClient) ConsumeStream(ctx context.Context, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error) {
 	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[0], "/log.v1.Log/ConsumeStream", opts...)
 	if err != nil {
 		return nil, err
 	}
 	x := &logConsumeStreamClient{stream}
-	if err := x.ClientStream.SendMsg(in); err != nil {
-		return nil, err
-	}
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
-	}
 	return x, nil
 }
 
 type Log_ConsumeStreamClient interface {
+	Send(*ConsumeStreamRequest) error
 	Recv() (*ConsumeResponse, error)
 	grpc.ClientStream
 }
@@ -80,6 +100,10 @@ type logConsumeStreamClient struct {
 	grpc.ClientStream
 }
 
+func (x *logConsumeStreamClient) Send(m *ConsumeStreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
 func (x *logConsumeStreamClient) Recv() (*ConsumeResponse, error) {
 	m := new(ConsumeResponse)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
@@ -119,16 +143,141 @@ func (x *logProduceStreamClient) Recv() (*ProduceResponse, error) {
 	return m, nil
 }
 
+func (c *logClient) Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error) {
+	out := new(CapabilitiesResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/Capabilities", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetResponse, error) {
+	out := new(CommitOffsetResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/CommitOffset", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) CommittedOffset(ctx context.Context, in *CommittedOffsetRequest, opts ...grpc.CallOption) (*CommittedOffsetResponse, error) {
+	out := new(CommittedOffsetResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/CommittedOffset", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error) {
+	out := new(GetMetadataResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetMetadata", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) ReplicateSegments(ctx context.Context, in *ReplicateSegmentsRequest, opts ...grpc.CallOption) (Log_ReplicateSegmentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[2], "/log.v1.Log/ReplicateSegments", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logReplicateSegmentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_ReplicateSegmentsClient interface {
+	Recv() (*SegmentChunk, error)
+	grpc.ClientStream
+}
+
+type logReplicateSegmentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logReplicateSegmentsClient) Recv() (*SegmentChunk, error) {
+	m := new(SegmentChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (Log_EventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[3], "/log.v1.Log/Events", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_EventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type logEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) ProduceDeadLetter(ctx context.Context, in *ProduceDeadLetterRequest, opts ...grpc.CallOption) (*ProduceResponse, error) {
+	out := new(ProduceResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/ProduceDeadLetter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
 type LogServer interface {
 	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
+	// レコードを追加し、書き込んだセグメントを安定したストレージに同期してからオフセットを返すRPC
+	ProduceSync(context.Context, *ProduceRequest) (*ProduceResponse, error)
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
-	// クライアントがサーバにリクエストを送信し、一連のメッセージを読み出すためのストリームを受信するストリーミングRPC
-	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
+	// クライアントが最初にリクエストを送信し、一連のメッセージを受信しながら処理したオフセットをackとして送り返す双方向ストリーミングRPC
+	ConsumeStream(Log_ConsumeStreamServer) error
 	// クライアントとサーバの量が読み書き可能なストリームを使って、一連のメッセージを送信する双方向ストリーミングRPC
 	ProduceStream(Log_ProduceStreamServer) error
+	// サーバのバージョンと、有効になっているオプション機能の一覧を返すRPC
+	Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error)
+	// コンシューマグループが処理を終えたオフセットを記録するRPC
+	CommitOffset(context.Context, *CommitOffsetRequest) (*CommitOffsetResponse, error)
+	// コンシューマグループが最後にコミットしたオフセットを返すRPC
+	CommittedOffset(context.Context, *CommittedOffsetRequest) (*CommittedOffsetResponse, error)
+	// ログの読み出せるオフセットの範囲を返すRPC
+	GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error)
+	// 書き込みの終わったセグメントのストアとインデックスをそのまま分割して送り、レプリカを作成させるサーバストリーミングRPC
+	ReplicateSegments(*ReplicateSegmentsRequest, Log_ReplicateSegmentsServer) error
+	// セグメントの切り替えや認可の拒否など、サーバの内部で発生したイベントを送り続けるデバッグ用のサーバストリーミングRPC
+	Events(*EventsRequest, Log_EventsServer) error
+	// 処理に失敗したレコードに元のオフセットと理由を付与し、デッドレターのトピックに追加するRPC
+	ProduceDeadLetter(context.Context, *ProduceDeadLetterRequest) (*ProduceResponse, error)
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -139,15 +288,39 @@ type UnimplementedLogServer struct {
 func (UnimplementedLogServer) Produce(context.Context, *ProduceRequest) (*ProduceResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Produce not implemented")
 }
+func (UnimplementedLogServer) ProduceSync(context.Context, *ProduceRequest) (*ProduceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProduceSync not implemented")
+}
 func (UnimplementedLogServer) Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Consume not implemented")
 }
-func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error {
+func (UnimplementedLogServer) ConsumeStream(Log_ConsumeStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ConsumeStream not implemented")
 }
 func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServer) Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capabilities not implemented")
+}
+func (UnimplementedLogServer) CommitOffset(context.Context, *CommitOffsetRequest) (*CommitOffsetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitOffset not implemented")
+}
+func (UnimplementedLogServer) CommittedOffset(context.Context, *CommittedOffsetRequest) (*CommittedOffsetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommittedOffset not implemented")
+}
+func (UnimplementedLogServer) GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMetadata not implemented")
+}
+func (UnimplementedLogServer) ReplicateSegments(*ReplicateSegmentsRequest, Log_ReplicateSegmentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReplicateSegments not implemented")
+}
+func (UnimplementedLogServer) Events(*EventsRequest, Log_EventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Events not implemented")
+}
+func (UnimplementedLogServer) ProduceDeadLetter(context.Context, *ProduceDeadLetterRequest) (*ProduceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProduceDeadLetter not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -179,6 +352,24 @@ func _Log_Produce_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Log_ProduceSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ProduceSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/ProduceSync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ProduceSync(ctx, req.(*ProduceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Log_Consume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ConsumeRequest)
 	if err := dec(in); err != nil {
@@ -198,15 +389,12 @@ func _Log_Consume_Handler(srv interface{}, ctx context.Context, dec func(interfa
 }
 
 func _Log_ConsumeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(ConsumeRequest)
-	if err := stream.RecvMsg(m); err != nil {
-		return err
-	}
-	return srv.(LogServer).ConsumeStream(m, &logConsumeStreamServer{stream})
+	return srv.(LogServer).ConsumeStream(&logConsumeStreamServer{stream})
 }
 
 type Log_ConsumeStreamServer interface {
 	Send(*ConsumeResponse) error
+	Recv() (*ConsumeStreamRequest, error)
 	grpc.ServerStream
 }
 
@@ -218,6 +406,14 @@ func (x *logConsumeStreamServer) Send(m *ConsumeResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func (x *logConsumeStreamServer) Recv() (*ConsumeStreamRequest, error) {
+	m := new(ConsumeStreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _Log_ProduceStream_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(LogServer).ProduceStream(&logProduceStreamServer{stream})
 }
@@ -244,6 +440,138 @@ func (x *logProduceStreamServer) Recv() (*ProduceRequest, error) {
 	return m, nil
 }
 
+func _Log_Capabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).Capabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/Capabilities",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).Capabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_CommitOffset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitOffsetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).CommitOffset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/CommitOffset",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).CommitOffset(ctx, req.(*CommitOffsetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_CommittedOffset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommittedOffsetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).CommittedOffset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/CommittedOffset",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).CommittedOffset(ctx, req.(*CommittedOffsetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetMetadata",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetMetadata(ctx, req.(*GetMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_ReplicateSegments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReplicateSegmentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).ReplicateSegments(m, &logReplicateSegmentsServer{stream})
+}
+
+type Log_ReplicateSegmentsServer interface {
+	Send(*SegmentChunk) error
+	grpc.ServerStream
+}
+
+type logReplicateSegmentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logReplicateSegmentsServer) Send(m *SegmentChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_Events_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).Events(m, &logEventsServer{stream})
+}
+
+type Log_EventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type logEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_ProduceDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceDeadLetterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ProduceDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/ProduceDeadLetter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ProduceDeadLetter(ctx, req.(*ProduceDeadLetterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Log_ServiceDesc is the grpc.ServiceDesc for Log service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -255,16 +583,41 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Produce",
 			Handler:    _Log_Produce_Handler,
 		},
+		{
+			MethodName: "ProduceSync",
+			Handler:    _Log_ProduceSync_Handler,
+		},
 		{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "Capabilities",
+			Handler:    _Log_Capabilities_Handler,
+		},
+		{
+			MethodName: "CommitOffset",
+			Handler:    _Log_CommitOffset_Handler,
+		},
+		{
+			MethodName: "CommittedOffset",
+			Handler:    _Log_CommittedOffset_Handler,
+		},
+		{
+			MethodName: "GetMetadata",
+			Handler:    _Log_GetMetadata_Handler,
+		},
+		{
+			MethodName: "ProduceDeadLetter",
+			Handler:    _Log_ProduceDeadLetter_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ConsumeStream",
 			Handler:       _Log_ConsumeStream_Handler,
 			ServerStreams: true,
+			ClientStreams: true,
 		},
 		{
 			StreamName:    "ProduceStream",
@@ -272,6 +625,16 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ReplicateSegments",
+			Handler:       _Log_ReplicateSegments_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Events",
+			Handler:       _Log_Events_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/v1/log.proto",
 }
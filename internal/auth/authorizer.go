@@ -1,30 +1,108 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Attributes 認可の判定に使えるリクエストの属性。
+// モデルのrequest_definitionに4つ目の要素がある場合のみ渡され、マッチャーからr.attr.Offsetのように参照できる
+type Attributes struct {
+	// Peer クライアントのアドレス
+	Peer string
+	// Time リクエストを受け付けた時刻
+	Time time.Time
+	// Topic 読み書きするトピック。空の場合はデフォルトのログ
+	Topic string
+	// Offset 読み出すオフセット。書き込みの場合は期待するオフセット
+	Offset uint64
+}
+
 type Authorizer struct {
+	// mu ポリシーの読み込み直しと判定が同時に行われないよう保護する
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	// withAttributes モデルがリクエストの属性を受け取るか
+	withAttributes bool
+	// generation ポリシーを読み込み直すたびに増える。キャッシュの無効化に使う
+	generation uint64
+}
+
+// enforce casbinで認可を判定する。テストで呼び出し回数を数えるために変数にしている
+var enforce = func(e *casbin.Enforcer, rvals ...interface{}) (bool, error) {
+	return e.Enforce(rvals...)
 }
 
-func New(model, policy string) (*Authorizer, error) {
-	enforcer, err := casbin.NewEnforcer(model, policy)
+// New modelと、policiesのポリシーファイルをまとめた認可を作成する。
+// ポリシーファイルは順に読み込んで1つのポリシーとして判定するので、ルールが衝突した場合はモデルのpolicy_effectに従う。
+// 例えばe = some(where (p.eft == allow)) && !some(where (p.eft == deny))とすると、どのファイルにあっても明示的なdenyが優先される。
+// 共通のポリシーに、チームごとのポリシーを重ねる場合に使う
+func New(model string, policies ...string) (*Authorizer, error) {
+	enforcer, err := casbin.NewEnforcer(model, policyFiles(policies))
 	if err != nil {
 		return nil, err
 	}
+	// INFO: ポリシーの値は文字列なので、属性の数値と比較できるようnumber関数を用意する
+	enforcer.AddFunction("number", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("number: expected 1 argument, got %d", len(args))
+		}
+		return strconv.ParseFloat(fmt.Sprint(args[0]), 64)
+	})
 
 	return &Authorizer{
-		enforcer: enforcer,
+		enforcer:       enforcer,
+		withAttributes: len(enforcer.GetModel()["r"]["r"].Tokens) > 3,
 	}, nil
 }
 
-func (a *Authorizer) Authorize(subject, object, action string) error {
-	ok, err := a.enforcer.Enforce(subject, object, action)
+// policyFiles 複数のポリシーファイルを、指定した順に読み込むアダプター。Reloadでもすべてのファイルを読み込み直す
+type policyFiles []string
+
+func (p policyFiles) LoadPolicy(m model.Model) error {
+	for _, path := range p {
+		if err := fileadapter.NewAdapter(path).LoadPolicy(m); err != nil {
+			return fmt.Errorf("load policy %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// INFO: ポリシーファイルは読み込むだけで、実行中に書き換えない
+func (p policyFiles) SavePolicy(model.Model) error {
+	return errors.New("not implemented")
+}
+
+func (p policyFiles) AddPolicy(string, string, []string) error {
+	return errors.New("not implemented")
+}
+
+func (p policyFiles) RemovePolicy(string, string, []string) error {
+	return errors.New("not implemented")
+}
+
+func (p policyFiles) RemoveFilteredPolicy(string, string, int, ...string) error {
+	return errors.New("not implemented")
+}
+
+func (a *Authorizer) Authorize(subject, object, action string, attrs Attributes) error {
+	rvals := []interface{}{subject, object, action}
+	if a.withAttributes {
+		rvals = append(rvals, attrs)
+	}
+	a.mu.RLock()
+	ok, err := enforce(a.enforcer, rvals...)
+	a.mu.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -42,3 +120,63 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 
 	return nil
 }
+
+// Reload ポリシーを読み込み直し、作成済みのキャッシュを無効にする
+func (a *Authorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.enforcer.LoadPolicy(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&a.generation, 1)
+	return nil
+}
+
+// Cache 1つの接続で行った認可の判定を覚えておき、同じ判定を繰り返さないようにする。
+// モデルがリクエストの属性を受け取る場合は、判定が属性に依存するのでキャッシュしない
+type Cache struct {
+	authorizer *Authorizer
+	mu         sync.Mutex
+	generation uint64
+	decisions  map[cacheKey]error
+}
+
+type cacheKey struct {
+	subject, object, action string
+}
+
+// NewCache 接続ごとに使うキャッシュを作成する
+func (a *Authorizer) NewCache() *Cache {
+	return &Cache{
+		authorizer: a,
+		generation: atomic.LoadUint64(&a.generation),
+		decisions:  make(map[cacheKey]error),
+	}
+}
+
+func (c *Cache) Authorize(subject, object, action string, attrs Attributes) error {
+	if c.authorizer.withAttributes {
+		return c.authorizer.Authorize(subject, object, action, attrs)
+	}
+
+	key := cacheKey{subject, object, action}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// ポリシーが読み込み直されていれば、これまでの判定を捨てる
+	if gen := atomic.LoadUint64(&c.authorizer.generation); gen != c.generation {
+		c.generation = gen
+		c.decisions = make(map[cacheKey]error)
+	}
+	if err, ok := c.decisions[key]; ok {
+		return err
+	}
+
+	err := c.authorizer.Authorize(subject, object, action, attrs)
+	// INFO: 許可と拒否だけを覚え、判定中のエラーは次の呼び出しで改めて判定する
+	if err == nil || status.Code(err) == codes.PermissionDenied {
+		c.decisions[key] = err
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ポリシーで定めたオフセット以上の読み出しを拒否するモデルで認可できるか
+func TestAuthorizeAttributes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "authorizer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	model := filepath.Join(dir, "model.conf")
+	require.NoError(t, os.WriteFile(model, []byte(`[request_definition]
+r = sub, obj, act, attr
+
+[policy_definition]
+p = sub, obj, act, max_offset
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.act == p.act && r.attr.Offset < number(p.max_offset)
+`), 0644))
+	policy := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(policy, []byte("p, alice, *, consume, 10\n"), 0644))
+
+	authorizer, err := New(model, policy)
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Authorize("alice", "*", "consume", Attributes{Offset: 9}))
+	err = authorizer.Authorize("alice", "*", "consume", Attributes{Offset: 10})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// 同じ判定はキャッシュされ、ポリシーを読み込み直すと無効になるか
+func TestCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "authorizer-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	model := filepath.Join(dir, "model.conf")
+	require.NoError(t, os.WriteFile(model, []byte(`[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`), 0644))
+	policy := filepath.Join(dir, "policy.csv")
+	require.NoError(t, os.WriteFile(policy, []byte("p, alice, *, produce\n"), 0644))
+
+	authorizer, err := New(model, policy)
+	require.NoError(t, err)
+
+	orig := enforce
+	defer func() { enforce = orig }()
+	var calls int
+	enforce = func(e *casbin.Enforcer, rvals ...interface{}) (bool, error) {
+		calls++
+		return orig(e, rvals...)
+	}
+
+	cache := authorizer.NewCache()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cache.Authorize("alice", "*", "produce", Attributes{}))
+		err = cache.Authorize("alice", "*", "consume", Attributes{})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+	require.Equal(t, 2, calls)
+
+	// ポリシーを読み込み直すと、改めて判定される
+	require.NoError(t, os.WriteFile(policy, []byte("p, alice, *, consume\n"), 0644))
+	require.NoError(t, authorizer.Reload())
+	err = cache.Authorize("alice", "*", "produce", Attributes{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.NoError(t, cache.Authorize("alice", "*", "consume", Attributes{}))
+	require.Equal(t, 4, calls)
+}
+
+// 共通のポリシーに重ねたポリシーの明示的なdenyが優先され、読み込み直しでも両方のファイルが反映されるか
+func TestAuthorizeOverlayPolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "authorizer-overlay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	model := filepath.Join(dir, "model.conf")
+	require.NoError(t, os.WriteFile(model, []byte(`[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act, eft
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = r.sub == p.sub && (p.obj == "*" || r.obj == p.obj) && r.act == p.act
+`), 0644))
+	base := filepath.Join(dir, "base.csv")
+	require.NoError(t, os.WriteFile(base, []byte(
+		"p, alice, *, consume, allow\np, bob, *, consume, allow\n",
+	), 0644))
+	overlay := filepath.Join(dir, "overlay.csv")
+	require.NoError(t, os.WriteFile(overlay, []byte("p, bob, secret, consume, deny\n"), 0644))
+
+	authorizer, err := New(model, base, overlay)
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Authorize("alice", "secret", "consume", Attributes{}))
+	require.NoError(t, authorizer.Authorize("bob", "public", "consume", Attributes{}))
+	err = authorizer.Authorize("bob", "secret", "consume", Attributes{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 重ねたポリシーを書き換えて読み込み直すと、共通のポリシーを残したまま反映される
+	require.NoError(t, os.WriteFile(overlay, []byte("p, alice, secret, consume, deny\n"), 0644))
+	require.NoError(t, authorizer.Reload())
+	require.NoError(t, authorizer.Authorize("bob", "secret", "consume", Attributes{}))
+	err = authorizer.Authorize("alice", "secret", "consume", Attributes{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 存在しないポリシーファイルはエラーになる
+	_, err = New(model, base, filepath.Join(dir, "missing.csv"))
+	require.Error(t, err)
+}
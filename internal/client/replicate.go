@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/log"
+)
+
+// ReplicateSegments ReplicateSegmentsで受け取ったセグメントのファイルを、cの設定に従ってdirに書き込む。
+// 受け取り終えたセグメントの次のオフセットを返すので、ストリームが途中で切れた場合はその値をfrom_base_offsetにして続きから受け取れる。
+// 途中まで受け取ったセグメントのファイルは削除する。書き込んだ後、dirはcと同じ設定のNewLogで開ける
+func ReplicateSegments(
+	ctx context.Context,
+	client api.LogClient,
+	req *api.ReplicateSegmentsRequest,
+	dir string,
+	c log.Config,
+) (next uint64, err error) {
+	next = req.FromBaseOffset
+	stream, err := client.ReplicateSegments(ctx, req)
+	if err != nil {
+		return next, err
+	}
+
+	var w *log.SegmentWriter
+	var base uint64
+	defer func() {
+		if w != nil {
+			_ = w.Remove()
+		}
+	}()
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			if w != nil {
+				return next, io.ErrUnexpectedEOF
+			}
+			return next, nil
+		}
+		if err != nil {
+			return next, err
+		}
+
+		if w == nil {
+			if w, err = log.NewSegmentWriter(dir, c, chunk.BaseOffset); err != nil {
+				return next, err
+			}
+			base = chunk.BaseOffset
+		} else if chunk.BaseOffset != base {
+			return next, fmt.Errorf("segment %d ended without its last chunk", base)
+		}
+
+		switch chunk.File {
+		case api.SegmentFile_SEGMENT_FILE_STORE:
+			err = w.WriteStore(chunk.Data)
+		case api.SegmentFile_SEGMENT_FILE_INDEX:
+			err = w.WriteIndex(chunk.Data)
+		default:
+			err = fmt.Errorf("unknown segment file: %v", chunk.File)
+		}
+		if err != nil {
+			return next, err
+		}
+
+		if chunk.Last {
+			err = w.Close()
+			if err != nil {
+				return next, err
+			}
+			w = nil
+			next = chunk.NextOffset
+		}
+	}
+}
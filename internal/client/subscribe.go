@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Backoff 再接続までの待ち時間。失敗するたびにBaseから倍にしていき、Capを上限とする。
+// 実際に待つ時間は、その半分から全体までの間でランダムに決める
+type Backoff struct {
+	Base time.Duration
+	Cap  time.Duration
+}
+
+// delay attempt回連続で失敗した後に待つ時間を返す
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Base
+	for i := 0; i < attempt && d < b.Cap; i++ {
+		d *= 2
+	}
+	if d > b.Cap {
+		d = b.Cap
+	}
+	// INFO: 再起動したサーバに全クライアントが同時に再接続しないよう、待ち時間をばらつかせる
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(jitter(int64(d-half)+1))
+}
+
+var (
+	// jitter 待ち時間をばらつかせるための乱数。テストで差し替えるために変数にしている
+	jitter = rand.Int63n
+	// sleep dだけ待つ。ctxが終了した場合はすぐに返す。テストで差し替えるために変数にしている
+	sleep = func(ctx context.Context, d time.Duration) error {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			return nil
+		}
+	}
+)
+
+// Subscribe reqの範囲のレコードをConsumeStreamで読み出し、受け取った順にhandleに渡す。
+// サーバの再起動などでストリームが切断された場合は、backoffに従って待ってから、最後に受け取ったレコードの次から読み出し直す。
+// レコードを受け取ると接続に成功したとみなし、待ち時間を初期値に戻す。
+// ctxが終了するとnilを、再接続しても解決しないエラーやhandleのエラーはそのまま返す
+func Subscribe(
+	ctx context.Context,
+	client api.LogClient,
+	req *api.ConsumeRequest,
+	backoff Backoff,
+	handle func(*api.Record) error,
+) error {
+	req = &api.ConsumeRequest{
+		Offset:           req.Offset,
+		Topic:            req.Topic,
+		MinSchemaVersion: req.MinSchemaVersion,
+		MaxSchemaVersion: req.MaxSchemaVersion,
+		Follow:           req.Follow,
+		EndOffset:        req.EndOffset,
+		NewOnly:          req.NewOnly,
+	}
+
+	var attempt int
+	for {
+		received, err := consume(ctx, client, req, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if herr, ok := err.(handlerError); ok {
+			return herr.err
+		}
+		if !retryable(err) {
+			return err
+		}
+		if received {
+			attempt = 0
+		}
+
+		if err := sleep(ctx, backoff.delay(attempt)); err != nil {
+			return nil
+		}
+		attempt++
+	}
+}
+
+// consume ストリームを1回開いて、切断されるまでレコードをhandleに渡す。レコードを1件でも受け取った場合はtrueを返す
+func consume(
+	ctx context.Context,
+	client api.LogClient,
+	req *api.ConsumeRequest,
+	handle func(*api.Record) error,
+) (received bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err = stream.Send(&api.ConsumeStreamRequest{
+		Message: &api.ConsumeStreamRequest_Request{Request: req},
+	}); err != nil {
+		return false, err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err = handle(res.Record); err != nil {
+			return received, handlerError{err}
+		}
+		// 再接続した場合は、受け取ったレコードの次から読み出す
+		req.Offset = res.Record.Offset + 1
+		// 購読した後のレコードだけを受け取る場合でも、再接続の間に追加されたレコードを取りこぼさないよう通常の読み出しに切り替える
+		if req.NewOnly {
+			req.NewOnly = false
+			req.Follow = true
+		}
+	}
+}
+
+// handlerError handleが返したエラー。再接続せずにSubscribeから返す
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return e.err.Error()
+}
+
+// retryable 再接続すれば解決しうるエラーかを返す
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// attempt fakeClientがConsumeStreamの1回の呼び出しで返す結果
+type attempt struct {
+	records []*api.Record
+	err     error
+}
+
+// fakeClient attemptsの順にストリームを返すクライアント
+type fakeClient struct {
+	api.LogClient
+	attempts []attempt
+	requests []*api.ConsumeRequest
+}
+
+func (c *fakeClient) ConsumeStream(ctx context.Context, opts ...grpc.CallOption) (api.Log_ConsumeStreamClient, error) {
+	if len(c.attempts) == 0 {
+		return nil, io.EOF
+	}
+	a := c.attempts[0]
+	c.attempts = c.attempts[1:]
+	return &fakeStream{client: c, attempt: a}, nil
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	client  *fakeClient
+	attempt attempt
+}
+
+func (s *fakeStream) Send(req *api.ConsumeStreamRequest) error {
+	r := *req.GetRequest()
+	s.client.requests = append(s.client.requests, &r)
+	return nil
+}
+
+func (s *fakeStream) Recv() (*api.ConsumeResponse, error) {
+	if len(s.attempt.records) > 0 {
+		record := s.attempt.records[0]
+		s.attempt.records = s.attempt.records[1:]
+		return &api.ConsumeResponse{Record: record}, nil
+	}
+	return nil, s.attempt.err
+}
+
+func TestSubscribeBackoff(t *testing.T) {
+	var delays []time.Duration
+	origSleep, origJitter := sleep, jitter
+	defer func() { sleep, jitter = origSleep, origJitter }()
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	// 乱数の代わりに、試行ごとに異なる値でばらつかせる
+	var n int64
+	jitter = func(max int64) int64 {
+		n++
+		return (max - 1) * (n % 3) / 2
+	}
+
+	unavailable := status.Error(codes.Unavailable, "server restarting")
+	client := &fakeClient{attempts: []attempt{
+		{err: unavailable},
+		{err: unavailable},
+		{err: unavailable},
+		{records: []*api.Record{{Offset: 5}, {Offset: 6}}, err: unavailable},
+		{err: unavailable},
+		{records: []*api.Record{{Offset: 7}}, err: io.EOF},
+	}}
+
+	backoff := Backoff{Base: 100 * time.Millisecond, Cap: 300 * time.Millisecond}
+	var offsets []uint64
+	err := Subscribe(context.Background(), client, &api.ConsumeRequest{Offset: 5, Follow: true}, backoff, func(r *api.Record) error {
+		offsets = append(offsets, r.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{5, 6, 7}, offsets)
+
+	// 待ち時間は失敗するたびに倍になり、上限で頭打ちになる。レコードを受け取ると初期値に戻る
+	require.Len(t, delays, 5)
+	for i, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		300 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+	} {
+		require.GreaterOrEqual(t, delays[i], max/2)
+		require.LessOrEqual(t, delays[i], max)
+	}
+	// 同じ上限でもばらつく
+	require.NotEqual(t, delays[0]*2, delays[1])
+
+	// 再接続は受け取ったレコードの次から読み出す
+	require.Equal(t, uint64(5), client.requests[3].Offset)
+	require.Equal(t, uint64(7), client.requests[4].Offset)
+}
+
+func TestSubscribeStopsOnCancel(t *testing.T) {
+	client := &fakeClient{attempts: []attempt{
+		{err: status.Error(codes.Unavailable, "down")},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Subscribe(ctx, client, &api.ConsumeRequest{}, Backoff{Base: time.Hour, Cap: time.Hour}, func(*api.Record) error {
+			return nil
+		})
+	}()
+
+	// 待っている間にキャンセルしても、すぐに返る
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe did not return after cancel")
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	// 再接続しても解決しないエラーはそのまま返す
+	denied := status.Error(codes.PermissionDenied, "denied")
+	client := &fakeClient{attempts: []attempt{{err: denied}}}
+	err := Subscribe(context.Background(), client, &api.ConsumeRequest{}, Backoff{}, func(*api.Record) error {
+		return nil
+	})
+	require.Equal(t, denied, err)
+
+	// handleのエラーもそのまま返す
+	stop := errors.New("stop")
+	client = &fakeClient{attempts: []attempt{{records: []*api.Record{{Offset: 0}}}}}
+	err = Subscribe(context.Background(), client, &api.ConsumeRequest{}, Backoff{}, func(*api.Record) error {
+		return stop
+	})
+	require.Equal(t, stop, err)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	stdlog "log"
 	"os"
 )
 
@@ -13,6 +14,44 @@ type TLSConfig struct {
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	// SessionTicketKeys サーバがセッションチケットの暗号化に使う鍵。先頭の鍵で暗号化し、すべての鍵で復号する。
+	// 複数のインスタンスで同じ鍵を使うと、別のインスタンスでもセッションを再開できる。空の場合はGoが自動でローテーションする
+	SessionTicketKeys [][32]byte
+	// MinClientVersion サーバが受け入れるクライアントのTLSバージョンの下限。0の場合は確認しない。
+	// ハンドシェイクで弾くと一般的な失敗と区別できないので、TLS1.2以上であればハンドシェイクを終えてから確認し、理由をログに残して拒否する
+	MinClientVersion uint16
+}
+
+// ErrClientTLSVersion クライアントとの接続で合意したTLSバージョンが、MinClientVersionより低いことを表すエラー
+type ErrClientTLSVersion struct {
+	Version uint16
+	Min     uint16
+}
+
+func (e ErrClientTLSVersion) Error() string {
+	return fmt.Sprintf(
+		"client negotiated %s, below the minimum %s",
+		tls.VersionName(e.Version), tls.VersionName(e.Min),
+	)
+}
+
+// verifyClientVersion 接続で合意したTLSバージョンがminより低い場合に、ログに残してErrClientTLSVersionを返す
+func verifyClientVersion(min uint16) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if cs.Version >= min {
+			return nil
+		}
+		err := ErrClientTLSVersion{Version: cs.Version, Min: min}
+		stdlog.Printf("proglog: rejecting TLS connection: %v", err)
+		return err
+	}
+}
+
+// Rotate keyをセッションチケットの新しい暗号化の鍵としてtlsConfigに設定する。
+// 発行済みのチケットで再開できるよう、これまでの鍵は復号用に残す
+func (c *TLSConfig) Rotate(tlsConfig *tls.Config, key [32]byte) {
+	c.SessionTicketKeys = append([][32]byte{key}, c.SessionTicketKeys...)
+	tlsConfig.SetSessionTicketKeys(c.SessionTicketKeys)
 }
 
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
@@ -55,5 +94,15 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		tlsConfig.ServerName = cfg.ServerAddress
 	}
 
+	if cfg.Server && cfg.MinClientVersion != 0 {
+		// INFO: 下限より低いクライアントもハンドシェイクを終えられるようにし、VerifyConnectionで理由を付けて拒否する
+		tlsConfig.MinVersion = tls.VersionTLS12
+		tlsConfig.VerifyConnection = verifyClientVersion(cfg.MinClientVersion)
+	}
+
+	if cfg.Server && len(cfg.SessionTicketKeys) > 0 {
+		tlsConfig.SetSessionTicketKeys(cfg.SessionTicketKeys)
+	}
+
 	return tlsConfig, nil
 }
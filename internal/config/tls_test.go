@@ -0,0 +1,139 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 同じセッションチケットの鍵を持つ別のサーバでセッションを再開できるか
+func TestSessionTicketKeys(t *testing.T) {
+	newServer := func(cfg *TLSConfig) (string, *tls.Config) {
+		cfg.CertFile = ServerCertFile
+		cfg.KeyFile = ServerKeyFile
+		cfg.CAFile = CAFile
+		cfg.Server = true
+		tlsConfig, err := SetupTLSConfig(*cfg)
+		require.NoError(t, err)
+
+		l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				// INFO: セッションチケットはハンドシェイク後に送られるので、クライアントが受け取れるようデータを書き込む
+				conn.Write([]byte{0})
+				conn.Close()
+			}
+		}()
+		return l.Addr().String(), tlsConfig
+	}
+
+	clientConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: RootClientCertFile,
+		KeyFile:  RootClientKeyFile,
+		CAFile:   CAFile,
+	})
+	require.NoError(t, err)
+	clientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	dial := func(addr string) bool {
+		conn, err := tls.Dial("tcp", addr, clientConfig)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		return conn.ConnectionState().DidResume
+	}
+
+	cfg1 := &TLSConfig{SessionTicketKeys: [][32]byte{{1}}}
+	addr1, tlsConfig1 := newServer(cfg1)
+	addr2, _ := newServer(&TLSConfig{SessionTicketKeys: [][32]byte{{1}}})
+	addr3, _ := newServer(&TLSConfig{SessionTicketKeys: [][32]byte{{2}}})
+
+	require.False(t, dial(addr1))
+	require.True(t, dial(addr2))
+
+	// 鍵が異なるサーバでは再開できない
+	require.False(t, dial(addr3))
+
+	// ローテーションしても、以前の鍵で発行されたチケットで再開できる
+	require.False(t, dial(addr1))
+	cfg1.Rotate(tlsConfig1, [32]byte{3})
+	require.Equal(t, [][32]byte{{3}, {1}}, cfg1.SessionTicketKeys)
+	require.True(t, dial(addr1))
+}
+
+// MinClientVersionより低いTLSバージョンのクライアントを、一般的なハンドシェイクの失敗と区別して拒否できるか
+func TestMinClientVersion(t *testing.T) {
+	newServer := func(min uint16) (string, <-chan error) {
+		tlsConfig, err := SetupTLSConfig(TLSConfig{
+			CertFile:         ServerCertFile,
+			KeyFile:          ServerKeyFile,
+			CAFile:           CAFile,
+			Server:           true,
+			MinClientVersion: min,
+		})
+		require.NoError(t, err)
+
+		l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		errs := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			errs <- conn.(*tls.Conn).Handshake()
+		}()
+		return l.Addr().String(), errs
+	}
+
+	dial := func(addr string, max uint16) error {
+		clientConfig, err := SetupTLSConfig(TLSConfig{
+			CertFile: RootClientCertFile,
+			KeyFile:  RootClientKeyFile,
+			CAFile:   CAFile,
+		})
+		require.NoError(t, err)
+		clientConfig.MinVersion = tls.VersionTLS12
+		clientConfig.MaxVersion = max
+		conn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// INFO: TLS1.3ではクライアントの証明書の検証結果をハンドシェイク後に受け取るので、読み込んで拒否されたか確認する
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	// 下限を満たすクライアントは受け入れる
+	addr, errs := newServer(tls.VersionTLS13)
+	require.ErrorIs(t, dial(addr, tls.VersionTLS13), io.EOF)
+	require.NoError(t, <-errs)
+
+	// 下限より低いクライアントは、理由を付けて拒否する
+	addr, errs = newServer(tls.VersionTLS13)
+	require.Error(t, dial(addr, tls.VersionTLS12))
+	var verr ErrClientTLSVersion
+	require.ErrorAs(t, <-errs, &verr)
+	require.Equal(t, ErrClientTLSVersion{Version: tls.VersionTLS12, Min: tls.VersionTLS13}, verr)
+	require.Contains(t, verr.Error(), "TLS 1.2")
+
+	// 下限を設定しない場合は、ハンドシェイクでバージョンが合わずに失敗する
+	addr, errs = newServer(0)
+	require.Error(t, dial(addr, tls.VersionTLS12))
+	err := <-errs
+	require.Error(t, err)
+	require.False(t, errors.As(err, &verr))
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// イベントの種類
+const (
+	// SegmentRolled アクティブセグメントが新しいセグメントに切り替わった
+	SegmentRolled = "segment_rolled"
+	// SegmentsTruncated 古いセグメントが削除された
+	SegmentsTruncated = "segments_truncated"
+	// AuthDenied RPCの認可が拒否された
+	AuthDenied = "auth_denied"
+)
+
+// Event サーバの内部で発生した運用上のイベント
+type Event struct {
+	Kind string
+	Time time.Time
+	// Attrs イベントの詳細。キーはイベントの種類ごとに決まる
+	Attrs map[string]string
+	// Dropped このイベントの前に、購読者の受信が追いつかずに捨てたイベントの数
+	Dropped uint64
+}
+
+// Bus ログや認可で発生したイベントを購読者に配信する。
+// 発行元を待たせないよう、受信が追いついていない購読者へのイベントは捨てる
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Publish イベントを発行する。Busがnilの場合は何もしない
+func (b *Bus) Publish(kind string, attrs map[string]string) {
+	if b == nil {
+		return
+	}
+	e := Event{Kind: kind, Time: time.Now(), Attrs: attrs}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		e.Dropped = s.dropped
+		select {
+		case s.c <- e:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Subscribe 以降に発行されたイベントを受け取る購読を開始する。bufferは受信を待たずに溜めておけるイベントの数
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	s := &Subscription{bus: b, c: make(chan Event, buffer)}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+// Subscription Busのイベントの購読
+type Subscription struct {
+	bus *Bus
+	c   chan Event
+	// dropped 最後に配信してから捨てたイベントの数。Busのロックで保護する
+	dropped uint64
+}
+
+// C イベントを受け取るチャネルを返す。Closeすると閉じられる
+func (s *Subscription) C() <-chan Event {
+	return s.c
+}
+
+// Close 購読を終了する。何度呼び出してもよい
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subs[s]; !ok {
+		return
+	}
+	delete(s.bus.subs, s)
+	close(s.c)
+}
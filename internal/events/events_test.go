@@ -0,0 +1,43 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	// 購読する前のイベントは届かない
+	b.Publish(SegmentRolled, nil)
+
+	sub := b.Subscribe(2)
+	b.Publish(SegmentRolled, map[string]string{"base_offset": "2"})
+	e := <-sub.C()
+	require.Equal(t, SegmentRolled, e.Kind)
+	require.Equal(t, "2", e.Attrs["base_offset"])
+	require.False(t, e.Time.IsZero())
+	require.Zero(t, e.Dropped)
+
+	// 受信が追いつかない場合は捨て、次に届いたイベントで捨てた数を知らせる
+	for i := 0; i < 4; i++ {
+		b.Publish(AuthDenied, nil)
+	}
+	<-sub.C()
+	<-sub.C()
+	b.Publish(SegmentsTruncated, nil)
+	e = <-sub.C()
+	require.Equal(t, SegmentsTruncated, e.Kind)
+	require.Equal(t, uint64(2), e.Dropped)
+
+	// 終了した購読には届かず、チャネルは閉じられる
+	sub.Close()
+	sub.Close()
+	b.Publish(SegmentRolled, nil)
+	_, ok := <-sub.C()
+	require.False(t, ok)
+
+	// nilのBusに発行しても何もしない
+	var nilBus *Bus
+	nilBus.Publish(SegmentRolled, nil)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package log
+
+import "github.com/tysonmote/gommap"
+
+// adviseWillNeed madvise(2)でマップした領域をこれから読み込むことをカーネルに伝え、先読みを促す
+func adviseWillNeed(mmap gommap.MMap) error {
+	return mmap.Advise(gommap.MADV_WILLNEED)
+}
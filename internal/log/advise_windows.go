@@ -0,0 +1,8 @@
+package log
+
+import "github.com/tysonmote/gommap"
+
+// adviseWillNeed Windowsのgommapはmadvise(2)に相当するものを持たないので、先読みを促さない
+func adviseWillNeed(mmap gommap.MMap) error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// AppendReader rから読み出したsizeバイトを値とするレコードを追加し、そのオフセットを返す。
+// 値全体をメモリに読み込まずにストアへ書き込むので、大きな値の追加に使う。値以外のフィールドは持たない。
+// ただし、Validate、Dedup、PreserveOffset、RecordIDsが有効な場合はレコード全体が必要なので、値を読み込んでからAppendと同様に追加する
+func (l *Log) AppendReader(r io.Reader, size int64) (uint64, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("invalid value size: %d", size)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	if l.Config.Validate != nil || l.Config.Segment.Dedup || l.Config.PreserveOffset || l.Config.Segment.RecordIDs {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return 0, err
+		}
+		return l.append(&api.Record{Value: value})
+	}
+
+	if err := l.breakerAllow(); err != nil {
+		return 0, err
+	}
+	if err := l.rolloverIfMaxed(); err != nil {
+		l.breakerRecord(err)
+		return 0, err
+	}
+	off, n, err := l.activeSegment.appendReader(r, uint64(size))
+	l.breakerRecord(err)
+	if err != nil {
+		return 0, fsError(err)
+	}
+	l.Config.Metrics.recordSize(l.Config.Topic, n)
+	l.notifyAppended()
+	l.checkThresholds()
+	return off, nil
+}
+
+// appendReader rから読み出したsizeバイトを値とするレコードを追加する。
+// protobufはフィールドの順序を問わないので、値のフィールドの前後を組み立て、値はrからそのままストアに書き込む。
+// 値とオフセットだけのレコードでは、proto.Marshalと同じバイト列になる。オフセットとシリアライズしたレコードのサイズを返す
+func (s *segment) appendReader(r io.Reader, size uint64) (uint64, uint64, error) {
+	if err := s.index.err(); err != nil {
+		return 0, 0, err
+	}
+
+	cur := s.nextOffset
+	header := protowire.AppendTag(nil, 1, protowire.BytesType)
+	header = protowire.AppendVarint(header, size)
+	trailer, err := proto.Marshal(&api.Record{Offset: cur})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n := uint64(len(header)) + size + uint64(len(trailer))
+	if err = s.checkRecordSize(n + lenWidth); err != nil {
+		return 0, 0, err
+	}
+
+	// INFO: rがsizeより長くても後続のフィールドを読み込まないよう、値はsizeバイトまでに制限する
+	_, pos, err := s.store.AppendFrom(io.MultiReader(
+		bytes.NewReader(header),
+		io.LimitReader(r, int64(size)),
+		bytes.NewReader(trailer),
+	), n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = s.index.Write(uint32(cur-s.baseOffset), pos); err != nil {
+		return 0, 0, err
+	}
+	s.nextOffset++
+	return cur, n, nil
+}
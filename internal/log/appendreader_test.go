@@ -0,0 +1,54 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// AppendReaderで追加した大きな値を、Appendで追加したレコードと同じように読み出せるか
+func TestLogAppendReader(t *testing.T) {
+	const size = 1 << 20
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4 << 20
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	value := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	off, err := log.AppendReader(bytes.NewReader(value), size)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, off, read.Offset)
+	require.True(t, bytes.Equal(value, read.Value))
+
+	// 値がsizeに満たない場合は何も追加されず、続けて追加したレコードも読み出せる
+	_, err = log.AppendReader(bytes.NewReader(value[:10]), size)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	off, err = log.AppendReader(strings.NewReader("hello world and more"), int64(len("hello world")))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err = log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// 開き直しても、途中で失敗した書き込みは残っていない
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), log.NextOffset())
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(value, read.Value))
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,129 @@
+package log
+
+import (
+	"bufio"
+	"io"
+	"sort"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// アーカイブのインデックスのエントリを構成する、オフセットと位置のバイト数
+	archiveOffWidth = 8
+	archivePosWidth = 8
+	archiveEntWidth = archiveOffWidth + archivePosWidth
+)
+
+// ExportArchive 読み出せるすべてのレコードをストアと同じ形式でdataWに書き出し、オフセットとdataW内の位置の組をindexWに書き出す。
+// セグメントごとのファイルに分けず、1つのファイルで長期保存するために使う
+func (l *Log) ExportArchive(dataW, indexW io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+
+	data := bufio.NewWriter(dataW)
+	index := bufio.NewWriter(indexW)
+	var pos uint64
+	entry := make([]byte, archiveEntWidth)
+	for _, s := range l.segments {
+		for off := l.readableFrom(s); off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			p, err := proto.Marshal(record)
+			if err != nil {
+				return err
+			}
+
+			enc.PutUint64(entry[:archiveOffWidth], off)
+			enc.PutUint64(entry[archiveOffWidth:], pos)
+			if _, err = index.Write(entry); err != nil {
+				return err
+			}
+			size := make([]byte, lenWidth)
+			enc.PutUint64(size, uint64(len(p)))
+			if _, err = data.Write(size); err != nil {
+				return err
+			}
+			if _, err = data.Write(p); err != nil {
+				return err
+			}
+			pos += lenWidth + uint64(len(p))
+		}
+	}
+
+	if err := data.Flush(); err != nil {
+		return err
+	}
+	return index.Flush()
+}
+
+// Archive ExportArchiveで書き出したアーカイブを読み出す、読み込み専用のログ
+type Archive struct {
+	data    io.ReaderAt
+	offsets []uint64
+	pos     []uint64
+}
+
+// OpenArchive indexRからインデックスをすべて読み込み、dataRからレコードを読み出すArchiveを返す
+func OpenArchive(dataR io.ReaderAt, indexR io.Reader) (*Archive, error) {
+	a := &Archive{data: dataR}
+	entry := make([]byte, archiveEntWidth)
+	for {
+		if _, err := io.ReadFull(indexR, entry); err != nil {
+			if err == io.EOF {
+				return a, nil
+			}
+			return nil, err
+		}
+		a.offsets = append(a.offsets, enc.Uint64(entry[:archiveOffWidth]))
+		a.pos = append(a.pos, enc.Uint64(entry[archiveOffWidth:]))
+	}
+}
+
+// Read offのレコードを返す。アーカイブに存在しない場合はErrOffsetOutOfRangeを返す
+func (a *Archive) Read(off uint64) (*api.Record, error) {
+	i := sort.Search(len(a.offsets), func(i int) bool {
+		return a.offsets[i] >= off
+	})
+	if i == len(a.offsets) || a.offsets[i] != off {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	size := make([]byte, lenWidth)
+	if _, err := a.data.ReadAt(size, int64(a.pos[i])); err != nil {
+		return nil, err
+	}
+	p := make([]byte, enc.Uint64(size))
+	if _, err := a.data.ReadAt(p, int64(a.pos[i]+lenWidth)); err != nil {
+		return nil, err
+	}
+
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// LowestOffset アーカイブ内の最小のオフセットを返す。空の場合はErrOffsetOutOfRangeを返す
+func (a *Archive) LowestOffset() (uint64, error) {
+	if len(a.offsets) == 0 {
+		return 0, api.ErrOffsetOutOfRange{Offset: 0}
+	}
+	return a.offsets[0], nil
+}
+
+// HighestOffset アーカイブ内の最大のオフセットを返す。空の場合はErrOffsetOutOfRangeを返す
+func (a *Archive) HighestOffset() (uint64, error) {
+	if len(a.offsets) == 0 {
+		return 0, api.ErrOffsetOutOfRange{Offset: 0}
+	}
+	return a.offsets[len(a.offsets)-1], nil
+}
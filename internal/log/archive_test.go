@@ -0,0 +1,49 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// アーカイブに書き出したレコードを読み出せるか
+func TestLogArchive(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.InitialOffset = 3
+	log := newTestLog(t, c)
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	var data, index bytes.Buffer
+	require.NoError(t, log.ExportArchive(&data, &index))
+
+	archive, err := OpenArchive(bytes.NewReader(data.Bytes()), &index)
+	require.NoError(t, err)
+	lowest, err := archive.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+	highest, err := archive.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), highest)
+
+	for off := lowest; off <= highest; off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := archive.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+
+	_, err = archive.Read(8)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
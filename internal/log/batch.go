@@ -0,0 +1,112 @@
+package log
+
+import (
+	"errors"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// AppendBatch recordsを1つのバッチとしてまとめて追加し、最初のレコードのオフセットを返す。
+// バッチはセグメントをまたいでもよい。途中のレコードの追加に失敗した場合は、追加済みのレコードを取り除いてエラーを返す。
+// 各レコードにはバッチの終わりのオフセットを記録するので、書き込みの途中でクラッシュしても、開き直したときに途中までのバッチは取り除かれる
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, errors.New("empty batch")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	first := l.activeSegment.nextOffset
+	end := first + uint64(len(records))
+	for _, record := range records {
+		record.BatchEnd = end
+		if _, _, err := l.appendWithLocation(record); err != nil {
+			if terr := l.truncateFrom(first); terr != nil {
+				return 0, terr
+			}
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+// dropPartialBatch ログの末尾にあるバッチが途中までしか書き込まれていない場合、そのバッチをすべて取り除く。
+// 末尾の読み出せないレコードは書き込みの途中で失われたものとみなし、その手前のレコードが属するバッチが終わっていなければ、
+// 読み出せないレコードも含めて取り除く。開くときに、書き込みのロックを獲得した状態で呼び出す
+func (l *Log) dropPartialBatch() error {
+	lowest, next := l.segments[0].baseOffset, l.activeSegment.nextOffset
+	var last *api.Record
+	for off := next; off > lowest; off-- {
+		if record, err := l.readRaw(off - 1); err == nil {
+			last = record
+			break
+		}
+	}
+	if last == nil || last.BatchEnd <= last.Offset+1 {
+		return nil
+	}
+
+	from := last.Offset
+	for from > lowest {
+		record, err := l.readRaw(from - 1)
+		if err != nil || record.BatchEnd != last.BatchEnd {
+			break
+		}
+		from--
+	}
+	return l.truncateFrom(from)
+}
+
+// readRaw 有効期間や保持期間にかかわらず、offのレコードをセグメントから読み出す。ロックを獲得した状態で呼び出す
+func (l *Log) readRaw(off uint64) (*api.Record, error) {
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s.Read(off)
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// truncateFrom from以降のレコードを取り除き、fromから書き込みを続けられるようにする。
+// すべてのレコードがfrom以降のセグメントは削除するが、最初のセグメントは残す。書き込みのロックを獲得した状態で呼び出す
+func (l *Log) truncateFrom(from uint64) error {
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.nextOffset <= from {
+			break
+		}
+		if s.baseOffset >= from && i > 0 {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			l.segments = l.segments[:i]
+			continue
+		}
+
+		entries := from - s.baseOffset
+		// INFO: 重複排除したセグメントでは取り除くレコードが残すレコードと同じ位置を指しうるので、ストアは切り詰めない
+		if !s.config.Segment.Dedup {
+			_, pos, err := s.index.Read(int64(entries))
+			if err != nil {
+				return err
+			}
+			if err = s.store.truncate(pos); err != nil {
+				return err
+			}
+		}
+		if err := s.index.TruncateTo(int(entries)); err != nil {
+			return err
+		}
+		s.nextOffset = from
+		break
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	if err := l.rebuildKeyIndex(); err != nil {
+		return err
+	}
+	return l.rebuildIDIndex()
+}
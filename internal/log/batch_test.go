@@ -0,0 +1,80 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+func TestLogAppendBatch(t *testing.T) {
+	// 途中のレコードをストアに収まらない大きさにして失敗させるため、領域を確保する
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.PreallocateStore = true
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	value := []byte("hello world")
+	_, err := log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: value}
+		}
+		return records
+	}
+
+	// セグメントをまたいで追加し、各レコードにバッチの終わりを記録する
+	first, err := log.AppendBatch(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Len(t, log.segments, 2)
+	for off := uint64(1); off < 4; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), record.BatchEnd)
+	}
+
+	// 途中のレコードを追加できない場合は、バッチのレコードをすべて取り除く
+	records := batch(3)
+	records[2].Value = make([]byte, 64)
+	_, err = log.AppendBatch(records)
+	require.IsType(t, api.ErrRecordTooLarge{}, err)
+	require.Equal(t, uint64(4), log.NextOffset())
+	_, err = log.Read(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+
+	// 書き込みの途中でクラッシュしたように、バッチの最後のレコードを途中まで書き込まれた状態にする
+	require.NoError(t, log.Close())
+	storePath := filepath.Join(dir, "2.store")
+	fi, err := os.Stat(storePath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(storePath, fi.Size()-3))
+
+	// 開き直すと、読み出せるレコードも含めてバッチ全体が取り除かれる
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(1), log.NextOffset())
+	require.Len(t, log.segments, 1)
+	_, err = os.Stat(storePath)
+	require.True(t, os.IsNotExist(err))
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, value, record.Value)
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+
+	// 取り除いたオフセットから書き込みを続けられる
+	off, err := log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	record, err = log.Read(1)
+	require.NoError(t, err)
+	require.Zero(t, record.BatchEnd)
+}
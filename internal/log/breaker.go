@@ -0,0 +1,75 @@
+package log
+
+import (
+	"errors"
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// breakerNow サーキットブレーカーが使う現在時刻。テストで時間を進めるために変数にしている
+var breakerNow = time.Now
+
+// breaker 書き込みの失敗が続いた場合に、ディスクに触れずに書き込みを失敗させるサーキットブレーカー。
+// Logの書き込みのロックで保護する
+type breaker struct {
+	// failures 連続した失敗の回数
+	failures int
+	// firstFailure 連続した失敗のうち最初の時刻
+	firstFailure time.Time
+	// openUntil 書き込みを遮断する期限。ゼロ値の場合は遮断していない
+	openUntil time.Time
+	// halfOpen 遮断の期限を過ぎ、回復したかを確かめる書き込みを通している場合はtrue
+	halfOpen bool
+	// lastErr 遮断する原因になった最後のエラー
+	lastErr error
+}
+
+// breakerAllow 書き込みを試みてよいかを返す。遮断中はErrCircuitOpenを返し、期限を過ぎていれば1件だけ通して回復を確かめる
+func (l *Log) breakerAllow() error {
+	cb := l.Config.CircuitBreaker
+	b := &l.breaker
+	if cb.Failures <= 0 || b.openUntil.IsZero() {
+		return nil
+	}
+	if breakerNow().Before(b.openUntil) {
+		return api.ErrCircuitOpen{Err: b.lastErr}
+	}
+	b.halfOpen = true
+	return nil
+}
+
+// breakerRecord 書き込みの結果を記録し、連続した失敗がWindowの間にFailures回に達した場合は、Cooldownの間遮断する。
+// 回復を確かめる書き込みが失敗した場合は、すぐに遮断し直す
+func (l *Log) breakerRecord(err error) {
+	cb := l.Config.CircuitBreaker
+	b := &l.breaker
+	if cb.Failures <= 0 {
+		return
+	}
+	// INFO: レコードの大きさや遮断そのものによるエラーはディスクの異常ではないので数えない
+	if errors.As(err, &api.ErrRecordTooLarge{}) || errors.As(err, &api.ErrCircuitOpen{}) {
+		return
+	}
+	if err == nil {
+		*b = breaker{}
+		return
+	}
+
+	now := breakerNow()
+	b.lastErr = err
+	if b.halfOpen {
+		b.halfOpen = false
+		b.openUntil = now.Add(cb.Cooldown)
+		return
+	}
+	if b.failures == 0 || (cb.Window > 0 && now.Sub(b.firstFailure) > cb.Window) {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= cb.Failures {
+		b.failures = 0
+		b.openUntil = now.Add(cb.Cooldown)
+	}
+}
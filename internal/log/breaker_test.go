@@ -0,0 +1,84 @@
+package log
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// ストアへの書き込みの失敗が続くとサーキットブレーカーが遮断し、期間を過ぎて書き込めれば元に戻るか
+func TestLogCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	origNow, origAppend := breakerNow, storeAppend
+	defer func() { breakerNow, storeAppend = origNow, origAppend }()
+	breakerNow = func() time.Time { return now }
+	var failing bool
+	var attempts int
+	storeAppend = func(s *store, p []byte) (uint64, uint64, error) {
+		attempts++
+		if failing {
+			return 0, 0, syscall.EIO
+		}
+		return s.Append(p)
+	}
+
+	c := Config{}
+	c.CircuitBreaker.Failures = 3
+	c.CircuitBreaker.Window = time.Minute
+	c.CircuitBreaker.Cooldown = 10 * time.Second
+	log := newTestLog(t, c)
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := log.Append(record)
+	require.NoError(t, err)
+
+	// Windowを過ぎた失敗は数え直すので、遮断しない
+	failing = true
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(record)
+		require.ErrorIs(t, err, syscall.EIO)
+	}
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(record)
+		require.ErrorIs(t, err, syscall.EIO)
+	}
+
+	// 3回連続で失敗すると遮断し、ストアに書き込まずにUnavailableを返す
+	_, err = log.Append(record)
+	require.ErrorIs(t, err, syscall.EIO)
+	attempts = 0
+	_, err = log.Append(record)
+	require.ErrorAs(t, err, &api.ErrCircuitOpen{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 0, attempts)
+
+	// 遮断している間も読み出せる
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+
+	// 期間を過ぎて試した書き込みが失敗すると、再び遮断する
+	now = now.Add(10 * time.Second)
+	_, err = log.Append(record)
+	require.ErrorIs(t, err, syscall.EIO)
+	require.Equal(t, 1, attempts)
+	_, err = log.Append(record)
+	require.ErrorAs(t, err, &api.ErrCircuitOpen{})
+
+	// 回復した後に試した書き込みが成功すると、遮断を解く
+	failing = false
+	now = now.Add(10 * time.Second)
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
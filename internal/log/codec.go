@@ -0,0 +1,63 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// encodeValue レコードで指定された方式で値を圧縮する
+func encodeValue(codec api.Codec, value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case api.Codec_CODEC_NONE:
+		return value, nil
+	case api.Codec_CODEC_GZIP:
+		w = gzip.NewWriter(&buf)
+	case api.Codec_CODEC_FLATE:
+		// flate.NewWriterは圧縮レベルが不正な場合のみエラーを返す
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, api.ErrInvalidRecord{Err: fmt.Errorf("unknown codec %d", codec)}
+	}
+
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeValue ストアから読み出したレコードの値を、記録されている方式で展開する
+func decodeValue(record *api.Record) error {
+	var r io.ReadCloser
+	switch record.Codec {
+	case api.Codec_CODEC_NONE:
+		return nil
+	case api.Codec_CODEC_GZIP:
+		zr, err := gzip.NewReader(bytes.NewReader(record.Value))
+		if err != nil {
+			return err
+		}
+		r = zr
+	case api.Codec_CODEC_FLATE:
+		r = flate.NewReader(bytes.NewReader(record.Value))
+	default:
+		return fmt.Errorf("record %d: unknown codec %d", record.Offset, record.Codec)
+	}
+	defer r.Close()
+
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	record.Value = value
+	return nil
+}
@@ -0,0 +1,276 @@
+package log
+
+import (
+	"errors"
+	stdlog "log"
+	"os"
+	"path/filepath"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// compactAppend 詰め直し先のログにレコードを追加する。テストで失敗を注入するために変数にしている
+var compactAppend = func(l *Log, record *api.Record) (uint64, error) {
+	return l.Append(record)
+}
+
+// compactRename CompactAndSwapでディレクトリを入れ替えるリネーム。テストで失敗を注入するために変数にしている
+var compactRename = os.Rename
+
+// compactDirs CompactAndSwapで使う、詰め直したログを作成するディレクトリと、元のログを退避するディレクトリを返す。
+// INFO: resetDirsと同様に、中断した詰め直しを開き直すときに見つけられるよう、名前はログのディレクトリから決める
+func compactDirs(dir string) (newDir, oldDir string) {
+	return workDir(dir, ".compact-new"), workDir(dir, ".compact-old")
+}
+
+// recoverCompact 中断したCompactAndSwapの後始末をする。詰め直したログは作成を終えてから入れ替えるので、Resetと同じ手順で復旧できる
+func recoverCompact(dir string) error {
+	newDir, oldDir := compactDirs(dir)
+	return recoverSwap(dir, newDir, oldDir)
+}
+
+// CompactAndSwap 現在の設定に従ってセグメントを一時ディレクトリに詰め直し、成功した場合のみ元のセグメントと入れ替える。
+// 失敗した場合、元のログには一切手を加えない。入れ替えの途中でクラッシュした場合は、次にNewLogで開いたときに入れ替えを完了させる
+func (l *Log) CompactAndSwap() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writable(); err != nil {
+		return err
+	}
+	// ディレクトリのリネームで入れ替えるので、OSのファイルシステムでなければ詰め直せない
+	if l.Config.FS != nil {
+		return errors.New("compaction requires the OS filesystem")
+	}
+
+	// INFO: リネームで入れ替えられるよう、作業用のディレクトリはログと同じ親ディレクトリに作成する
+	newDir, oldDir := compactDirs(l.Dir)
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(newDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(newDir)
+
+	if err := l.compactInto(newDir); err != nil {
+		return err
+	}
+
+	for _, s := range l.segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+
+	// INFO: 元のディレクトリを退避してから詰め直したディレクトリを差し替える。
+	//  2つのリネームの間でクラッシュした場合は、次にNewLogで開いたときに詰め直したディレクトリへ入れ替える
+	if err := compactRename(l.Dir, oldDir); err != nil {
+		return l.reopen(err)
+	}
+	if err := compactRename(newDir, l.Dir); err != nil {
+		if rerr := compactRename(oldDir, l.Dir); rerr != nil {
+			// 元に戻せない場合は閉じたことにし、次にNewLogで開いて復旧できるようロックを解放する
+			l.closed.Store(true)
+			_ = l.unlockDir()
+			return rerr
+		}
+		return l.reopen(err)
+	}
+	if err := syncDir(filepath.Dir(filepath.Clean(l.Dir))); err != nil {
+		return l.reopen(err)
+	}
+	// 入れ替えは完了しているので、退避したディレクトリを削除できなくても失敗にはしない。残ったものは次にNewLogで開いたときに削除する
+	if err := os.RemoveAll(oldDir); err != nil {
+		stdlog.Printf("proglog: removing compacted-out directory %s: %v", oldDir, err)
+	}
+
+	return l.reopen(nil)
+}
+
+// compactedMarker 値を取り除いたマーカーを返す。時刻と有効期間、IDは元のレコードのものを引き継ぐ
+func compactedMarker(record *api.Record) *api.Record {
+	return &api.Record{
+		Key:       record.Key,
+		Timestamp: record.Timestamp,
+		Ttl:       record.Ttl,
+		Id:        record.Id,
+		Compacted: true,
+	}
+}
+
+// compactInto 読み出せるすべてのレコードをオフセットを保ったままdirに作成したログへ書き込む。
+// 欠損した範囲などでオフセットが連続していない場合は、元のセグメントのベースオフセットから始まるセグメントを作成して間を空ける。
+// AppendWithRetentionで読み出せなくしたレコードは書き込まない
+func (l *Log) compactInto(dir string) error {
+	var latest map[string]uint64
+	if l.Config.KeyCompaction {
+		var err error
+		if latest, err = l.latestOffsets(); err != nil {
+			return err
+		}
+	}
+
+	c := l.Config
+	c.Segment.InitialOffset = l.readableFrom(l.segments[0])
+	// INFO: 書き込み済みのレコードとマーカーは検証し直さない。
+	//  一時的なログは自動で詰め直さず、Resetと同様にコールバックやメトリクス、イベントには一時ディレクトリでの書き込みを伝えない
+	c.Validate = nil
+	c.Segment.IndexSyncInterval = 0
+	c.AutoCompact.Interval = 0
+	c.SealOnClose = false
+	c.OnSegmentSealed = nil
+	c.OnThreshold = nil
+	c.OnSegmentsRemoved = nil
+	c.Metrics = nil
+	c.Events = nil
+	nl, err := NewLog(dir, c)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range l.segments {
+		from := l.readableFrom(s)
+		if from > s.nextOffset {
+			from = s.nextOffset
+		}
+		if err = nl.skipTo(from); err != nil {
+			_ = nl.Close()
+			return err
+		}
+		for off := from; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				_ = nl.Close()
+				return err
+			}
+			if latest != nil && len(record.Key) > 0 && latest[string(record.Key)] != off {
+				record = compactedMarker(record)
+			} else if expired(record) {
+				// 有効期間の過ぎたレコードは、オフセットを保つため値を取り除いた印だけを残す
+				record = compactedMarker(record)
+			}
+			if _, err = compactAppend(nl, record); err != nil {
+				_ = nl.Close()
+				return err
+			}
+		}
+	}
+
+	// INFO: 入れ替えた直後にクラッシュしても詰め直したログが欠けないよう、ファイルとディレクトリのエントリを同期してから閉じる
+	if err = nl.Sync(); err != nil {
+		_ = nl.Close()
+		return err
+	}
+	if err = nl.Close(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// skipTo 次に追加するレコードのオフセットがoffより小さい場合、offから始まるセグメントを作成してoffまで進める
+func (l *Log) skipTo(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if off <= l.activeSegment.nextOffset {
+		return nil
+	}
+	return l.newSegment(off)
+}
+
+// latestOffsets キーごとに最新のレコードのオフセットを返す
+func (l *Log) latestOffsets() (map[string]uint64, error) {
+	latest := make(map[string]uint64)
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return nil, err
+			}
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = off
+			}
+		}
+	}
+	return latest, nil
+}
+
+// compactStats マーカーを除いたレコードのうち、最新のものと同じキーを持つ後続のレコードがあるものの数を返す
+func (l *Log) compactStats() (live, dead uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	// INFO: 後続のレコードがあるかを判定するため、新しいレコードから走査する
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		for off := s.nextOffset; off > s.baseOffset; off-- {
+			record, err := s.Read(off - 1)
+			if err != nil {
+				return 0, 0, err
+			}
+			if record.Compacted {
+				continue
+			}
+			if len(record.Key) > 0 {
+				if _, ok := seen[string(record.Key)]; ok {
+					dead++
+					continue
+				}
+				seen[string(record.Key)] = struct{}{}
+			}
+			live++
+		}
+	}
+	return live, dead, nil
+}
+
+// startAutoCompact AutoCompact.Intervalが設定されている場合、条件を満たしたときに詰め直すゴルーチンを起動する
+func (l *Log) startAutoCompact() {
+	l.backgroundMu.Lock()
+	defer l.backgroundMu.Unlock()
+
+	interval := l.Config.AutoCompact.Interval
+	if interval <= 0 || l.autoCompactDone != nil || l.backgroundStopped {
+		return
+	}
+
+	done := make(chan struct{})
+	l.autoCompactDone = done
+	l.autoCompactWG.Add(1)
+	go func() {
+		defer l.autoCompactWG.Done()
+
+		ticks, stop := backgroundTicker(interval)
+		defer stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticks:
+				// 失敗した場合でも元のログには手を加えないので、次の周期で改めて試みる
+				live, dead, err := l.compactStats()
+				if err != nil || float64(dead) < l.Config.AutoCompact.DeadRatio*float64(live+dead) {
+					continue
+				}
+				_ = l.CompactAndSwap()
+			}
+		}
+	}()
+}
+
+// reopen ディスク上のセグメントからログを構築し直す。cause が渡された場合はそれを優先して返す
+func (l *Log) reopen(cause error) error {
+	// INFO: ディレクトリを入れ替えた場合、ロックしているのは元のディレクトリのロックファイルなので、かけ直す
+	if err := l.unlockDir(); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	l.closed.Store(false)
+	if err := l.setup(); err != nil {
+		return err
+	}
+	return cause
+}
@@ -0,0 +1,310 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 詰め直したセグメントに入れ替えても、同じオフセットでレコードを読み出せるか
+func testCompactAndSwap(t *testing.T, log *Log) {
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(ap)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(log.segments))
+
+	// セグメントの上限を大きくしてから詰め直す
+	log.Config.Segment.MaxStoreBytes = 1024
+	require.NoError(t, log.CompactAndSwap())
+	require.Equal(t, 1, len(log.segments))
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, ap.Value, read.Value)
+		require.Equal(t, i, read.Offset)
+	}
+
+	// 入れ替え後も追加できるか
+	off, err := log.Append(ap)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	require.NoError(t, log.Close())
+}
+
+// キーによる詰め直しで、古いレコードが同じオフセットのマーカーに置き換えられるか
+func testCompactByKey(t *testing.T, log *Log) {
+	// 時刻やIDを含むレコードが収まるよう上限を広げる
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	require.NoError(t, log.UpdateConfig(c))
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1"), Timestamp: time.Now().UnixNano(), Id: "a1"},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Key: []byte("a"), Value: []byte("a2"), Ttl: int64(time.Hour)},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a3")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	log.Config.KeyCompaction = true
+	require.NoError(t, log.CompactAndSwap())
+
+	for off, want := range records {
+		read, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, uint64(off), read.Offset)
+		require.Equal(t, want.Key, read.Key)
+
+		if off == 0 || off == 2 {
+			// マーカーは元のレコードの時刻、有効期間、IDを引き継ぐ
+			require.True(t, read.Compacted)
+			require.Empty(t, read.Value)
+			require.Equal(t, want.Timestamp, read.Timestamp)
+			require.Equal(t, want.Ttl, read.Ttl)
+			require.Equal(t, want.Id, read.Id)
+			continue
+		}
+		require.False(t, read.Compacted)
+		require.Equal(t, want.Value, read.Value)
+	}
+}
+
+// 詰め直しの途中で失敗した場合、元のログがそのまま読み出せるか
+func testCompactAndSwapFailure(t *testing.T, log *Log) {
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(ap)
+		require.NoError(t, err)
+	}
+
+	// 2件目のレコードを書き込んだところで失敗させる
+	orig := compactAppend
+	defer func() { compactAppend = orig }()
+	n := 0
+	compactAppend = func(l *Log, record *api.Record) (uint64, error) {
+		if n++; n == 2 {
+			return 0, errors.New("injected failure")
+		}
+		return orig(l, record)
+	}
+
+	log.Config.Segment.MaxStoreBytes = 1024
+	require.Error(t, log.CompactAndSwap())
+	require.Equal(t, 2, len(log.segments))
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, ap.Value, read.Value)
+	}
+
+	// 一時ディレクトリが残っていないか
+	matches, err := filepath.Glob(log.Dir + ".compact-*")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	require.NoError(t, log.Close())
+}
+
+// 古くなったレコードの割合が閾値を超えると自動で詰め直されるか
+func TestLogAutoCompact(t *testing.T) {
+	ticks := fakeTicks(t)
+	c := Config{}
+	c.KeyCompaction = true
+	c.AutoCompact.Interval = time.Minute
+	c.AutoCompact.DeadRatio = 0.5
+	log := newTestLog(t, c)
+
+	for _, value := range []string{"a1", "a2", "a3"} {
+		_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	_, err := log.Append(&api.Record{Key: []byte("b"), Value: []byte("b1")})
+	require.NoError(t, err)
+
+	ticks <- time.Now()
+	ticks <- time.Now()
+	live, dead, err := log.compactStats()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), live)
+	require.Equal(t, uint64(0), dead)
+
+	// 古いレコードはマーカーに置き換えられ、最新の値は残っている
+	for off := uint64(0); off < 2; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.True(t, read.Compacted)
+	}
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a3"), read.Value)
+}
+
+// 読み飛ばしたセグメントがある場合でも、詰め直した後のレコードが元のオフセットのまま読み出せるか
+func TestLogCompactAndSwapKeepsGaps(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello worl%d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Truncate(filepath.Join(dir, "2.store"), 5))
+
+	c.SkipCorruptSegments = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.NoError(t, log.CompactAndSwap())
+
+	for _, off := range []uint64{0, 1, 4, 5} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("hello worl%d", off)), read.Value)
+	}
+	_, err = log.Read(3)
+	require.Error(t, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello worl6")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+// CompactAndSwapがディレクトリを入れ替える途中で中断しても、開き直したときに元のログか詰め直したログのどちらかが残るか
+func TestLogCompactAndSwapRecovery(t *testing.T) {
+	parent, err := os.MkdirTemp("", "compact-recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	want := &api.Record{Value: []byte("hello world")}
+
+	// newLog 3件のレコードを持つログを作成する
+	newLog := func(t *testing.T, dir string) *Log {
+		require.NoError(t, os.Mkdir(dir, 0700))
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = log.Append(want)
+			require.NoError(t, err)
+		}
+		return log
+	}
+	// requireRecords dirを開き直し、3件のレコードが読み出せることとセグメントの数を確認する
+	requireRecords := func(t *testing.T, dir string, segments int) {
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		require.Len(t, log.segments, segments)
+		require.Equal(t, uint64(3), log.NextOffset())
+		for off := uint64(0); off < 3; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, read.Value)
+		}
+		newDir, oldDir := compactDirs(dir)
+		for _, d := range []string{newDir, oldDir} {
+			_, err := os.Stat(d)
+			require.True(t, os.IsNotExist(err), d)
+		}
+	}
+
+	t.Run("recovers the old log after an interrupted swap", func(t *testing.T) {
+		dir := filepath.Join(parent, "interrupted")
+		log := newLog(t, dir)
+
+		// 退避した後のリネームがすべて失敗し、ログのディレクトリがない状態で中断する
+		_, oldDir := compactDirs(dir)
+		defer func() { compactRename = os.Rename }()
+		compactRename = func(from, to string) error {
+			if to == oldDir {
+				return os.Rename(from, to)
+			}
+			return errors.New("injected rename failure")
+		}
+		log.Config.Segment.MaxStoreBytes = 1024
+		require.Error(t, log.CompactAndSwap())
+		_, err := os.Stat(dir)
+		require.True(t, os.IsNotExist(err))
+
+		// 開き直すと詰め直す前のログが戻る
+		requireRecords(t, dir, 2)
+	})
+
+	t.Run("recovers the compacted log after a crash between renames", func(t *testing.T) {
+		dir := filepath.Join(parent, "crashed")
+		log := newLog(t, dir)
+		require.NoError(t, log.Close())
+
+		// 詰め直したログを作成し、元のログを退避したところでクラッシュした状態を作る
+		newDir, oldDir := compactDirs(dir)
+		require.NoError(t, os.Mkdir(newDir, 0700))
+		nc := c
+		nc.Segment.MaxStoreBytes = 1024
+		nl, err := NewLog(newDir, nc)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = nl.Append(want)
+			require.NoError(t, err)
+		}
+		require.NoError(t, nl.Close())
+		require.NoError(t, os.Rename(dir, oldDir))
+
+		// 開き直すと入れ替えが完了し、詰め直したログになる
+		requireRecords(t, dir, 1)
+	})
+}
+
+// CompactAndSwapが一時ディレクトリでの書き込みを、コールバックやメトリクスに伝えないか
+func TestLogCompactAndSwapCallbacks(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	require.NoError(t, err)
+	var calls []string
+	c := Config{Metrics: m}
+	c.Segment.MaxStoreBytes = 32
+	c.Thresholds.Segments = 1
+	c.OnSegmentSealed = func(baseOffset uint64, storePath, indexPath string) {
+		calls = append(calls, storePath)
+	}
+	c.OnThreshold = func(e ThresholdEvent) {
+		calls = append(calls, "threshold")
+	}
+	log := newTestLog(t, c)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NotEmpty(t, calls)
+	rollovers := testutil.ToFloat64(m.rollovers.WithLabelValues(rolloverStore, ""))
+
+	calls = nil
+	require.NoError(t, log.CompactAndSwap())
+	require.Empty(t, calls)
+	require.Equal(t, rollovers, testutil.ToFloat64(m.rollovers.WithLabelValues(rolloverStore, "")))
+}
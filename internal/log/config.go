@@ -1,9 +1,115 @@
 package log
 
+import (
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/events"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxRecords セグメントに格納するレコード数の上限。0の場合は制限しない
+		MaxRecords uint64
+		// PreallocateStore ストアファイルの作成時にMaxStoreBytesまで領域を確保しておく。空のストアにも収まらないレコードはErrRecordTooLargeで拒否する
+		PreallocateStore bool
+		// IndexSyncInterval アクティブセグメントのインデックスとストアをバックグラウンドでSyncする間隔。0の場合はClose時のみ同期する
+		IndexSyncInterval time.Duration
+		// Dedup オフセットと時刻以外が同じレコードをセグメント内で一度だけ保存する。重複とみなしたレコードは最初に保存したレコードの時刻を返す。
+		// 有効期間のあるレコードは重複排除しない。IDはレコードごとに異なるので、RecordIDsとは併用できない。
+		// 有効な場合、Readerが返すレコードの数とオフセットは元のログと一致しない
+		Dedup bool
+		// IndexCacheEntries 直近に書き込んだインデックスのエントリをメモリに保持する件数。
+		// 追加した直後のレコードを読み出すときにマップした領域に触れずに済む。0の場合は保持しない
+		IndexCacheEntries int
+		// CloseSyncAttempts Closeでインデックスの同期が失敗したときに、諦めるまでに試す回数。0の場合は1回だけ試す
+		CloseSyncAttempts int
+		// CloseSyncBackoff Closeでインデックスの同期を再試行するまでの待ち時間。失敗するたびに倍にする
+		CloseSyncBackoff time.Duration
+		// RecordIDs IDが空のレコードに、追加時にUUIDのIDを付与して保存する。詰め直しのマーカーには付与しない
+		RecordIDs bool
+	}
+	// OnSegmentSealed アクティブセグメントが上限に達し、新しいセグメントに切り替わったときに呼び出される。
+	// 書き込みのロックを保持したまま次のレコードを追加する前に同期的に呼び出されるため、ログを操作してはならない。
+	// なお、インデックスファイルはセグメントを閉じるまでMaxIndexBytesの大きさのままである
+	OnSegmentSealed func(baseOffset uint64, storePath, indexPath string)
+	// OnSegmentsRemoved Truncate、AppendWithRetention、TruncateBeforeでセグメントを削除したときと、Resetの後に、
+	// Topicと、ディスクに残っているレコードの最小のオフセットを渡して呼び出される。Resetではすべてのレコードを削除したので、オフセットの最大値を渡す。
+	// ログのロックを保持したまま呼び出される場合があるので、ログを操作してはならない
+	OnSegmentsRemoved func(topic string, lowest uint64)
+	// AutoCompact バックグラウンドでCompactAndSwapを呼び出す条件
+	AutoCompact struct {
+		// Interval 条件を確認する間隔。0の場合は自動で詰め直さない
+		Interval time.Duration
+		// DeadRatio 古くなったレコードの割合がこの値以上の場合に詰め直す。0の場合は周期ごとに必ず詰め直す。
+		// 古くなったレコードとは、同じキーを持つ後続のレコードがあるものをいうので、KeyCompactionと組み合わせて使う
+		DeadRatio float64
+	}
+	// SkipCorruptSegments 起動時に開けないセグメントや壊れたセグメントがあっても、残りのセグメントでログを開く。
+	// 読み飛ばしたセグメントの範囲はMissingRangesで確認でき、読み出すとErrOffsetUnavailableを返す
+	SkipCorruptSegments bool
+	// WarmIndexes 起動時に各セグメントのインデックスをページキャッシュに読み込んでおく。
+	// 起動は遅くなるが、最初の読み出しでページフォルトを待たなくてよくなる
+	WarmIndexes bool
+	// SealOnClose Closeでアクティブセグメントのストアのチェックサムをシールファイルに書き込み、書き込めないセグメントとして封じる。
+	// 開き直すと封じたセグメントの内容を検証し、その後ろに新しいアクティブセグメントを作成する
+	SealOnClose bool
+	// KeyCompaction CompactAndSwapで、キーが同じレコードのうち最新以外を、同じオフセットに値のないマーカーとして残す。
+	// キーが空のレコードは置き換えない
+	KeyCompaction bool
+	// KeyIndex キーごとに最新のレコードのオフセットをメモリに保持し、ReadByKeyで読み出せるようにする。
+	// 起動時にすべてのレコードを走査して構築する
+	KeyIndex bool
+	// IDIndex IDからレコードのオフセットへのマップをメモリに保持し、ReadByIDで読み出せるようにする。
+	// 起動時にすべてのレコードを走査して構築する
+	IDIndex bool
+	// PreserveOffset レコードのオフセットを上書きせず、次に追加されるオフセットと一致しない場合はErrOffsetMismatchを返す。
+	// オフセットを持つレコードをそのまま複製する場合に使う
+	PreserveOffset bool
+	// Validate レコードを追加する前に呼び出され、エラーを返した場合は追加を中止する。nilの場合は検証しない
+	Validate func(*api.Record) error
+	// Thresholds OnThresholdを呼び出す条件。0の項目は確認しない
+	Thresholds struct {
+		// TotalBytes ストアとインデックスに書き込んだバイト数の合計の上限
+		TotalBytes uint64
+		// Segments セグメントの数の上限
+		Segments int
+		// MinDiskFree ログのディレクトリがあるファイルシステムの空き容量の下限
+		MinDiskFree uint64
+	}
+	// OnThreshold 追加、セグメントの切り替え、Truncateの後に、Thresholdsのいずれかを超えたときと元に戻ったときに呼び出される。
+	// 同じ状態が続く間は再び呼び出さない。ログのロックを保持したまま同期的に呼び出されるため、ログを操作してはならない
+	OnThreshold func(ThresholdEvent)
+	// CircuitBreaker ディスクへの書き込みの失敗が続いた場合に、書き込みを一時的に遮断する条件。
+	// 遮断している間の追加はディスクに触れずにErrCircuitOpenを返すが、読み出しはそのまま行える
+	CircuitBreaker struct {
+		// Failures 遮断するまでの連続した失敗の回数。0の場合は遮断しない
+		Failures int
+		// Window 連続した失敗を数える期間。最初の失敗からこの期間を過ぎると数え直す。0の場合は期間を区切らない
+		Window time.Duration
+		// Cooldown 遮断する期間。過ぎると次の1件だけを書き込み、成功すれば遮断を解き、失敗すれば再び遮断する
+		Cooldown time.Duration
 	}
+	// ReadOnly セグメントのファイルを読み込み専用で開き、ディレクトリのロックを獲得しない。
+	// 別のプロセスが書き込み用に開いているログも開けるが、読み出せるのは開いた時点でファイルに書き出されていたレコードに限る。
+	// 追加などの書き込みはErrLogReadOnlyを返し、バックグラウンドの同期や詰め直しは行わない
+	ReadOnly bool
+	// MaxReadScanSegments 読み出すレコードのセグメントを探すときに調べるセグメントの数の上限。
+	// 超えた場合はErrReadScanLimitを返し、設定の誤りを遅い読み出しとして見過ごさないようにする。0の場合は制限しない
+	MaxReadScanSegments int
+	// Metrics セグメントの切り替えや削除を記録するメトリクス。nilの場合は記録しない
+	Metrics *Metrics
+	// Topic メトリクスのラベルに使うトピック名。LogManagerが配下のログに設定する。空の場合はデフォルトのログ
+	Topic string
+	// Events セグメントの切り替えや削除をイベントとして発行する先。nilの場合は発行しない
+	Events *events.Bus
+	// FS セグメントのファイルを操作するファイルシステム。nilの場合はOSのファイルシステムを使う。
+	// OSのファイル以外ではインデックスをメモリにマップせずバッファに読み込み、同期のたびに書き戻す。
+	// CompactAndSwapはディレクトリのリネームを使うので、OSのファイルシステムでのみ使える
+	FS FS
+	// Naming セグメントのファイル名の付け方。nilの場合は<ベースオフセット>.storeと<ベースオフセット>.indexを使う
+	Naming Naming
 }
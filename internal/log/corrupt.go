@@ -0,0 +1,118 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+)
+
+// OffsetRange [From, To)のオフセットの範囲
+type OffsetRange struct {
+	From, To uint64
+}
+
+// setupSkippingCorrupt ベースオフセットごとにセグメントを開き、開けないものや壊れているものは読み飛ばして欠損した範囲として記録する。
+// 最後のセグメントを読み飛ばした場合は、欠損した範囲の後ろに新しいアクティブセグメントを作成する
+func (l *Log) setupSkippingCorrupt(baseOffsets []uint64) error {
+	// INFO: ストアとインデックスのどちらかが欠けていても対応が崩れないよう、重複を除いて扱う
+	var bases []uint64
+	for _, off := range baseOffsets {
+		if len(bases) == 0 || bases[len(bases)-1] != off {
+			bases = append(bases, off)
+		}
+	}
+
+	lastSkipped := false
+	for i, off := range bases {
+		s, err := l.openIntactSegment(off)
+		if err == nil {
+			l.segments = append(l.segments, s)
+			l.activeSegment = s
+			lastSkipped = false
+			continue
+		}
+
+		end := l.corruptSegmentEnd(off)
+		if i+1 < len(bases) {
+			end = bases[i+1]
+		}
+		stdlog.Printf("proglog: skipping corrupt segment %d in %s: %v", off, l.Dir, err)
+		l.missing = append(l.missing, OffsetRange{From: off, To: end})
+		lastSkipped = true
+	}
+
+	if lastSkipped {
+		return l.newSegment(l.missing[len(l.missing)-1].To)
+	}
+	return nil
+}
+
+// openIntactSegment ストアとインデックスがそろっていて、内容が壊れていないセグメントを開く
+func (l *Log) openIntactSegment(off uint64) (*segment, error) {
+	naming := l.Config.naming()
+	for _, p := range []string{naming.StorePath(l.Dir, off), naming.IndexPath(l.Dir, off)} {
+		if _, err := l.Config.fs().Stat(p); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.check(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// corruptSegmentEnd 最後のセグメントが壊れている場合に、そのセグメントが含みうるオフセットの上限を見積もる
+func (l *Log) corruptSegmentEnd(off uint64) uint64 {
+	size := l.Config.Segment.MaxIndexBytes
+	if fi, err := l.Config.fs().Stat(l.Config.naming().IndexPath(l.Dir, off)); err == nil && uint64(fi.Size()) > size {
+		size = uint64(fi.Size())
+	}
+	return off + size/entWidth
+}
+
+// check インデックスの最後のエントリが指すレコードがストアに収まっているかを確認する
+func (s *segment) check() error {
+	_, pos, err := s.index.Read(-1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if pos+lenWidth > s.store.size {
+		return fmt.Errorf("store %s: record at %d is past the end %d", s.store.Name(), pos, s.store.size)
+	}
+	size := make([]byte, lenWidth)
+	if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+		return err
+	}
+	if enc.Uint64(size) > s.store.size-pos-lenWidth {
+		return fmt.Errorf("store %s: record at %d is truncated", s.store.Name(), pos)
+	}
+	return nil
+}
+
+// MissingRanges SkipCorruptSegmentsで読み飛ばしたセグメントのオフセットの範囲を返す
+func (l *Log) MissingRanges() []OffsetRange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]OffsetRange(nil), l.missing...)
+}
+
+// isMissing offが読み飛ばしたセグメントの範囲に含まれるかを返す
+func (l *Log) isMissing(off uint64) bool {
+	for _, r := range l.missing {
+		if r.From <= off && off < r.To {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 壊れたセグメントを読み飛ばして、残りのセグメントでログを開けるか
+func TestLogSkipCorruptSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+	require.NoError(t, log.Close())
+
+	// 2件目のセグメントのストアを途中で切り詰める
+	require.NoError(t, os.Truncate(filepath.Join(dir, "2.store"), 5))
+
+	c.SkipCorruptSegments = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, []OffsetRange{{From: 2, To: 4}}, log.MissingRanges())
+	for _, off := range []uint64{0, 1, 4, 5} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetUnavailable{Offset: 3}, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// PresentRanges レコードが存在するオフセットの範囲を小さい順に返す。
+// 隣り合うセグメントの範囲はまとめ、欠損したセグメントや削除済みの範囲は含まない
+func (l *Log) PresentRanges() []OffsetRange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	lowest := l.lowestOffset()
+	var ranges []OffsetRange
+	for _, s := range l.segments {
+		from := s.baseOffset
+		if from < lowest {
+			from = lowest
+		}
+		if from >= s.nextOffset {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].To == from {
+			ranges[n-1].To = s.nextOffset
+			continue
+		}
+		ranges = append(ranges, OffsetRange{From: from, To: s.nextOffset})
+	}
+	return ranges
+}
+
+// Describe 各セグメントのオフセットの範囲、ストアとインデックスのサイズ、上限に達しているかを表形式でwに書き出す。
+// レコードの内容は読み出さない
+func (l *Log) Describe(w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BASE OFFSET\tNEXT OFFSET\tSTORE BYTES\tINDEX BYTES\tMAXED")
+	for _, s := range l.segments {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%t\n",
+			s.baseOffset, s.nextOffset, s.store.size, s.index.size, s.IsMaxed())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// セグメントの構成を書き出せるか
+func TestLogDescribe(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, log.Describe(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, []string{"BASE", "OFFSET", "NEXT", "OFFSET", "STORE", "BYTES", "INDEX", "BYTES", "MAXED"}, strings.Fields(lines[0]))
+	require.Equal(t, []string{"0", "2", "44", "24", "true"}, strings.Fields(lines[1]))
+	require.Equal(t, []string{"2", "3", "23", "12", "false"}, strings.Fields(lines[2]))
+}
@@ -0,0 +1,12 @@
+package log
+
+import "syscall"
+
+// diskFree statfs(2)を用いて、dirがあるファイルシステムで一般ユーザが使える空き容量を返す
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package log
+
+// diskFree statfs(2)が使えない環境では空き容量を取得できない
+func diskFree(dir string) (uint64, error) {
+	return 0, errDiskFreeUnsupported
+}
@@ -0,0 +1,11 @@
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate fallocate(2)を用いてファイルの領域をsizeバイトまで確保する
+func fallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
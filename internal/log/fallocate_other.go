@@ -0,0 +1,10 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// fallocate fallocate(2)が使えない環境では、ファイルを拡張して領域を確保する
+func fallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
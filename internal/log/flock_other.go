@@ -0,0 +1,10 @@
+//go:build !unix
+
+package log
+
+import "os"
+
+// flock flock(2)が使えない環境ではロックをかけない
+func flock(f *os.File) (ok bool, err error) {
+	return true, nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock flock(2)を用いてファイルに排他的なアドバイザリロックをかける。他がロックしている場合は待たずにokをfalseで返す
+func flock(f *os.File) (ok bool, err error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
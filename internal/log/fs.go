@@ -0,0 +1,73 @@
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// File ログが読み書きするセグメントのファイル
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS ログがファイルを操作するためのファイルシステム。
+// テストや組み込み用途で、OSのファイルシステムの代わりに差し替えたり、障害を注入したりするために使う
+type FS interface {
+	// OpenFile os.OpenFileと同様に、flagに従ってファイルを開くか作成する
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	// RemoveAll ディレクトリとその中のファイルをすべて削除する
+	RemoveAll(path string) error
+	Truncate(name string, size int64) error
+	ReadDir(name string) ([]os.DirEntry, error)
+}
+
+// osFS OSのファイルシステムを使うFS
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fileOpener(name, flag, perm)
+	if err != nil {
+		// INFO: nilの*os.Fileをインターフェースに入れて返さない
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// fs 設定されたファイルシステムを返す。設定されていない場合はOSのファイルシステムを使う
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return osFS{}
+	}
+	return c.FS
+}
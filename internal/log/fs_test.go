@@ -0,0 +1,233 @@
+package log
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memFS テストで使うメモリ上のファイルシステム。ディレクトリは持たず、パスの接頭辞で扱う
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memData)}
+}
+
+type memData struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		d = &memData{}
+		m.files[name] = d
+	}
+	return &memFile{name: name, data: d, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	d, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.stat(name), nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := filepath.Clean(path) + string(filepath.Separator)
+	for name := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Truncate(name string, size int64) error {
+	m.mu.Lock()
+	d, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+	d.truncate(size)
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []os.DirEntry
+	for path, d := range m.files {
+		if filepath.Dir(path) == filepath.Clean(name) {
+			entries = append(entries, fs.FileInfoToDirEntry(d.stat(path)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return memFileInfo{name: filepath.Base(name), size: int64(len(d.data))}
+}
+
+func (d *memData) truncate(size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size <= int64(len(d.data)) {
+		d.data = d.data[:size]
+		return
+	}
+	d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+}
+
+// memFile memFSで開いたファイル
+type memFile struct {
+	name   string
+	data   *memData
+	pos    int64
+	append bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Stat() (os.FileInfo, error) { return f.data.stat(f.name), nil }
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Truncate(size int64) error {
+	f.data.truncate(size)
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.data.mu.Lock()
+		f.pos = int64(len(f.data.data))
+		f.data.mu.Unlock()
+	}
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	return copy(f.data.data[off:], p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.data.mu.Lock()
+		offset += int64(len(f.data.data))
+		f.data.mu.Unlock()
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0600 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func TestLogMemFS(t *testing.T) {
+	for scenario, fn := range logScenarios {
+		// 詰め直しはディレクトリのリネームを使うので、OSのファイルシステムでのみ実行する
+		if strings.HasPrefix(scenario, "compact") {
+			continue
+		}
+		t.Run(scenario, func(t *testing.T) {
+			memfs := newMemFS()
+			c := Config{FS: memfs}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog("/memfs/log", c)
+			require.NoError(t, err)
+
+			fn(t, log)
+
+			// OSのファイルシステムには何も作成しない
+			_, err = os.Stat("/memfs")
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
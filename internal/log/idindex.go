@@ -0,0 +1,74 @@
+package log
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// newRecordID ランダムなUUID(バージョン4)を生成する
+func newRecordID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// rebuildIDIndex IDIndexが有効な場合、すべてのレコードを走査してIDごとのオフセットを求め直す
+func (l *Log) rebuildIDIndex() error {
+	if !l.Config.IDIndex {
+		l.ids = nil
+		return nil
+	}
+
+	ids := make(map[string]uint64)
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			if record.Id != "" && !record.Compacted {
+				ids[record.Id] = off
+			}
+		}
+	}
+	l.ids = ids
+	return nil
+}
+
+// pruneIDIndex 削除されたセグメントにあるレコードのIDを取り除く
+func (l *Log) pruneIDIndex() {
+	lowest := l.lowestOffset()
+	for id, off := range l.ids {
+		if off < lowest {
+			delete(l.ids, id)
+		}
+	}
+}
+
+// ReadByID idを持つレコードを返す。見つからない場合はErrRecordIDNotFoundを返す。
+// IDIndexが無効な場合は常にErrRecordIDNotFoundを返す
+func (l *Log) ReadByID(id string) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	off, ok := l.ids[id]
+	if !ok {
+		return nil, api.ErrRecordIDNotFound{ID: id}
+	}
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return liveRecord(s.Read(off))
+		}
+	}
+	return nil, api.ErrRecordIDNotFound{ID: id}
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 追加時に付与したIDで、開き直した後もレコードを読み出せるか
+func TestLogReadByID(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.RecordIDs = true
+	c.IDIndex = true
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	ids := make(map[string]uint64)
+	for i := 0; i < 4; i++ {
+		record := &api.Record{Value: []byte("hello world")}
+		off, err := log.Append(record)
+		require.NoError(t, err)
+		require.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, record.Id)
+		ids[record.Id] = off
+	}
+	require.Len(t, ids, 4)
+	// 指定したIDはそのまま使い、値を読み込んで追加する経路でも付与する
+	off, err := log.Append(&api.Record{Value: []byte("hello world"), Id: "given"})
+	require.NoError(t, err)
+	ids["given"] = off
+	off, err = log.AppendReader(strings.NewReader("hello world"), 11)
+	require.NoError(t, err)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.NotEmpty(t, read.Id)
+	ids[read.Id] = off
+	require.Greater(t, len(log.segments), 1)
+
+	// 開き直しても再構築される
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for id, off := range ids {
+		read, err := log.ReadByID(id)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, id, read.Id)
+	}
+	_, err = log.ReadByID("missing")
+	require.Equal(t, api.ErrRecordIDNotFound{ID: "missing"}, err)
+
+	// 削除したセグメントのレコードは見つからない
+	require.NoError(t, log.Truncate(2))
+	require.NotZero(t, log.segments[0].baseOffset)
+	for id, off := range ids {
+		_, err := log.ReadByID(id)
+		if off < log.segments[0].baseOffset {
+			require.Equal(t, api.ErrRecordIDNotFound{ID: id}, err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
 
 	"github.com/tysonmote/gommap"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
 )
 
 const (
@@ -14,54 +20,215 @@ const (
 )
 
 type index struct {
-	file *os.File
+	file File
 	mmap gommap.MMap
-	size uint64
+	// mapped OSのファイルをメモリにマップしている場合はtrue。falseの場合、mmapはファイルの内容を読み込んだバッファ
+	mapped bool
+	size   uint64
+	// readOnly 読み込み専用で開いている場合はtrue。ファイルの大きさを変えず、書き戻さない
+	readOnly bool
+	// writing 書き込み中の場合は1
+	writing int32
+	// unhealthy checkで異常を検出した場合のエラー。以降の読み書きはこのエラーを返す
+	unhealthy atomic.Value
+	// tail 直近に書き込んだエントリを、エントリの番号をその長さで割った余りの位置に保持するリングバッファ。
+	// INFO: 書き込みはログの書き込みのロックを、読み出しは読み込みのロックを獲得した状態で行うので、排他制御は不要
+	tail []cachedEntry
+	// closeSyncAttempts Closeで同期を試す回数。closeSyncBackoffは最初に再試行するまでの待ち時間
+	closeSyncAttempts int
+	closeSyncBackoff  time.Duration
+}
+
+// cachedEntry tailに保持するエントリ。nはエントリの番号に1を足したもので、0の場合は空
+type cachedEntry struct {
+	n uint64
+	indexEntry
+}
+
+// indexSync メモリにマップされたインデックスのデータをファイルへ同期する。テストで差し替えるために変数にしている
+var indexSync = func(i *index) error {
+	return i.syncMap()
+}
+
+// indexCloseSync Closeでインデックスのデータをファイルと安定したストレージに同期する。テストで失敗を注入するために変数にしている
+var indexCloseSync = func(i *index) error {
+	// メモリにマップされたファイルのデータを永続化されたファイルへ同期
+	if err := i.syncMap(); err != nil {
+		return err
+	}
+	// 永続化されたファイルの内容を安定したストレージに同期
+	return i.file.Sync()
+}
+
+// indexWarm インデックスをページキャッシュに読み込む。テストで差し替えるために変数にしている
+var indexWarm = func(i *index) {
+	i.warm()
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:              f,
+		readOnly:          c.ReadOnly,
+		closeSyncAttempts: c.Segment.CloseSyncAttempts,
+		closeSyncBackoff:  c.Segment.CloseSyncBackoff,
+	}
+	if n := c.Segment.IndexCacheEntries; n > 0 && !c.ReadOnly {
+		idx.tail = make([]cachedEntry, n)
 	}
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
 
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	// INFO: 読み込み専用の場合はファイルの大きさのままマップする。空のファイルはマップできないので、空のバッファを使う
+	if idx.readOnly {
+		if idx.size == 0 {
+			return idx, nil
+		}
+		return idx, idx.mapFile()
+	}
+	if err = f.Truncate(int64(c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED); err != nil {
+	if err = idx.mapFile(); err != nil {
 		return nil, err
 	}
 	return idx, nil
 }
 
-func (i *index) Close() error {
-	// メモリにマップされたファイルのデータを永続化されたファイルへ同期
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+// mapFile ファイルをメモリにマップする。OSのファイルでない場合はマップできないので、内容をバッファに読み込んで代わりに使う
+func (i *index) mapFile() error {
+	if f, ok := i.file.(*os.File); ok {
+		prot := gommap.PROT_READ | gommap.PROT_WRITE
+		if i.readOnly {
+			prot = gommap.PROT_READ
+		}
+		mmap, err := gommap.Map(f.Fd(), prot, gommap.MAP_SHARED)
+		if err != nil {
+			return err
+		}
+		i.mmap, i.mapped = mmap, true
+		return nil
+	}
+
+	fi, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make(gommap.MMap, fi.Size())
+	if _, err = i.file.ReadAt(buf, 0); err != nil && err != io.EOF {
 		return err
 	}
+	i.mmap, i.mapped = buf, false
+	return nil
+}
 
-	// 永続化されたファイルの内容を安定したストレージに同期
-	if err := i.file.Sync(); err != nil {
+// syncMap マップした領域のデータをファイルへ同期する。バッファの場合はファイルに書き戻す
+func (i *index) syncMap() error {
+	if i.mapped {
+		return i.mmap.Sync(gommap.MS_SYNC)
+	}
+	_, err := i.file.WriteAt(i.mmap, 0)
+	return err
+}
+
+// unmap マップした領域を解放する
+func (i *index) unmap() error {
+	if i.mapped {
+		return i.mmap.UnsafeUnmap()
+	}
+	return nil
+}
+
+// warm 書き込み済みの範囲をメモリに読み込む。カーネルに先読みを促したうえで、各ページに触れてフォルトさせる。
+// INFO: 先読みはあくまでヒントなので、失敗しても読み出しには影響しない
+func (i *index) warm() {
+	if !i.mapped || i.size == 0 {
+		return
+	}
+	_ = adviseWillNeed(i.mmap)
+
+	pageSize := uint64(os.Getpagesize())
+	var sum byte
+	for off := uint64(0); off < i.size; off += pageSize {
+		sum += i.mmap[off]
+	}
+	runtime.KeepAlive(sum)
+}
+
+func (i *index) Close() error {
+	if i.readOnly {
+		if err := i.unmap(); err != nil {
+			return err
+		}
+		return i.file.Close()
+	}
+	// INFO: 失敗した場合もファイルディスクリプタを漏らさないよう、ファイルは閉じてからエラーを返す
+	if err := i.closeSync(); err != nil {
+		_ = i.unmap()
+		_ = i.file.Close()
 		return err
 	}
 
-	if err := i.mmap.UnsafeUnmap(); err != nil {
+	if err := i.unmap(); err != nil {
+		_ = i.file.Close()
 		return err
 	}
 
 	// 永続化されたファイルをその中にある実際のデータ量まで切り詰めて、ファイルを閉じる
 	if err := i.file.Truncate(int64(i.size)); err != nil {
+		_ = i.file.Close()
 		return err
 	}
 	return i.file.Close()
 }
 
+// closeSync インデックスを同期する。一時的なI/Oエラーに備え、失敗した場合は待ち時間を倍にしながらcloseSyncAttempts回まで試す
+func (i *index) closeSync() error {
+	backoff := i.closeSyncBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = indexCloseSync(i); err == nil || attempt >= i.closeSyncAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// check ファイルの大きさがマップした大きさと一致するかを確認する。
+// ファイルが外部から切り詰められている場合、マップした領域に触れるとSIGBUSになるので、以降の読み書きをエラーにする
+func (i *index) check() error {
+	if err := i.err(); err != nil {
+		return err
+	}
+	fi, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < int64(len(i.mmap)) {
+		err := api.ErrIndexUnhealthy{Path: i.Name(), Size: fi.Size(), Mapped: len(i.mmap)}
+		i.unhealthy.Store(err)
+		return err
+	}
+	return nil
+}
+
+// err checkで異常を検出している場合はそのエラーを返す
+func (i *index) err() error {
+	if err, ok := i.unhealthy.Load().(api.ErrIndexUnhealthy); ok {
+		return err
+	}
+	return nil
+}
+
 // Read 与えられた相対オフセットをもとに、ストア内の紐づくレコードの位置を返す
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
+	if err := i.err(); err != nil {
+		return 0, 0, err
+	}
+
 	// 0の場合は、最初の位置を返す
 	if i.size == 0 {
 		return 0, 0, io.EOF
@@ -78,6 +245,11 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	if i.size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
+	if len(i.tail) > 0 {
+		if e := i.tail[uint64(out)%uint64(len(i.tail))]; e.n == uint64(out)+1 {
+			return e.off, e.pos, nil
+		}
+	}
 	// オフセット番号とストアファイルの位置をマッピング
 	out = enc.Uint32(i.mmap[pos : pos+offWidth])
 	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
@@ -85,15 +257,70 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 }
 
 func (i *index) Write(off uint32, pos uint64) error {
+	// INFO: セグメントはログのロックで保護されているので同時に書き込まれることはないはずだが、
+	//  ロックの不備があった場合にマップされた領域を壊さないよう、同時の書き込みを検出してエラーにする
+	if !atomic.CompareAndSwapInt32(&i.writing, 0, 1) {
+		return fmt.Errorf("index %s: concurrent write detected", i.Name())
+	}
+	defer atomic.StoreInt32(&i.writing, 0)
+
+	if err := i.err(); err != nil {
+		return err
+	}
+
+	// 通常はisMaxedで上限に達したことを検出するが、サイズが壊れている場合はスライスの範囲外参照でパニックしないようエラーを返す
+	if i.size > uint64(len(i.mmap)) || i.size%entWidth != 0 {
+		return fmt.Errorf(
+			"index %s: write out of bounds: size %d, entry width %d, mapped %d bytes",
+			i.Name(), i.size, entWidth, len(i.mmap),
+		)
+	}
 	if i.isMaxed() {
 		return io.EOF
 	}
 	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	if len(i.tail) > 0 {
+		n := i.size / entWidth
+		i.tail[n%uint64(len(i.tail))] = cachedEntry{n: n + 1, indexEntry: indexEntry{off: off, pos: pos}}
+	}
 	i.size += uint64(entWidth)
 	return nil
 }
 
+// TruncateTo インデックスを先頭のentries件のエントリに切り詰める。
+// ファイルを一度切り詰めてから元の大きさに戻して再度マップするので、セグメントを開いたまま後続のエントリの領域を解放でき、
+// 切り詰めた後もWriteで続けて書き込める。マップし直すので、ログの書き込みのロックを獲得した状態で呼び出すこと
+func (i *index) TruncateTo(entries int) error {
+	if err := i.err(); err != nil {
+		return err
+	}
+	size := uint64(entries) * entWidth
+	if entries < 0 || size > i.size {
+		return fmt.Errorf("index %s: cannot truncate to %d entries, has %d", i.Name(), entries, i.size/entWidth)
+	}
+
+	mapped := int64(len(i.mmap))
+	if err := i.syncMap(); err != nil {
+		return err
+	}
+	if err := i.unmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	if err := i.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if err := i.file.Truncate(mapped); err != nil {
+		return err
+	}
+	if err := i.mapFile(); err != nil {
+		return err
+	}
+	i.size = size
+	return nil
+}
+
 func (i *index) isMaxed() bool {
 	return uint64(len(i.mmap)) < i.size+entWidth
 }
@@ -101,3 +328,38 @@ func (i *index) isMaxed() bool {
 func (i *index) Name() string {
 	return i.file.Name()
 }
+
+// writtenEntries 書き込み済みのエントリの数を返す。
+// INFO: 書き込み中のインデックスやCloseせずに終了したインデックスはMaxIndexBytesまで0で埋まっているので、相対オフセットが連番でなくなったところを末尾とみなす
+func (i *index) writtenEntries() uint64 {
+	n := i.size / entWidth
+	for e := uint64(1); e < n; e++ {
+		if enc.Uint32(i.mmap[e*entWidth:]) != uint32(e) {
+			return e
+		}
+	}
+	return n
+}
+
+// lastPosition 書き込み済みのエントリが指すストア内の位置のうち、最も後ろのものを返す。エントリがない場合は-1を返す。
+// 重複排除が有効な場合は前のレコードと同じ位置を指すエントリがあるので、最後のエントリではなくすべてのエントリから求める
+func (i *index) lastPosition() int64 {
+	last := int64(-1)
+	n := i.writtenEntries()
+	for e := uint64(0); e < n; e++ {
+		if pos := int64(enc.Uint64(i.mmap[e*entWidth+offWidth:])); pos > last {
+			last = pos
+		}
+	}
+	return last
+}
+
+// trimWritten 読み込み専用で開いたインデックスの大きさを、書き込み済みのエントリまでに切り詰める。
+// また、ストアのバッファからまだ書き出されていないレコードを指すエントリも除く
+func (i *index) trimWritten(storeSize uint64) {
+	n := i.writtenEntries()
+	for n > 0 && enc.Uint64(i.mmap[(n-1)*entWidth+offWidth:])+lenWidth > storeSize {
+		n--
+	}
+	i.size = n * entWidth
+}
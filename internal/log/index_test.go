@@ -4,7 +4,10 @@ import (
 	"github.com/stretchr/testify/require"
 	"io"
 	"os"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestIndex(t *testing.T) {
@@ -51,3 +54,198 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexWriteOutOfBounds(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_bounds_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	for i := uint32(0); i < 2; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+	}
+	// 上限に達した場合はこれまで通りio.EOFを返す
+	require.Equal(t, io.EOF, idx.Write(2, 20))
+
+	// サイズがマップされた領域を超えている場合は、パニックせずにエラーを返す
+	size := idx.size
+	idx.size = uint64(len(idx.mmap)) + entWidth
+	err = idx.Write(2, 20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "out of bounds")
+	idx.size = size
+
+	// 同時に書き込もうとした場合はエラーを返す
+	idx.writing = 1
+	err = idx.Write(2, 20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "concurrent write")
+	idx.writing = 0
+}
+
+func TestIndexTruncateTo(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_truncate_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	for i := uint32(0); i < 5; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+	}
+
+	require.NoError(t, idx.TruncateTo(2))
+	require.Equal(t, 2*entWidth, idx.size)
+	for i := int64(0); i < 2; i++ {
+		off, pos, err := idx.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), off)
+		require.Equal(t, uint64(i)*10, pos)
+	}
+	// 切り詰めたエントリは読み出せない
+	_, _, err = idx.Read(2)
+	require.Equal(t, io.EOF, err)
+
+	// 増やすことはできない
+	require.Error(t, idx.TruncateTo(3))
+
+	// 切り詰めた後も続けて書き込める
+	require.NoError(t, idx.Write(2, 99))
+	_, pos, err := idx.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(99), pos)
+
+	// 閉じると実際のエントリの分だけが残る
+	require.NoError(t, idx.Close())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(3*entWidth), fi.Size())
+}
+
+func TestIndexTailCache(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_cache_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexCacheEntries = 4
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	// 書き込んだ直後のエントリを読み出せる
+	for i := uint32(0); i < 10; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, uint64(i)*10, pos)
+		off, pos, err = idx.Read(-1)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, uint64(i)*10, pos)
+	}
+
+	// 直近の4件はマップした領域ではなくメモリから読み出し、それより古いエントリはマップした領域から読み出す
+	for i := uint64(0); i < 10; i++ {
+		enc.PutUint64(idx.mmap[i*entWidth+offWidth:], 1000+i)
+	}
+	for i := int64(0); i < 10; i++ {
+		want := uint64(1000 + i)
+		if i >= 6 {
+			want = uint64(i) * 10
+		}
+		_, pos, err := idx.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want, pos)
+	}
+
+	// 切り詰めたエントリはメモリに残っていても読み出せず、書き直したエントリを返す
+	require.NoError(t, idx.TruncateTo(8))
+	_, _, err = idx.Read(8)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, idx.Write(8, 99))
+	_, pos, err := idx.Read(8)
+	require.NoError(t, err)
+	require.Equal(t, uint64(99), pos)
+}
+
+func BenchmarkIndexReadTail(b *testing.B) {
+	for _, n := range []int{0, 1024} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			f, err := os.CreateTemp(os.TempDir(), "index_cache_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1 << 20
+			c.Segment.IndexCacheEntries = n
+			idx, err := newIndex(f, c)
+			require.NoError(b, err)
+			defer idx.Close()
+			for i := uint32(0); i < 1024; i++ {
+				require.NoError(b, idx.Write(i, uint64(i)*10))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := idx.Read(int64(1023 - i%64)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Closeで一時的に同期が失敗しても、再試行して閉じられるか
+func TestIndexCloseSyncRetry(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_close_sync_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	var calls int
+	orig := indexCloseSync
+	defer func() { indexCloseSync = orig }()
+	indexCloseSync = func(i *index) error {
+		calls++
+		if calls <= 2 {
+			return syscall.EIO
+		}
+		return orig(i)
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.CloseSyncAttempts = 3
+	c.Segment.CloseSyncBackoff = time.Millisecond
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(0, 0))
+	require.NoError(t, idx.Close())
+	require.Equal(t, 3, calls)
+
+	// 同期した後にファイルは切り詰められている
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(entWidth), fi.Size())
+
+	// 回数を使い切った場合はエラーを返すが、ファイルは閉じられている
+	calls = 0
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	c.Segment.CloseSyncAttempts = 2
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.ErrorIs(t, idx.Close(), syscall.EIO)
+	require.Equal(t, 2, calls)
+	require.ErrorIs(t, f.Close(), os.ErrClosed)
+}
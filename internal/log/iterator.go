@@ -0,0 +1,70 @@
+package log
+
+import (
+	"io"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// RecordIterator ログのレコードをオフセット順に読み出す
+type RecordIterator struct {
+	log *Log
+	off uint64
+}
+
+// Iterator ログの最小のオフセットから読み出すRecordIteratorを返す
+func (l *Log) Iterator() *RecordIterator {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return &RecordIterator{
+		log: l,
+		off: l.lowestOffset(),
+	}
+}
+
+// Next 現在の位置のレコードを返し、次のオフセットに進む。有効期間の過ぎたレコードは読み飛ばす。ログの末尾に達した場合はio.EOFを返す
+func (it *RecordIterator) Next() (*api.Record, error) {
+	for {
+		record, err := it.log.Read(it.off)
+		if _, ok := err.(api.ErrRecordExpired); ok {
+			it.off++
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok && it.off >= it.log.NextOffset() {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		it.off++
+		return record, nil
+	}
+}
+
+// SeekTo 次にNextで読み出すオフセットをoffに移動する。ログに存在しないオフセットの場合はErrOffsetOutOfRangeを返す
+func (it *RecordIterator) SeekTo(off uint64) error {
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+
+	if off < it.log.lowestOffset() || off >= it.log.activeSegment.nextOffset {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	it.off = off
+	return nil
+}
+
+// Offset 次にNextで読み出すオフセットを返す
+func (it *RecordIterator) Offset() uint64 {
+	return it.off
+}
+
+// NextOffset 次に追加されるレコードのオフセットを返す
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.activeSegment.nextOffset
+}
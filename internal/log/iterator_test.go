@@ -0,0 +1,48 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 複数のセグメントにまたがるログの途中に移動し、末尾まで読み出せるか
+func testIteratorSeek(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	it := log.Iterator()
+	require.Equal(t, uint64(0), it.Offset())
+	require.NoError(t, it.SeekTo(3))
+
+	for want := uint64(3); want < 6; want++ {
+		read, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", want)), read.Value)
+	}
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// 範囲外のオフセットには移動できず、位置も変わらない
+	err = it.SeekTo(6)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+	require.Equal(t, uint64(6), it.Offset())
+
+	// 先頭に戻って読み直せる
+	require.NoError(t, it.SeekTo(0))
+	read, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), read.Offset)
+
+	require.NoError(t, log.Close())
+}
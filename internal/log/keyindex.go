@@ -0,0 +1,61 @@
+package log
+
+import (
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// rebuildKeyIndex KeyIndexが有効な場合、すべてのレコードを走査してキーごとの最新のオフセットを求め直す
+func (l *Log) rebuildKeyIndex() error {
+	if !l.Config.KeyIndex {
+		l.keys = nil
+		return nil
+	}
+
+	keys := make(map[string]uint64)
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			// INFO: 詰め直しのマーカーは最新のレコードより前にしか存在しないが、念のため対象外とする
+			if len(record.Key) > 0 && !record.Compacted {
+				keys[string(record.Key)] = off
+			}
+		}
+	}
+	l.keys = keys
+	return nil
+}
+
+// pruneKeyIndex 削除されたセグメントにしかないキーを取り除く
+func (l *Log) pruneKeyIndex() {
+	lowest := l.lowestOffset()
+	for key, off := range l.keys {
+		if off < lowest {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// ReadByKey keyを持つ最新のレコードを返す。見つからない場合はErrKeyNotFoundを返す。
+// KeyIndexが無効な場合は常にErrKeyNotFoundを返す
+func (l *Log) ReadByKey(key []byte) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	off, ok := l.keys[string(key)]
+	if !ok {
+		return nil, api.ErrKeyNotFound{Key: key}
+	}
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return liveRecord(s.Read(off))
+		}
+	}
+	return nil, api.ErrKeyNotFound{Key: key}
+}
@@ -0,0 +1,44 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// キーごとに最新のレコードを読み出せるか
+func TestLogReadByKey(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.KeyIndex = true
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	_, err := log.Append(&api.Record{Key: []byte("b"), Value: []byte("v1")})
+	require.NoError(t, err)
+
+	read, err := log.ReadByKey([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), read.Value)
+	require.Equal(t, uint64(2), read.Offset)
+
+	_, err = log.ReadByKey([]byte("c"))
+	require.IsType(t, api.ErrKeyNotFound{}, err)
+
+	// 開き直しても再構築される
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	read, err = log.ReadByKey([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), read.Value)
+	require.Equal(t, uint64(3), read.Offset)
+}
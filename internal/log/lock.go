@@ -0,0 +1,64 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// lockFileName ログのディレクトリを書き込み用に開いていることを示すロックファイルの名前
+const lockFileName = ".lock"
+
+// lockDir ログのディレクトリのロックファイルに排他的なロックをかける。
+// 別のプロセスやLogがロックしている場合はErrLogLockedを返す。
+// INFO: 2つのLogが同じインデックスをマップして書き込むと壊れるので、書き込み用に開くLogを1つに限る。
+// 読み込み専用の場合と、OS以外のファイルシステムの場合はロックしない
+func (l *Log) lockDir() error {
+	if l.Config.ReadOnly || l.Config.FS != nil || l.lock != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(l.Dir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	ok, err := flock(f)
+	if err != nil || !ok {
+		f.Close()
+		if err != nil {
+			return err
+		}
+		return api.ErrLogLocked{Dir: l.Dir}
+	}
+	l.lock = f
+	return nil
+}
+
+// unlockDir lockDirでかけたロックを解放する。ファイルを閉じるとロックも解放される
+func (l *Log) unlockDir() error {
+	if l.lock == nil {
+		return nil
+	}
+	err := l.lock.Close()
+	l.lock = nil
+	return err
+}
+
+// writable 閉じたログの場合はErrLogClosedを、読み込み専用で開いたログの場合はErrLogReadOnlyを返す
+func (l *Log) writable() error {
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.Config.ReadOnly {
+		return api.ErrLogReadOnly{Dir: l.Dir}
+	}
+	return nil
+}
+
+// checkOpen ログを閉じている場合はErrLogClosedを返す
+func (l *Log) checkOpen() error {
+	if l.closed.Load() {
+		return api.ErrLogClosed{Dir: l.Dir}
+	}
+	return nil
+}
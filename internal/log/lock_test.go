@@ -0,0 +1,59 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 書き込み用に開いているログのディレクトリは、別の書き込み用には開けず、読み込み専用では開けるか
+func TestLogLock(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Flush())
+	// バッファに残っているレコードは、読み込み専用のログからは見えない
+	_, err := log.Append(record)
+	require.NoError(t, err)
+
+	_, err = NewLog(dir, c)
+	require.ErrorAs(t, err, &api.ErrLogLocked{})
+
+	rc := c
+	rc.ReadOnly = true
+	ro, err := NewLog(dir, rc)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ro.NextOffset())
+	for off := uint64(0); off < 3; off++ {
+		got, err := ro.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+	}
+	_, err = ro.Append(record)
+	require.ErrorAs(t, err, &api.ErrLogReadOnly{})
+	require.ErrorAs(t, ro.Truncate(1), &api.ErrLogReadOnly{})
+	require.NoError(t, ro.Close())
+
+	// 読み込み専用のログを閉じても、書き込み中のログはそのまま使える
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	got, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, got.Value)
+
+	// 閉じるとロックが解放され、書き込み用に開き直せる
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), log.NextOffset())
+	require.NoError(t, log.Close())
+}
@@ -1,15 +1,23 @@
 package log
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
-	"path"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 
 	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/events"
 )
 
 type Log struct {
@@ -19,6 +27,44 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// backgroundMu バックグラウンドのゴルーチンを停止するためのチャネルを保護する
+	backgroundMu sync.Mutex
+	// backgroundStopped Closeでバックグラウンドのゴルーチンを停止した後はtrueになり、新しく起動しない
+	backgroundStopped bool
+	// indexSyncDone インデックスを定期的に同期するゴルーチンを停止するためのチャネル
+	indexSyncDone chan struct{}
+	indexSyncWG   sync.WaitGroup
+	// autoCompactDone 自動で詰め直すゴルーチンを停止するためのチャネル
+	autoCompactDone chan struct{}
+	autoCompactWG   sync.WaitGroup
+	// missing SkipCorruptSegmentsで読み飛ばしたセグメントのオフセットの範囲
+	missing []OffsetRange
+	// retainedFrom AppendWithRetentionで決めた、読み出せる最小のオフセット
+	retainedFrom uint64
+	// keys KeyIndexが有効な場合の、キーから最新のレコードのオフセットへのマップ
+	keys map[string]uint64
+	// ids IDIndexが有効な場合の、IDからレコードのオフセットへのマップ
+	ids map[string]uint64
+	// syncMu 永続化済みのオフセットを保護する
+	syncMu sync.Mutex
+	// syncedOffset このオフセットより前のレコードはディスクに永続化されている
+	syncedOffset uint64
+	// synced Syncのたびにクローズされ、WaitForSyncで待っているゴルーチンを起こす
+	synced chan struct{}
+	// appendedMu レコードの追加を待つチャネルを保護する
+	appendedMu sync.Mutex
+	// appended レコードが追加されるとクローズされ、Subscriptionで待っているゴルーチンを起こす。待っているものがいない場合はnil
+	appended chan struct{}
+	// thresholdMu しきい値を超えているかの状態を保護する
+	thresholdMu sync.Mutex
+	// thresholdCrossed 種類ごとの、しきい値を超えているか
+	thresholdCrossed map[ThresholdKind]bool
+	// breaker 書き込みの失敗が続いた場合に書き込みを遮断するサーキットブレーカー
+	breaker breaker
+	// lock ディレクトリのロックファイル。開いている間はロックを保持する
+	lock *os.File
+	// closed Closeでセグメントを閉じたか。閉じたセグメントには触れないよう、以降の操作はErrLogClosedを返す
+	closed atomic.Bool
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -29,26 +75,72 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.Dedup && c.Segment.RecordIDs {
+		return nil, fmt.Errorf("invalid config: Dedup cannot be combined with RecordIDs")
+	}
 
 	l := &Log{
 		Dir:    dir,
 		Config: c,
 	}
-	return l, l.setup()
+	// 途中で中断したResetや詰め直しがあれば、入れ替えを完了させるか元に戻す
+	if c.FS == nil && !c.ReadOnly {
+		if err := recoverReset(dir); err != nil {
+			return nil, err
+		}
+		if err := recoverCompact(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.setup(); err != nil {
+		_ = l.unlockDir()
+		return nil, err
+	}
+	return l, nil
+}
+
+// UpdateConfig 実行中のログのセグメントの上限値(MaxStoreBytes、MaxIndexBytes、MaxRecords)を変更する。
+// 書き込みの終わったセグメントには影響せず、アクティブセグメントとこれから作成するセグメントに適用される。
+// ただし、アクティブセグメントのインデックスはマップ済みの大きさを超えては書き込めない
+func (l *Log) UpdateConfig(c Config) error {
+	if c.Segment.MaxStoreBytes == 0 {
+		return fmt.Errorf("invalid config: MaxStoreBytes must be greater than 0")
+	}
+	if c.Segment.MaxIndexBytes < entWidth {
+		return fmt.Errorf("invalid config: MaxIndexBytes must be at least %d", entWidth)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.Config.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	l.Config.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	l.Config.Segment.MaxRecords = c.Segment.MaxRecords
+	l.activeSegment.config.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	l.activeSegment.config.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	l.activeSegment.config.Segment.MaxRecords = c.Segment.MaxRecords
+	return nil
 }
 
 func (l *Log) setup() error {
 	// ディスク上のセグメントの一覧を取得
-	files, err := os.ReadDir(l.Dir)
+	files, err := l.Config.fs().ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
+	// 他が書き込み用に開いている場合は、同じファイルに書き込まないよう開くのをやめる
+	if err = l.lockDir(); err != nil {
+		return err
+	}
 
 	// ファイル名からベースオフセットの値を求めてソート
 	var baseOffsets []uint64
 	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		// シールファイルなど、ストアとインデックス以外のファイルは数えない
+		off, ok := l.Config.naming().Parse(file.Name())
+		if !ok {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
@@ -56,28 +148,142 @@ func (l *Log) setup() error {
 	})
 
 	// ディスク上に存在するセグメントを処理して設定
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	l.missing = nil
+	if l.Config.SkipCorruptSegments {
+		if err = l.setupSkippingCorrupt(baseOffsets); err != nil {
 			return err
 		}
-		// baseOffsetsは、インデックスファイルとストアファイルの2つの重複を含んでいるので、
-		// 重複しているものをスキップする
-		i++
+	} else {
+		for i := 0; i < len(baseOffsets); i++ {
+			if err = l.newSegment(baseOffsets[i]); err != nil {
+				return err
+			}
+			// baseOffsetsは、インデックスファイルとストアファイルの2つの重複を含んでいるので、
+			// 重複しているものをスキップする
+			i++
+		}
 	}
 
 	// 既存のセグメントが存在しない場合、渡されたベースオフセットで最初のセグメントを作成
+	if l.segments == nil && l.Config.ReadOnly {
+		return fmt.Errorf("read-only log %s has no segments", l.Dir)
+	}
 	if l.segments == nil {
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
+
+	if l.Config.WarmIndexes {
+		for _, s := range l.segments {
+			indexWarm(s.index)
+		}
+	}
+
+	if !l.Config.ReadOnly {
+		if err = l.dropPartialBatch(); err != nil {
+			return err
+		}
+	}
+
+	// 封じられたセグメントには書き込まないので、その後ろに新しいアクティブセグメントを作成する
+	if l.activeSegment.sealed && !l.Config.ReadOnly {
+		if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return err
+		}
+	}
+
+	if err = l.rebuildKeyIndex(); err != nil {
+		return err
+	}
+	if err = l.rebuildIDIndex(); err != nil {
+		return err
+	}
+
+	// 起動時にディスク上にあるレコードは永続化済みとみなす
+	l.syncMu.Lock()
+	l.syncedOffset = l.activeSegment.nextOffset
+	if l.synced == nil {
+		l.synced = make(chan struct{})
+	}
+	l.syncMu.Unlock()
+
+	if !l.Config.ReadOnly {
+		l.startIndexSync()
+		l.startAutoCompact()
+	}
 	return nil
 }
 
+// backgroundTicker バックグラウンドのゴルーチンが周期ごとに受け取るチャネルと、それを止める関数を返す。
+// テストで周期を進めるために変数にしている
+var backgroundTicker = func(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// startIndexSync IndexSyncIntervalが設定されている場合、アクティブセグメントを定期的に同期するゴルーチンを起動する
+func (l *Log) startIndexSync() {
+	l.backgroundMu.Lock()
+	defer l.backgroundMu.Unlock()
+
+	interval := l.Config.Segment.IndexSyncInterval
+	if interval <= 0 || l.indexSyncDone != nil || l.backgroundStopped {
+		return
+	}
+
+	done := make(chan struct{})
+	l.indexSyncDone = done
+	l.indexSyncWG.Add(1)
+	go func() {
+		defer l.indexSyncWG.Done()
+
+		ticks, stop := backgroundTicker(interval)
+		defer stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticks:
+				// 失敗した場合でも、次の周期かClose時に改めて同期される
+				_ = l.Sync()
+			}
+		}
+	}()
+}
+
+// stopBackground インデックスを同期するゴルーチンと自動で詰め直すゴルーチンを停止し、終了するまで待つ。
+// 同時に呼び出されてもチャネルは一度だけクローズする。停止した後はresumeBackgroundを呼び出すまで起動しない
+func (l *Log) stopBackground() {
+	l.backgroundMu.Lock()
+	l.backgroundStopped = true
+	indexSync, autoCompact := l.indexSyncDone, l.autoCompactDone
+	l.indexSyncDone, l.autoCompactDone = nil, nil
+	l.backgroundMu.Unlock()
+
+	// INFO: 詰め直しの途中でゴルーチンがbackgroundMuを獲得する場合があるので、ロックを解放してから終了を待つ
+	if indexSync != nil {
+		close(indexSync)
+	}
+	if autoCompact != nil {
+		close(autoCompact)
+	}
+	l.indexSyncWG.Wait()
+	l.autoCompactWG.Wait()
+}
+
+// resumeBackground stopBackgroundで停止したゴルーチンを、次にログを構築し直したときに起動できるようにする
+func (l *Log) resumeBackground() {
+	l.backgroundMu.Lock()
+	defer l.backgroundMu.Unlock()
+
+	l.backgroundStopped = false
+}
+
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
-		return err
+		return fsError(err)
 	}
 	l.segments = append(l.segments, s)
 	// 追加したセグメントを一番新しいものとみなし、アクティブセグメントとする
@@ -93,122 +299,675 @@ func (l *Log) highestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// SegmentBase offのレコードを含むセグメントのベースオフセットを返す
+func (l *Log) SegmentBase(off uint64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	// INFO: 追加したばかりのレコードを探すことが多いので、新しいセグメントから探す
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s.baseOffset, nil
+		}
+	}
+	return 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return l.segments[0].baseOffset, nil
+	return l.lowestOffset(), nil
 }
 
 // Truncate 処理したデータ不要になった古いセグメントを削除するためのメソッド
 func (l *Log) Truncate(lowest uint64) error {
+	if err := l.writable(); err != nil {
+		return err
+	}
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	// 最大オフセットがlowestよりも小さいセグメントを削除
+	return l.removeSegmentsBelow(lowest + 1)
+}
 
-	var segments []*segment
+// removeSegmentsBelow すべてのレコードがlowestより前のセグメントを削除する。ただしアクティブセグメントは書き込み先なので残す。
+// 書き込みのロックを獲得した状態で呼び出し、ロックはこのメソッドの中で解放する
+func (l *Log) removeSegmentsBelow(lowest uint64) error {
+	// INFO: 削除するセグメントの選別とスライスの差し替えだけを書き込みのロック内で行う。
+	//  ロックを獲得した時点で読み込み中の処理はなく、差し替え後の読み込みからは削除対象のセグメントは見えないので、
+	//  時間のかかるファイルの削除はロックの外で行い、残るセグメントの読み込みを妨げないようにする
+	var segments, victims []*segment
 	for _, s := range l.segments {
-		// 最大オフセットがlowestよりも小さいセグメントを削除
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
-				return err
-			}
+		if s.nextOffset <= lowest && s != l.activeSegment {
+			victims = append(victims, s)
 			continue
 		}
 
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.pruneKeyIndex()
+	l.pruneIDIndex()
+	readable, remaining := l.lowestOffset(), l.segments[0].baseOffset
+	l.mu.Unlock()
+	l.Config.Metrics.removeSegments(l.Config.Topic, removeTruncate, len(victims))
+	l.publishTruncated(readable, victims)
+	if len(victims) > 0 {
+		l.notifyRemoved(remaining)
+	}
+
+	for _, s := range victims {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.mu.RLock()
+	l.checkThresholds()
+	l.mu.RUnlock()
 	return nil
 }
 
+// notifyRemoved OnSegmentsRemovedが設定されている場合は、ディスクに残っている最小のオフセットを渡して呼び出す
+func (l *Log) notifyRemoved(lowest uint64) {
+	if l.Config.OnSegmentsRemoved != nil {
+		l.Config.OnSegmentsRemoved(l.Config.Topic, lowest)
+	}
+}
+
+// publishTruncated 削除したセグメントがある場合は、削除した後に読み出せる最小のオフセットとともにイベントを発行する
+func (l *Log) publishTruncated(lowest uint64, victims []*segment) {
+	if len(victims) == 0 {
+		return
+	}
+	l.Config.Events.Publish(events.SegmentsTruncated, map[string]string{
+		"dir":      l.Dir,
+		"lowest":   strconv.FormatUint(lowest, 10),
+		"segments": strconv.Itoa(len(victims)),
+	})
+}
+
+// truncatable Truncate(lowest)でsを削除するかを判定する。ロックを獲得した状態で呼び出す
+func (l *Log) truncatable(s *segment, lowest uint64) bool {
+	// removeSegmentsBelow(lowest+1)と同じ条件で判定する
+	return s.nextOffset <= lowest+1 && s != l.activeSegment
+}
+
+// SegmentInfo セグメントのオフセットの範囲とファイル
+type SegmentInfo struct {
+	// BaseOffset セグメントの最小のオフセット
+	BaseOffset uint64
+	// NextOffset セグメントに次に追加されるオフセット。セグメントのレコードはこれより小さい
+	NextOffset uint64
+	StorePath  string
+	IndexPath  string
+	// Bytes ストアとインデックスに書き込んだバイト数の合計
+	Bytes uint64
+}
+
+// TruncatePreview Truncate(lowest)で削除されるセグメントを、何も削除せずに返す
+func (l *Log) TruncatePreview(lowest uint64) ([]SegmentInfo, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var infos []SegmentInfo
+	for _, s := range l.segments {
+		if !l.truncatable(s, lowest) {
+			continue
+		}
+		infos = append(infos, SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StorePath:  s.store.Name(),
+			IndexPath:  s.index.Name(),
+			Bytes:      s.store.size + s.index.size,
+		})
+	}
+	return infos, nil
+}
+
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	highestOffset, err := l.highestOffset()
+	return l.append(record)
+}
+
+// AppendAt 次に採番されるオフセットがoffと一致する場合のみレコードを追加する。
+// 一致しない場合は実際の次のオフセットを含むエラーを返す
+func (l *Log) AppendAt(record *api.Record, off uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if next := l.activeSegment.nextOffset; next != off {
+		return 0, api.ErrOffsetMismatch{Expected: off, Actual: next}
+	}
+
+	return l.append(record)
+}
+
+// AppendIfMatch 最大のオフセットがexpectedHighestと一致する場合のみレコードを追加する。
+// 一致しない場合は実際の最大のオフセットを含むErrHighestMismatchを返す。
+// INFO: 空のログの最大のオフセットは、レコードが1件のログと同じく0とみなすので、最初のレコードはAppendAtで追加すること
+func (l *Log) AppendIfMatch(record *api.Record, expectedHighest uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	highest, err := l.highestOffset()
 	if err != nil {
 		return 0, err
 	}
+	if highest != expectedHighest {
+		return 0, api.ErrHighestMismatch{Expected: expectedHighest, Actual: highest}
+	}
 
-	// アクティブセグメントが最大の場合は新しいアクティブセグメントを作成
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(highestOffset + 1)
-		if err != nil {
+	return l.append(record)
+}
+
+// AppendAligned アクティブセグメントにレコードがある場合は新しいセグメントに切り替えてから追加し、
+// レコードがセグメントの先頭になるようにする。スナップショットの時点などの区切りを、複製やバックアップの単位に揃えるために使う
+func (l *Log) AppendAligned(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	if s := l.activeSegment; s.nextOffset > s.baseOffset {
+		if err := l.breakerAllow(); err != nil {
+			return 0, err
+		}
+		if err := l.rollover(rolloverAligned); err != nil {
+			l.breakerRecord(err)
 			return 0, err
 		}
 	}
+	return l.append(record)
+}
+
+// AppendWithLocation レコードを追加し、ストアファイル内でレコードが占める位置も返す。
+// 返した位置をすぐに読み出せるよう、バッファの内容はファイルに書き出してから返す
+func (l *Log) AppendWithLocation(record *api.Record) (uint64, RecordLocation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	off, err := l.activeSegment.Append(record)
+	off, loc, err := l.appendWithLocation(record)
 	if err != nil {
+		return 0, loc, err
+	}
+	if err = l.activeSegment.store.flush(); err != nil {
+		return 0, loc, fsError(err)
+	}
+
+	return off, loc, nil
+}
+
+func (l *Log) append(record *api.Record) (uint64, error) {
+	off, _, err := l.appendWithLocation(record)
+	return off, err
+}
+
+func (l *Log) appendWithLocation(record *api.Record) (uint64, RecordLocation, error) {
+	var loc RecordLocation
+	if err := l.writable(); err != nil {
+		return 0, loc, err
+	}
+	if err := l.prepareRecord(record); err != nil {
+		return 0, loc, err
+	}
+	if err := l.breakerAllow(); err != nil {
+		return 0, loc, err
+	}
+
+	off, loc, err := l.writeRecord(record)
+	l.breakerRecord(err)
+	if err != nil {
+		return 0, loc, fsError(err)
+	}
+	l.Config.Metrics.recordSize(l.Config.Topic, loc.Length)
+	l.notifyAppended()
+	l.checkThresholds()
+	return off, loc, nil
+}
+
+// prepareRecord 書き込む前にレコードを検証し、有効期間のあるレコードに時刻を付与する
+func (l *Log) prepareRecord(record *api.Record) error {
+	// 検証に失敗したレコードはディスクに書き込まない
+	if l.Config.Validate != nil {
+		if err := l.Config.Validate(record); err != nil {
+			return api.ErrInvalidRecord{Err: err}
+		}
+	}
+	if l.Config.PreserveOffset {
+		if next := l.activeSegment.nextOffset; record.Offset != next {
+			return api.ErrOffsetMismatch{Expected: record.Offset, Actual: next}
+		}
+	}
+	// 有効期間は時刻から数えるので、時刻のないレコードには追加した時刻を付与する
+	if record.Ttl > 0 && record.Timestamp == 0 {
+		record.Timestamp = ttlNow().UnixNano()
+	}
+	return nil
+}
+
+// writeRecord 必要に応じてセグメントを切り替えてからレコードを書き込み、キーとIDの索引を更新する。
+// 書き込みのロックを獲得した状態で呼び出す
+func (l *Log) writeRecord(record *api.Record) (uint64, RecordLocation, error) {
+	if err := l.rolloverIfMaxed(); err != nil {
+		return 0, RecordLocation{}, err
+	}
+
+	off, loc, err := l.activeSegment.append(record)
+	if err != nil {
+		return 0, loc, err
+	}
+	if l.keys != nil && len(record.Key) > 0 {
+		l.keys[string(record.Key)] = off
+	}
+	if l.ids != nil && record.Id != "" {
+		l.ids[record.Id] = off
+	}
+	return off, loc, nil
+}
+
+// rolloverIfMaxed アクティブセグメントが最大の場合は新しいアクティブセグメントを作成する。書き込みのロックを獲得した状態で呼び出す
+func (l *Log) rolloverIfMaxed() error {
+	cause := l.activeSegment.maxedCause()
+	if cause == "" {
+		return nil
+	}
+	return l.rollover(cause)
+}
+
+// rollover 次のオフセットから始まる新しいアクティブセグメントを作成し、causeを切り替えた理由として記録する。
+// 書き込みのロックを獲得した状態で呼び出す
+func (l *Log) rollover(cause string) error {
+	highestOffset, err := l.highestOffset()
+	if err != nil {
+		return err
+	}
+
+	sealed := l.activeSegment
+	if err = l.newSegment(highestOffset + 1); err != nil {
+		return err
+	}
+	l.Config.Metrics.rollover(l.Config.Topic, cause)
+	l.Config.Events.Publish(events.SegmentRolled, map[string]string{
+		"dir":                l.Dir,
+		"cause":              cause,
+		"sealed_base_offset": strconv.FormatUint(sealed.baseOffset, 10),
+		"base_offset":        strconv.FormatUint(l.activeSegment.baseOffset, 10),
+	})
+
+	// 書き込みが終わったセグメントを通知する前に、バッファの内容をファイルに書き出しておく
+	if l.Config.OnSegmentSealed != nil {
+		if err = sealed.store.flush(); err != nil {
+			return fsError(err)
+		}
+		l.Config.OnSegmentSealed(sealed.baseOffset, sealed.store.Name(), sealed.index.Name())
+	}
+	return nil
+}
+
+// fsError ファイルシステムの空き不足や読み込み専用によるエラーを、型付きのエラーに変換する
+func fsError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return api.ErrDiskFull{Err: err}
+	case errors.Is(err, syscall.EROFS):
+		return api.ErrReadOnlyFilesystem{Err: err}
+	}
+	return err
+}
+
+// BulkLoad Readerと同じ形式で並んだレコードを読み込み、ロックを一度だけ獲得してまとめて追加する。
+// リストアや初期データの投入のためのメソッドで、追加したレコード数を返す。
+// レコードごとのサーキットブレーカーやメトリクスは経由せず、購読者への通知としきい値の確認は最後に一度だけ行う
+func (l *Log) BulkLoad(r io.Reader) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writable(); err != nil {
 		return 0, err
 	}
+	var count uint64
+	// INFO: 途中で失敗した場合も、それまでに追加したレコードは読み出せるので通知する
+	defer func() {
+		if count > 0 {
+			l.notifyAppended()
+			l.checkThresholds()
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	size := make([]byte, lenWidth)
+	for {
+		// レコードの長さを読み込み、入力の終端に達していれば終了
+		if _, err := io.ReadFull(br, size); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+
+		p := make([]byte, enc.Uint64(size))
+		if _, err := io.ReadFull(br, p); err != nil {
+			return count, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return count, err
+		}
+		// Readerの出力は圧縮されたままなので、展開してから追加し直す
+		if err := decodeValue(record); err != nil {
+			return count, err
+		}
 
-	return off, nil
+		if err := l.prepareRecord(record); err != nil {
+			return count, err
+		}
+		if _, _, err := l.writeRecord(record); err != nil {
+			return count, fsError(err)
+		}
+		count++
+	}
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *segment
-	for _, segment := range l.segments {
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return nil, err
+	}
+	return liveRecord(s.Read(off))
+}
+
+// ReadWithPosition レコードを読み出し、ストアファイル内でレコードが占める位置も返す。
+// 位置はAppendWithLocationと同じく、長さの接頭辞を除いたレコードのバイト列を指す
+func (l *Log) ReadWithPosition(off uint64) (*api.Record, RecordLocation, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return nil, RecordLocation{}, err
+	}
+	record, loc, err := s.readWithLocation(off)
+	if record, err = liveRecord(record, err); err != nil {
+		return nil, RecordLocation{}, err
+	}
+	return record, loc, nil
+}
+
+// segmentFor offを含むセグメントを返す。ロックを獲得した状態で呼び出す
+func (l *Log) segmentFor(off uint64) (*segment, error) {
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	for i, segment := range l.segments {
+		if max := l.Config.MaxReadScanSegments; max > 0 && i >= max {
+			return nil, api.ErrReadScanLimit{Offset: off, Max: max}
+		}
 		// セグメントのベースセグメントはセグメント内の最小のオフセットなので、
-		// ベースオフセットが探しているオフセット以下であり、かつnextOffsetが探しているオフセットより大きい最初のセグメントを探す
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+		// 読み出せる最小のオフセットが探しているオフセット以下であり、かつnextOffsetが探しているオフセットより大きい最初のセグメントを探す
+		if l.readableFrom(segment) <= off && off < segment.nextOffset {
+			return segment, nil
 		}
 	}
-	if s == nil {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	if l.isMissing(off) {
+		return nil, api.ErrOffsetUnavailable{Offset: off}
 	}
-	return s.Read(off)
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
 }
 
-// Close セグメントをすべてクローズする
+// readableFrom セグメントのうち読み出せる最小のオフセットを返す。
+// AppendWithRetentionで読み出せなくしたレコードは、セグメントに残っていても読み出さない。ロックを獲得した状態で呼び出す
+func (l *Log) readableFrom(s *segment) uint64 {
+	if s.baseOffset < l.retainedFrom {
+		return l.retainedFrom
+	}
+	return s.baseOffset
+}
+
+// ReadUpToBytes fromから順にレコードを読み出し、読み出したレコードと次に読み出すオフセットを返す。
+// 次のレコードを加えると値の合計バイト数がmaxBytesを超える場合はそこで止めるが、少なくとも1件は返す。
+// 有効期間の過ぎたレコードは読み飛ばし、末尾まで期限切れのレコードしかない場合はErrRecordExpiredを返す
+func (l *Log) ReadUpToBytes(from uint64, maxBytes int) ([]*api.Record, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+
+	var records []*api.Record
+	var total int
+	off := from
+	for _, s := range l.segments {
+		for ; l.readableFrom(s) <= off && off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			if expired(record) {
+				continue
+			}
+			if len(records) > 0 && total+len(record.Value) > maxBytes {
+				return records, off, nil
+			}
+			records = append(records, record)
+			total += len(record.Value)
+		}
+	}
+	if len(records) == 0 && off > from {
+		return nil, 0, api.ErrRecordExpired{Offset: from}
+	}
+	if len(records) == 0 {
+		return nil, 0, api.ErrOffsetOutOfRange{Offset: from}
+	}
+	return records, off, nil
+}
+
+// FindLast fromから最小のオフセットに向かって遡り、predを満たす最初のレコードを返す。
+// fromが最大のオフセットより大きい場合は最大のオフセットから遡る。有効期間の過ぎたレコードはpredに渡さない。
+// 見つからない場合はErrNoMatchingRecordを返す
+func (l *Log) FindLast(from uint64, pred func(*api.Record) bool) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		lowest := l.readableFrom(s)
+		if lowest > from || s.nextOffset <= lowest {
+			continue
+		}
+		off := s.nextOffset - 1
+		if from < off {
+			off = from
+		}
+		for ; ; off-- {
+			record, err := s.Read(off)
+			if err != nil {
+				return nil, err
+			}
+			if !expired(record) && pred(record) {
+				return record, nil
+			}
+			if off == lowest {
+				break
+			}
+		}
+	}
+	return nil, api.ErrNoMatchingRecord{From: from}
+}
+
+// ReadSegment ベースオフセットがbaseOffsetのセグメントに含まれる、読み出せるレコードをすべて返す。有効期間の過ぎたレコードは含まない
+func (l *Log) ReadSegment(baseOffset uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range l.segments {
+		if s.baseOffset != baseOffset {
+			continue
+		}
+
+		from := l.readableFrom(s)
+		records := make([]*api.Record, 0, s.nextOffset-from)
+		for off := from; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return nil, err
+			}
+			if expired(record) {
+				continue
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	return nil, api.ErrSegmentNotFound{BaseOffset: baseOffset}
+}
+
+// HealthCheck すべてのセグメントのインデックスが、メモリにマップした大きさのまま読み書きできるかを確認する。
+// 異常を検出したセグメントの読み書きは、以降ErrIndexUnhealthyを返す
+func (l *Log) HealthCheck() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var first error
+	for _, s := range l.segments {
+		if err := s.index.check(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close セグメントをすべてクローズする。閉じたログの操作はErrLogClosedを返し、もう一度閉じても何もしない
 func (l *Log) Close() error {
+	// INFO: ゴルーチンがロックを待っている可能性があるので、ロックを獲得する前に停止させる
+	l.stopBackground()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.closed.Load() {
+		return nil
+	}
+	// INFO: セグメントを閉じる途中で失敗しても、一部の閉じたセグメントに触れないよう先に閉じたことにする
+	l.closed.Store(true)
+
+	// INFO: 失敗しても残りのセグメントを閉じてロックを解放し、次にNewLogで開けるようにする。エラーは最初のものを返す
+	var first error
+	// INFO: 空のセグメントを封じると、開き直すたびに空のセグメントが増えるので、レコードがある場合のみ封じる
+	if s := l.activeSegment; l.Config.SealOnClose && !l.Config.ReadOnly && !s.sealed && s.nextOffset > s.baseOffset {
+		if err := s.seal(l.Dir); err != nil {
+			first = fsError(err)
+		}
+	}
+
 	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
-			return err
+		if err := segment.Close(); err != nil && first == nil {
+			first = err
 		}
 	}
 
-	return nil
+	if err := l.unlockDir(); err != nil && first == nil {
+		first = err
+	}
+	return first
 }
 
-// Remove セグメントをすべてクローズし、データをすべて削除する
-func (l *Log) Remove() error {
-	if err := l.Close(); err != nil {
+// CloseContext 新しい操作を受け付けるのをやめ、実行中の読み出しや書き込みが終わるのを待ってからログを閉じる。
+// ctxが先に終了した場合はctxのエラーを返すが、実行中の操作が終わり次第ログは閉じられる
+func (l *Log) CloseContext(ctx context.Context) error {
+	// INFO: 実行中の操作はロックを獲得しているので、Closeは終わるまで書き込みのロックを待つ。
+	//  書き込みのロックを待っている間は新しい読み込みのロックも獲得できず、獲得できたときには閉じている
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Close()
+	}()
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return os.RemoveAll(l.Dir)
 }
 
-// Reset データをすべて削除し、新しいログを作成する
-func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+// Remove セグメントをすべてクローズし、データをすべて削除する
+func (l *Log) Remove() error {
+	if err := l.Close(); err != nil {
 		return err
 	}
 
-	return l.setup()
+	return l.Config.fs().RemoveAll(l.Dir)
 }
 
-// Reader ログ全体を読み込むためのio.Readerを返す
+// Reader ログ全体を読み込むためのio.Readerを返す。AppendWithRetentionで読み出せなくしたレコードは含まない
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originalReader{segment.store, 0}
+		// INFO: 追加済みのデータがすべて読み出せるよう、バッファの内容をファイルに書き出しておく。
+		//  書き出しに失敗した場合、エラーはバッファに残るので、読み出し時に同じエラーが返ってくる
+		_ = segment.store.flush()
+		pos, err := segment.position(l.readableFrom(segment))
+		if err != nil {
+			readers[i] = &errReader{err}
+			continue
+		}
+		readers[i] = &originalReader{segment.store, int64(pos)}
 	}
 	return io.MultiReader(readers...)
 }
 
+// ReaderContext Readerと同じ内容を読み出すが、ctxがキャンセルされると以降のReadはctxのエラーを返す
+func (l *Log) ReaderContext(ctx context.Context) io.Reader {
+	return &contextReader{ctx: ctx, r: l.Reader()}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// errReader 常にerrを返すio.Reader
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
 type originalReader struct {
 	*store
 	off int64
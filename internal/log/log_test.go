@@ -1,38 +1,92 @@
 package log
 
 import (
-	api "github.com/radish-miyazaki/proglog/api/v1"
-	"github.com/stretchr/testify/require"
-	"google.golang.org/protobuf/proto"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
 )
 
+// logScenarios TestLogとTestLogMemFSで共通に実行するログのシナリオ
+var logScenarios = map[string]func(
+	t *testing.T, log *Log){
+	"append and read a record succeeds": testAppendRead,
+	"offset out of range error":         testOutOfRangeErr,
+	"init with existing segments":       testInitExisting,
+	"reader":                            testReader,
+	"truncate":                          testTruncate,
+	"compact and swap":                  testCompactAndSwap,
+	"compact and swap failure":          testCompactAndSwapFailure,
+	"compact by key leaves markers":     testCompactByKey,
+	"append at expected offset":         testAppendAt,
+	"bulk load":                         testBulkLoad,
+	"segment sealed callback":           testOnSegmentSealed,
+	"truncate concurrent with reads":    testTruncateConcurrentReads,
+	"append with location":              testAppendWithLocation,
+	"dedup identical values":            testDedup,
+	"iterator seek":                     testIteratorSeek,
+	"reader includes buffered records":  testReaderBuffered,
+	"update config":                     testUpdateConfig,
+	"read segment":                      testReadSegment,
+	"read with position":                testReadWithPosition,
+}
+
 func TestLog(t *testing.T) {
-	for scenario, fn := range map[string]func(
-		t *testing.T, log *Log){
-		"append and read a record succeeds": testAppendRead,
-		"offset out of range error":         testOutOfRangeErr,
-		"init with existing segments":       testInitExisting,
-		"reader":                            testReader,
-		"truncate":                          testTruncate,
-	} {
+	for scenario, fn := range logScenarios {
 		t.Run(scenario, func(t *testing.T) {
-			dir, err := os.MkdirTemp("", "store-test")
-			require.NoError(t, err)
-			defer os.RemoveAll(dir)
-
 			c := Config{}
 			c.Segment.MaxStoreBytes = 32
-			log, err := NewLog(dir, c)
-			require.NoError(t, err)
+			log := newTestLog(t, c)
 
 			fn(t, log)
 		})
 	}
 }
 
+// newTestLog 一時ディレクトリにcの設定でログを作成する。ログはテストの終わりに閉じ、ディレクトリは削除する
+func newTestLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { log.Close() })
+	return log
+}
+
+// fakeTicks backgroundTickerを差し替え、テストから周期を進めるチャネルを返す。
+// バッファを持たないので、次の周期を送れた時点でゴルーチンは前の周期の処理を終えている
+func fakeTicks(t *testing.T) chan<- time.Time {
+	t.Helper()
+	ticks := make(chan time.Time)
+	orig := backgroundTicker
+	backgroundTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	t.Cleanup(func() { backgroundTicker = orig })
+	return ticks
+}
+
 // ログへの追加とログからの読み出しが正常に行えるか
 func testAppendRead(t *testing.T, log *Log) {
 	ap := &api.Record{
@@ -122,5 +176,962 @@ func testTruncate(t *testing.T, log *Log) {
 	require.NoError(t, err)
 	_, err = log.Read(0)
 	require.Error(t, err)
+
+	// すべてのレコードを切り詰めても、アクティブセグメントは残る
+	require.NoError(t, log.Truncate(2))
+	require.Equal(t, 1, len(log.segments))
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = log.Append(ap)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	require.NoError(t, log.Close())
+}
+
+// 次のオフセットと一致する場合のみ追加できるか
+func testAppendAt(t *testing.T, log *Log) {
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.AppendAt(ap, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = log.AppendAt(ap, 0)
+	require.Equal(t, api.ErrOffsetMismatch{Expected: 0, Actual: 1}, err)
+
+	off, err = log.AppendAt(ap, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	require.NoError(t, log.Close())
+}
+
+// 別のログのReaderの出力をまとめて取り込めるか
+func testBulkLoad(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	c := log.Config
+	c.Thresholds.Segments = 1
+	var events []ThresholdEvent
+	c.OnThreshold = func(e ThresholdEvent) {
+		events = append(events, e)
+	}
+	dst := newTestLog(t, c)
+	sub := dst.Subscribe()
+
+	count, err := dst.BulkLoad(log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), count)
+	// 上限に応じてセグメントが分割されているか
+	require.Equal(t, len(log.segments), len(dst.segments))
+	require.Greater(t, len(dst.segments), 1)
+	// しきい値は読み込みの終わりに一度だけ確認されているか
+	require.Len(t, events, 1)
+	require.Equal(t, uint64(len(dst.segments)), events[0].Value)
+	// 読み込みの前に購読していれば、すべてのレコードを受け取れるか
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := uint64(0); i < 5; i++ {
+		record, err := sub.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+	}
+
+	for i := uint64(0); i < 5; i++ {
+		read, err := dst.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+
+	require.NoError(t, dst.Close())
+	require.NoError(t, log.Close())
+}
+
+// セグメントが切り替わったときに、書き込みの終わったセグメントが通知されるか
+func testOnSegmentSealed(t *testing.T, log *Log) {
+	type sealed struct {
+		baseOffset           uint64
+		storePath, indexPath string
+	}
+	var got []sealed
+	log.Config.OnSegmentSealed = func(baseOffset uint64, storePath, indexPath string) {
+		got = append(got, sealed{baseOffset, storePath, indexPath})
+	}
+
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(ap)
+		require.NoError(t, err)
+	}
+	require.Empty(t, got)
+
+	// 3件目の追加でセグメントが切り替わる
+	_, err := log.Append(ap)
+	require.NoError(t, err)
+	require.Equal(t, []sealed{{
+		baseOffset: 0,
+		storePath:  filepath.Join(log.Dir, "0.store"),
+		indexPath:  filepath.Join(log.Dir, "0.index"),
+	}}, got)
+
+	// 通知された時点でストアファイルにレコードが書き出されているか
+	fi, err := log.Config.fs().Stat(got[0].storePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(log.segments[0].store.size), fi.Size())
+
+	require.NoError(t, log.Close())
+}
+
+// 切り詰めている間も、残るセグメントのレコードを読み出せるか
+func testTruncateConcurrentReads(t *testing.T, log *Log) {
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(ap)
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for off := uint64(6); off < 10; off++ {
+					if _, err := log.Read(off); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	require.NoError(t, log.Truncate(5))
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	_, err := log.Read(0)
+	require.Error(t, err)
+	_, err = log.Read(6)
+	require.NoError(t, err)
+
+	require.NoError(t, log.Close())
+}
+
+// 返された位置のバイト列から、追加したレコードを復元できるか
+func testAppendWithLocation(t *testing.T, log *Log) {
+	for i := uint64(0); i < 3; i++ {
+		ap := &api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		}
+		off, loc, err := log.AppendWithLocation(ap)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, log.activeSegment.baseOffset, loc.BaseOffset)
+
+		f, err := log.Config.fs().OpenFile(loc.StorePath, os.O_RDONLY, 0)
+		require.NoError(t, err)
+		b := make([]byte, loc.Length)
+		_, err = f.ReadAt(b, int64(loc.Position))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		read := &api.Record{}
+		err = proto.Unmarshal(b, read)
+		require.NoError(t, err)
+		require.Equal(t, ap.Value, read.Value)
+		require.Equal(t, off, read.Offset)
+	}
+
+	require.NoError(t, log.Close())
+}
+
+// 読み出したレコードの位置から、ストアファイル上の同じバイト列を読み出せるか
+func testReadWithPosition(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	for off := uint64(0); off < 3; off++ {
+		record, loc, err := log.ReadWithPosition(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+
+		s, err := log.segmentFor(off)
+		require.NoError(t, err)
+		require.Equal(t, s.baseOffset, loc.BaseOffset)
+
+		// ストアの位置は長さの接頭辞の後を指す
+		p, err := s.store.Read(loc.Position - lenWidth)
+		require.NoError(t, err)
+		require.Equal(t, loc.Length, uint64(len(p)))
+
+		f, err := log.Config.fs().OpenFile(loc.StorePath, os.O_RDONLY, 0)
+		require.NoError(t, err)
+		b := make([]byte, loc.Length)
+		_, err = f.ReadAt(b, int64(loc.Position))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Equal(t, p, b)
+
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b, read))
+		require.Equal(t, record.Value, read.Value)
+	}
+
+	_, _, err := log.ReadWithPosition(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	require.NoError(t, log.Close())
+}
+
+// 重複排除を有効にしたログで、同じ値を追加してもそれぞれのオフセットで読み出せるか
+func testDedup(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.Dedup = true
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := uint64(0); i < 3; i++ {
+		off, err := log.Append(ap)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	size := log.activeSegment.store.size
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, ap.Value, read.Value)
+		require.Equal(t, i, read.Offset)
+	}
+	require.NoError(t, log.Close())
+
+	// 再度開いた後も重複した値でストアは大きくならない
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	off, err := log.Append(ap)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Equal(t, size, log.activeSegment.store.size)
+
+	// 時刻だけが異なるレコードも重複とみなす
+	off, err = log.Append(&api.Record{Value: ap.Value, Timestamp: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.Equal(t, size, log.activeSegment.store.size)
+
+	// 有効期間のあるレコードは重複排除しない
+	_, err = log.Append(&api.Record{Value: ap.Value, Ttl: 60})
+	require.NoError(t, err)
+	require.Greater(t, log.activeSegment.store.size, size)
+	require.NoError(t, log.Close())
+
+	// レコードごとにIDを振る設定とは併用できない
+	c.Segment.RecordIDs = true
+	_, err = NewLog(log.Dir, c)
+	require.Error(t, err)
+}
+
+// ファイルシステムの空き不足や読み込み専用のエラーが、型付きのエラーとして返ってくるか
+func TestLogFilesystemErrors(t *testing.T) {
+	orig := fileOpener
+	defer func() { fileOpener = orig }()
+
+	for name, tc := range map[string]struct {
+		errno syscall.Errno
+		want  error
+		code  codes.Code
+	}{
+		"disk full":            {syscall.ENOSPC, api.ErrDiskFull{}, codes.ResourceExhausted},
+		"read-only filesystem": {syscall.EROFS, api.ErrReadOnlyFilesystem{}, codes.FailedPrecondition},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "fs-error-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			var fail bool
+			fileOpener = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+				if fail {
+					return nil, &os.PathError{Op: "open", Path: name, Err: tc.errno}
+				}
+				return orig(name, flag, perm)
+			}
+
+			// ログの作成に失敗する場合
+			fail = true
+			_, err = NewLog(dir, Config{})
+			require.IsType(t, tc.want, err)
+			require.ErrorIs(t, err, tc.errno)
+			require.Equal(t, tc.code, status.Code(err))
+
+			// セグメントの切り替えに失敗する場合
+			fail = false
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fail = true
+			ap := &api.Record{Value: []byte("hello world")}
+			for i := 0; i < 2; i++ {
+				_, err = log.Append(ap)
+				require.NoError(t, err)
+			}
+			_, err = log.Append(ap)
+			require.IsType(t, tc.want, err)
+			require.Equal(t, tc.code, status.Code(err))
+		})
+	}
+}
+
+// バッファに溜まっているレコードも含めて、Readerからすべてのレコードを読み出せるか
+func testReaderBuffered(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	// 最後のレコードはまだファイルに書き出されていない
+	require.Greater(t, log.activeSegment.store.buf.Buffered(), 0)
+
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], read))
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+		require.Equal(t, uint64(i), read.Offset)
+		b = b[lenWidth+size:]
+	}
+	require.Empty(t, b)
+
+	require.NoError(t, log.Close())
+}
+
+// 実行中にストアの上限を引き上げると、アクティブセグメントにより多く格納されるか
+func testUpdateConfig(t *testing.T, log *Log) {
+	ap := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(ap)
+	require.NoError(t, err)
+
+	c := log.Config
+	c.Segment.MaxIndexBytes = 0
+	require.Error(t, log.UpdateConfig(c))
+
+	c = log.Config
+	c.Segment.MaxStoreBytes = 1024
+	require.NoError(t, log.UpdateConfig(c))
+
+	// 元の上限である2件を超えても切り替わらない
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(ap)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, len(log.segments))
+	require.Greater(t, log.activeSegment.store.size, uint64(32))
+
+	require.NoError(t, log.Close())
+}
+
+// 指定したベースオフセットのセグメントのレコードだけを読み出せるか
+func testReadSegment(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(2), log.segments[1].baseOffset)
+
+	records, err := log.ReadSegment(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	for i, record := range records {
+		require.Equal(t, uint64(2+i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", 2+i)), record.Value)
+	}
+
+	// セグメントの途中のオフセットはベースオフセットではない
+	_, err = log.ReadSegment(3)
+	require.Equal(t, api.ErrSegmentNotFound{BaseOffset: 3}, err)
+
+	require.NoError(t, log.Close())
+}
+
+// 値の合計バイト数の上限を守ってレコードを読み出せるか
+func TestLogReadUpToBytes(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	// 1セグメントに2件ずつ格納される
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	// セグメントの境界をまたいで読み出す
+	records, next, err := log.ReadUpToBytes(1, 35)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, uint64(4), next)
+	for i, record := range records {
+		require.Equal(t, uint64(1+i), record.Offset)
+	}
+
+	// 上限より大きいレコードでも1件は返す
+	records, next, err = log.ReadUpToBytes(4, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(5), next)
+
+	_, _, err = log.ReadUpToBytes(5, 100)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// 検証に失敗したレコードが書き込まれないか
+func TestLogValidate(t *testing.T) {
+	errEmpty := errors.New("empty value")
+	c := Config{}
+	c.Validate = func(record *api.Record) error {
+		if len(record.Value) == 0 {
+			return errEmpty
+		}
+		return nil
+	}
+	log := newTestLog(t, c)
+
+	_, err := log.Append(&api.Record{})
+	require.IsType(t, api.ErrInvalidRecord{}, err)
+	require.ErrorIs(t, err, errEmpty)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, uint64(0), log.activeSegment.store.size)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+// コンテキストをキャンセルすると読み出しが止まるか
+func TestLogReaderContext(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := log.ReaderContext(ctx)
+
+	// キャンセル前は読み出せる
+	b := make([]byte, lenWidth)
+	_, err := io.ReadFull(reader, b)
+	require.NoError(t, err)
+
+	cancel()
+	_, err = io.Copy(io.Discard, reader)
+	require.Equal(t, context.Canceled, err)
+}
+
+// インデックスファイルが切り詰められたことを、読み出しでSIGBUSになる前に検出できるか
+func TestLogHealthCheck(t *testing.T) {
+	log := newTestLog(t, Config{})
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.HealthCheck())
+
+	require.NoError(t, os.Truncate(log.activeSegment.index.Name(), 0))
+
+	err = log.HealthCheck()
+	require.IsType(t, api.ErrIndexUnhealthy{}, err)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	// 異常を検出したセグメントはマップした領域に触れずにエラーを返す
+	_, err = log.Read(0)
+	require.IsType(t, api.ErrIndexUnhealthy{}, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.IsType(t, api.ErrIndexUnhealthy{}, err)
+}
+
+// オフセットを保ったままレコードを複製できるか
+func TestLogPreserveOffset(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.PreserveOffset = true
+	log := newTestLog(t, c)
+
+	// セグメントをまたいでも、正しいオフセットのレコードは追加できる
+	for off := uint64(0); off < 3; off++ {
+		got, err := log.Append(&api.Record{Value: []byte("hello world"), Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, off, got)
+	}
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world"), Offset: 5})
+	require.Equal(t, api.ErrOffsetMismatch{Expected: 5, Actual: 3}, err)
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// 条件を満たす最新のレコードを遡って見つけられるか
+func TestLogFindLast(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	for _, key := range []string{"a", "b", "a", "b", "c"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	keyIs := func(key string) func(*api.Record) bool {
+		return func(record *api.Record) bool {
+			return string(record.Key) == key
+		}
+	}
+
+	// 最大のオフセットより大きい場合は末尾から遡る
+	record, err := log.FindLast(100, keyIs("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+
+	// セグメントをまたいで遡る
+	record, err = log.FindLast(2, keyIs("b"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+
+	_, err = log.FindLast(3, keyIs("c"))
+	require.Equal(t, api.ErrNoMatchingRecord{From: 3}, err)
+}
+
+// WarmIndexesを有効にすると、起動時にすべてのセグメントのインデックスがメモリに読み込まれるか
+func TestLogWarmIndexes(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	want := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(want)
+		require.NoError(t, err)
+	}
+	segments := len(log.segments)
 	require.NoError(t, log.Close())
+
+	warmed := 0
+	orig := indexWarm
+	defer func() { indexWarm = orig }()
+	indexWarm = func(i *index) {
+		orig(i)
+		// INFO: 常駐しているかはカーネル次第なので、確認できる場合のみ検証する
+		if resident, err := i.mmap.IsResident(); err == nil && len(resident) > 0 {
+			require.True(t, resident[0])
+		}
+		warmed++
+	}
+
+	c.WarmIndexes = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, segments, warmed)
+	for off := uint64(0); off < 5; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+}
+
+// SegmentBaseが、レコードを含むセグメントのベースオフセットを返すか
+func TestLogSegmentBase(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	log := newTestLog(t, c)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	for off, want := range []uint64{0, 0, 2, 2, 4} {
+		base, err := log.SegmentBase(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, base)
+	}
+	_, err := log.SegmentBase(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+}
+
+// セグメントの上限を超えるレコードは、領域を確保したストアの場合のみ拒否されるか
+func TestLogRecordTooLarge(t *testing.T) {
+	value := make([]byte, 2000)
+	for name, preallocate := range map[string]bool{
+		"appends past the max store bytes":                     false,
+		"rejects records that do not fit a preallocated store": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := Config{}
+			c.Segment.PreallocateStore = preallocate
+			log := newTestLog(t, c)
+
+			_, appendErr := log.Append(&api.Record{Value: value})
+			_, readerErr := log.AppendReader(bytes.NewReader(value), int64(len(value)))
+			for _, err := range []error{appendErr, readerErr} {
+				if !preallocate {
+					require.NoError(t, err)
+					continue
+				}
+				var tooLarge api.ErrRecordTooLarge
+				require.ErrorAs(t, err, &tooLarge)
+				require.Equal(t, uint64(1024), tooLarge.Max)
+			}
+
+			if !preallocate {
+				for off := uint64(0); off < 2; off++ {
+					read, err := log.Read(off)
+					require.NoError(t, err)
+					require.Equal(t, value, read.Value)
+				}
+			}
+		})
+	}
+}
+func (paddedNaming) StorePath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", baseOffset))
+}
+func (paddedNaming) IndexPath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.idx", baseOffset))
+}
+func (paddedNaming) Parse(name string) (uint64, bool) {
+	ext := filepath.Ext(name)
+	if ext != ".log" && ext != ".idx" {
+		return 0, false
+	}
+	off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	return off, err == nil
+}
+
+// AppendAlignedで追加したレコードが、常にセグメントの先頭のオフセットになるか
+func TestLogAppendAligned(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics, err := NewMetrics(reg)
+	require.NoError(t, err)
+	c := Config{Metrics: metrics}
+	log := newTestLog(t, c)
+
+	record := &api.Record{Value: []byte("hello world")}
+	aligned := func() uint64 {
+		off, err := log.AppendAligned(record)
+		require.NoError(t, err)
+		// セグメントのベースオフセットとして見つかる
+		records, err := log.ReadSegment(off)
+		require.NoError(t, err)
+		require.Equal(t, off, records[0].Offset)
+		return off
+	}
+
+	// 空のアクティブセグメントには、切り替えずに追加する
+	require.Equal(t, uint64(0), aligned())
+	require.Len(t, log.segments, 1)
+
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(4), aligned())
+	require.Equal(t, uint64(5), aligned())
+	require.Len(t, log.segments, 3)
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.rollovers.WithLabelValues(rolloverAligned, "")))
+
+	// 続けて追加したレコードは同じセグメントに入る
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	records, err := log.ReadSegment(5)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, off, records[1].Offset)
+}
+
+// 同時に閉じてもパニックせず、セグメントを閉じられなくてもロックは解放されるか
+func TestLogCloseConcurrently(t *testing.T) {
+	dir, err := os.MkdirTemp("", "close-concurrently-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.IndexSyncInterval = time.Millisecond
+	c.AutoCompact.Interval = time.Millisecond
+	for i := 0; i < 10; i++ {
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = log.Close()
+			}()
+		}
+		wg.Wait()
+		require.NoError(t, log.Close())
+	}
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// INFO: 先にストアのファイルを閉じておき、Closeでセグメントを閉じられないようにする
+	require.NoError(t, log.activeSegment.store.File.Close())
+	require.Error(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+func TestLogCloseContext(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	// 閉じている間も読み出し続け、閉じたセグメントに触れずにErrLogClosedで終わることを確認する
+	var wg, reading sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		reading.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n, off := 0, uint64(i%6); ; n, off = n+1, (off+1)%6 {
+				got, err := log.Read(off)
+				if err != nil {
+					require.Equal(t, api.ErrLogClosed{Dir: dir}, err)
+					return
+				}
+				require.Equal(t, record.Value, got.Value)
+				// すべてのゴルーチンが読み出しを始めてから閉じる
+				if n == 0 {
+					reading.Done()
+				}
+			}
+		}(i)
+	}
+	reading.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, log.CloseContext(ctx))
+	wg.Wait()
+
+	_, err := log.Append(record)
+	require.Equal(t, api.ErrLogClosed{Dir: dir}, err)
+	require.Equal(t, api.ErrLogClosed{Dir: dir}, log.ReadInto(0, &api.Record{}))
+	// もう一度閉じても何もしない
+	require.NoError(t, log.Close())
+
+	// 実行中の操作が終わらないうちに期限が来た場合は、終わり次第閉じる
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	log.mu.RLock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, log.CloseContext(ctx), context.DeadlineExceeded)
+	log.mu.RUnlock()
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrLogClosed{Dir: dir}, err)
+}
+func TestLogMaxReadScanSegments(t *testing.T) {
+	c := Config{MaxReadScanSegments: 3}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 5)
+
+	// 上限までのセグメントにあるレコードは読み出せる
+	for off := uint64(0); off < 6; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+	// それより後ろのセグメントを探すと上限を超える
+	_, err := log.Read(6)
+	require.Equal(t, api.ErrReadScanLimit{Offset: 6, Max: 3}, err)
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, err.Error(), "scanned more than 3 segments")
+}
+func TestLogAppendIfMatch(t *testing.T) {
+	log := newTestLog(t, Config{})
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := log.Append(record)
+	require.NoError(t, err)
+
+	// 同じ最大のオフセットを期待して同時に追加すると、1つだけが成功する
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	offs := make([]uint64, 2)
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			offs[i], errs[i] = log.AppendIfMatch(&api.Record{Value: []byte("hello world")}, 0)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	winner, loser := 0, 1
+	if errs[0] != nil {
+		winner, loser = 1, 0
+	}
+	require.NoError(t, errs[winner])
+	require.Equal(t, uint64(1), offs[winner])
+	require.Equal(t, api.ErrHighestMismatch{Expected: 0, Actual: 1}, errs[loser])
+	require.Equal(t, codes.Aborted, status.Code(errs[loser]))
+	require.Equal(t, uint64(2), log.NextOffset())
+
+	// 実際の最大のオフセットを期待し直せば追加できる
+	off, err := log.AppendIfMatch(record, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+func TestLogTruncatePreview(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+
+	preview, err := log.TruncatePreview(3)
+	require.NoError(t, err)
+	require.Len(t, preview, 2)
+	for i, info := range preview {
+		base := uint64(i) * 2
+		require.Equal(t, base, info.BaseOffset)
+		require.Equal(t, base+2, info.NextOffset)
+		require.Equal(t, filepath.Join(dir, fmt.Sprintf("%d.store", base)), info.StorePath)
+		require.Equal(t, filepath.Join(dir, fmt.Sprintf("%d.index", base)), info.IndexPath)
+		require.NotZero(t, info.Bytes)
+	}
+
+	// プレビューでは何も削除しない
+	require.Len(t, log.segments, 4)
+	for _, info := range preview {
+		_, err = os.Stat(info.StorePath)
+		require.NoError(t, err)
+	}
+
+	// 実際に削除されるのはプレビューしたセグメントだけ
+	require.NoError(t, log.Truncate(3))
+	for _, info := range preview {
+		_, err = os.Stat(info.StorePath)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(info.IndexPath)
+		require.True(t, os.IsNotExist(err))
+	}
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(4), log.segments[0].baseOffset)
+
+	// アクティブセグメントは削除しないので、プレビューにも含まれない
+	preview, err = log.TruncatePreview(100)
+	require.NoError(t, err)
+	require.Len(t, preview, 1)
+	require.Equal(t, uint64(4), preview[0].BaseOffset)
+}
+func benchmarkLog(b *testing.B) *Log {
+	b.Helper()
+	dir := b.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	b.Cleanup(func() { log.Close() })
+	for i := 0; i < 1000; i++ {
+		_, err = log.Append(&api.Record{Value: bytes.Repeat([]byte("a"), 256)})
+		require.NoError(b, err)
+	}
+	return log
+}
+func BenchmarkLogRead(b *testing.B) {
+	log := benchmarkLog(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := log.Read(uint64(i % 1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+func BenchmarkLogReadInto(b *testing.B) {
+	log := benchmarkLog(b)
+	rec := &api.Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := log.ReadInto(uint64(i%1000), rec); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
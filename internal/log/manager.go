@@ -0,0 +1,136 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// LogManager トピック名ごとのログをルートディレクトリ配下で管理する
+type LogManager struct {
+	mu     sync.Mutex
+	Dir    string
+	Config Config
+	// MaxTopics 新しく作成できるトピックの数の上限。トピックはメトリクスのラベルになるので、その数を抑えるために使う。
+	// 起動時にディスクにあるトピックは上限を超えていても開く。0の場合は制限しない
+	MaxTopics int
+	logs      map[string]*Log
+}
+
+// NewLogManager ルートディレクトリ配下に存在するトピックのログを開いてLogManagerを作成する
+func NewLogManager(dir string, c Config) (*LogManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	m := &LogManager{
+		Dir:    dir,
+		Config: c,
+		logs:   make(map[string]*Log),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// Resetなどの作業用のディレクトリは隠しディレクトリなので、トピックとして開かない
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		l, err := NewLog(filepath.Join(dir, entry.Name()), m.topicConfig(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m.logs[entry.Name()] = l
+	}
+
+	return m, nil
+}
+
+// Get トピックのログを返す。存在しない場合は新しく作成する。MaxTopicsに達している場合はErrTooManyTopicsを返す
+func (m *LogManager) Get(topic string) (*Log, error) {
+	if !ValidTopic(topic) {
+		return nil, api.ErrInvalidTopic{Topic: topic}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.logs[topic]; ok {
+		return l, nil
+	}
+	if m.MaxTopics > 0 && len(m.logs) >= m.MaxTopics {
+		return nil, api.ErrTooManyTopics{Topic: topic, Max: m.MaxTopics}
+	}
+
+	dir := filepath.Join(m.Dir, topic)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l, err := NewLog(dir, m.topicConfig(topic))
+	if err != nil {
+		return nil, err
+	}
+	m.logs[topic] = l
+
+	return l, nil
+}
+
+// topicConfig topicのログの設定を返す
+func (m *LogManager) topicConfig(topic string) Config {
+	c := m.Config
+	c.Topic = topic
+	return c
+}
+
+// Topics 管理しているトピック名をソートして返す
+func (m *LogManager) Topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	topics := make([]string, 0, len(m.logs))
+	for topic := range m.logs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+// Close すべてのトピックのログを閉じる
+func (m *LogManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range m.logs {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove すべてのトピックのログを閉じ、ルートディレクトリごと削除する
+func (m *LogManager) Remove() error {
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(m.Dir)
+}
+
+// ValidTopic トピック名がディレクトリ名として安全に使えるかを判定する。
+// "."で始まる名前は作業用のディレクトリと衝突するので使えない
+func ValidTopic(topic string) bool {
+	if topic == "" || strings.HasPrefix(topic, ".") {
+		return false
+	}
+
+	return !strings.ContainsAny(topic, `/\`)
+}
@@ -0,0 +1,84 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+func TestLogManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+
+	// トピックは初めて参照されたときに作成される
+	a, err := m.Get("a")
+	require.NoError(t, err)
+	_, err = a.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = m.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, m.Topics())
+
+	_, err = m.Get("../a")
+	require.Equal(t, api.ErrInvalidTopic{Topic: "../a"}, err)
+	_, err = m.Get(".a.reset-old")
+	require.Equal(t, api.ErrInvalidTopic{Topic: ".a.reset-old"}, err)
+	require.NoError(t, m.Close())
+
+	// 中断したResetや詰め直しの作業用のディレクトリが残っていても、トピックとしては開かない
+	_, oldDir := resetDirs(filepath.Join(dir, "a"))
+	require.NoError(t, os.Mkdir(oldDir, 0700))
+	_, compactOld := compactDirs(filepath.Join(dir, "b"))
+	require.NoError(t, os.Mkdir(compactOld, 0700))
+
+	// 既存のトピックはディスクから復元される
+	m, err = NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, m.Topics())
+	for _, d := range []string{oldDir, compactOld} {
+		_, err = os.Stat(d)
+		require.True(t, os.IsNotExist(err), d)
+	}
+	a, err = m.Get("a")
+	require.NoError(t, err)
+	read, err := a.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.NoError(t, m.Remove())
+}
+
+// MaxTopicsに達すると新しいトピックは作成できないが、既存のトピックは使えるか
+func TestLogManagerMaxTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manager-max-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	m.MaxTopics = 2
+	for _, topic := range []string{"a", "b", "a"} {
+		l, err := m.Get(topic)
+		require.NoError(t, err)
+		require.Equal(t, topic, l.Config.Topic)
+	}
+	_, err = m.Get("c")
+	require.Equal(t, api.ErrTooManyTopics{Topic: "c", Max: 2}, err)
+	require.Equal(t, []string{"a", "b"}, m.Topics())
+	require.NoError(t, m.Close())
+
+	// 開き直したトピックにもトピック名が設定される
+	m, err = NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+	b, err := m.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, "b", b.Config.Topic)
+}
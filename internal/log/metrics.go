@@ -0,0 +1,81 @@
+package log
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// セグメントが切り替わった原因
+const (
+	rolloverStore   = "store_size"
+	rolloverIndex   = "index_size"
+	rolloverRecords = "record_count"
+	rolloverSealed  = "sealed"
+	rolloverAligned = "aligned"
+)
+
+// セグメントが削除された理由
+const (
+	removeTruncate = "truncate"
+)
+
+// Metrics ログの書き込みの増幅や保持期間の挙動を把握するためのメトリクス。
+// 複数のログで共有できるので、LogManager配下のログには同じMetricsを設定する。各メトリクスはConfig.Topicをラベルに持つ
+type Metrics struct {
+	rollovers       *prometheus.CounterVec
+	removedSegments *prometheus.CounterVec
+	recordSizes     *prometheus.HistogramVec
+}
+
+// NewMetrics メトリクスを作成してregに登録する
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		rollovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Name:      "segment_rollovers_total",
+			Help:      "Number of times the active segment was rolled, by cause and topic.",
+		}, []string{"cause", "topic"}),
+		removedSegments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Name:      "segments_removed_total",
+			Help:      "Number of segments removed from the log, by reason and topic.",
+		}, []string{"reason", "topic"}),
+		// INFO: 小さなレコードから1つのセグメントを占めるような大きなレコードまで区別できるよう、64Bから1MiBまで4倍ずつに区切る
+		recordSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "proglog",
+			Name:      "record_size_bytes",
+			Help:      "Size of appended records after serialization, in bytes, by topic.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"topic"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.rollovers, m.removedSegments, m.recordSizes} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// INFO: Metricsが設定されていないログでも呼び出せるよう、nilの場合は何もしない
+
+func (m *Metrics) rollover(topic, cause string) {
+	if m == nil {
+		return
+	}
+	m.rollovers.WithLabelValues(cause, topic).Inc()
+}
+
+func (m *Metrics) removeSegments(topic, reason string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.removedSegments.WithLabelValues(reason, topic).Add(float64(n))
+}
+
+func (m *Metrics) recordSize(topic string, n uint64) {
+	if m == nil {
+		return
+	}
+	m.recordSizes.WithLabelValues(topic).Observe(float64(n))
+}
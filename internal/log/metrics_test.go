@@ -0,0 +1,95 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// セグメントの切り替えの原因ごと、および切り詰めで削除したセグメントの数が記録されるか
+func TestLogMetrics(t *testing.T) {
+	for cause, configure := range map[string]func(c *Config){
+		rolloverStore: func(c *Config) {
+			c.Segment.MaxStoreBytes = 32
+		},
+		rolloverIndex: func(c *Config) {
+			c.Segment.MaxIndexBytes = entWidth * 2
+		},
+		rolloverRecords: func(c *Config) {
+			c.Segment.MaxRecords = 2
+		},
+	} {
+		t.Run(cause, func(t *testing.T) {
+			m, err := NewMetrics(prometheus.NewRegistry())
+			require.NoError(t, err)
+			c := Config{Metrics: m}
+			configure(&c)
+			log := newTestLog(t, c)
+
+			// 2件ごとにセグメントが切り替わる
+			ap := &api.Record{Value: []byte("hello world")}
+			for i := 0; i < 5; i++ {
+				_, err = log.Append(ap)
+				require.NoError(t, err)
+			}
+			for _, other := range []string{rolloverStore, rolloverIndex, rolloverRecords} {
+				want := 0.0
+				if other == cause {
+					want = 2
+				}
+				require.Equal(t, want, testutil.ToFloat64(m.rollovers.WithLabelValues(other, "")))
+			}
+
+			require.NoError(t, log.Truncate(3))
+			require.Equal(t, 2.0, testutil.ToFloat64(m.removedSegments.WithLabelValues(removeTruncate, "")))
+		})
+	}
+}
+func TestLogRecordSizeMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics, err := NewMetrics(reg)
+	require.NoError(t, err)
+	c := Config{Metrics: metrics}
+	c.Segment.MaxStoreBytes = 1 << 20
+	log := newTestLog(t, c)
+
+	var total uint64
+	for _, n := range []int{10, 10, 10, 200, 5000} {
+		_, loc, err := log.AppendWithLocation(&api.Record{Value: make([]byte, n)})
+		require.NoError(t, err)
+		total += loc.Length
+	}
+	// 値をストリームで追加したレコードも数える
+	_, err = log.AppendReader(bytes.NewReader(make([]byte, 100000)), 100000)
+	require.NoError(t, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var h *dto.Histogram
+	for _, f := range families {
+		if f.GetName() == "proglog_record_size_bytes" {
+			h = f.GetMetric()[0].GetHistogram()
+		}
+	}
+	require.NotNil(t, h)
+	require.Equal(t, uint64(6), h.GetSampleCount())
+	require.Greater(t, h.GetSampleSum(), float64(total+100000))
+
+	// 上限ごとの累積の件数
+	counts := make(map[float64]uint64)
+	for _, b := range h.GetBucket() {
+		counts[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	require.Equal(t, uint64(3), counts[64])
+	require.Equal(t, uint64(4), counts[256])
+	require.Equal(t, uint64(4), counts[4096])
+	require.Equal(t, uint64(5), counts[16384])
+	require.Equal(t, uint64(5), counts[65536])
+	require.Equal(t, uint64(6), counts[262144])
+}
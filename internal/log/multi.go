@@ -0,0 +1,93 @@
+package log
+
+import (
+	"container/heap"
+	"io"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// MultiRecord MultiRecordReaderが返すレコードと、その読み出し元のログ
+type MultiRecord struct {
+	Record *api.Record
+	// Log 読み出し元のログの、MultiLogReaderに渡したスライス内でのインデックス
+	Log int
+}
+
+// MultiRecordReader 複数のログのレコードをタイムスタンプ順にマージして読み出す
+type MultiRecordReader struct {
+	its    []*RecordIterator
+	heap   multiHeap
+	primed bool
+}
+
+// MultiLogReader logsのレコードをタイムスタンプ順にk-wayマージするリーダーを返す。
+// 各ログのレコードはタイムスタンプ順に追加されていることを前提とする。
+// タイムスタンプが同じ場合は、logsのインデックスが小さいログのレコードを先に返す
+func MultiLogReader(logs []*Log) *MultiRecordReader {
+	its := make([]*RecordIterator, len(logs))
+	for i, l := range logs {
+		its[i] = l.Iterator()
+	}
+	return &MultiRecordReader{its: its}
+}
+
+// Next 次に古いレコードを返す。すべてのログの末尾に達した場合はio.EOFを返す
+func (r *MultiRecordReader) Next() (*MultiRecord, error) {
+	// 最初の呼び出しで、各ログの先頭のレコードをヒープに積む
+	if !r.primed {
+		for i := range r.its {
+			if err := r.push(i); err != nil {
+				return nil, err
+			}
+		}
+		r.primed = true
+	}
+
+	if r.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	next := heap.Pop(&r.heap).(*MultiRecord)
+	if err := r.push(next.Log); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// push i番目のログから次のレコードを読み出してヒープに積む
+func (r *MultiRecordReader) push(i int) error {
+	record, err := r.its[i].Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	heap.Push(&r.heap, &MultiRecord{Record: record, Log: i})
+	return nil
+}
+
+type multiHeap []*MultiRecord
+
+func (h multiHeap) Len() int { return len(h) }
+
+func (h multiHeap) Less(i, j int) bool {
+	if h[i].Record.Timestamp != h[j].Record.Timestamp {
+		return h[i].Record.Timestamp < h[j].Record.Timestamp
+	}
+	return h[i].Log < h[j].Log
+}
+
+func (h multiHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *multiHeap) Push(x any) { *h = append(*h, x.(*MultiRecord)) }
+
+func (h *multiHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+func TestMultiLogReader(t *testing.T) {
+	var logs []*Log
+	for _, timestamps := range [][]int64{
+		{10, 30, 50, 60},
+		{20, 30, 40},
+	} {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 32
+		l := newTestLog(t, c)
+
+		for _, ts := range timestamps {
+			_, err := l.Append(&api.Record{
+				Value:     []byte("hello world"),
+				Timestamp: ts,
+			})
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+
+	// タイムスタンプ順に並び、同じ時刻の場合はスライスの前のログが先に来る
+	want := []struct {
+		log       int
+		timestamp int64
+		offset    uint64
+	}{
+		{0, 10, 0},
+		{1, 20, 0},
+		{0, 30, 1},
+		{1, 30, 1},
+		{1, 40, 2},
+		{0, 50, 2},
+		{0, 60, 3},
+	}
+
+	r := MultiLogReader(logs)
+	for _, w := range want {
+		got, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, w.log, got.Log)
+		require.Equal(t, w.timestamp, got.Record.Timestamp)
+		require.Equal(t, w.offset, got.Record.Offset)
+	}
+	_, err := r.Next()
+	require.Equal(t, io.EOF, err)
+}
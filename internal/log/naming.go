@@ -0,0 +1,57 @@
+package log
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Naming セグメントのストアファイルとインデックスファイルの名前の付け方
+type Naming interface {
+	// StorePath dirにあるbaseOffsetのセグメントのストアファイルのパスを返す
+	StorePath(dir string, baseOffset uint64) string
+	// IndexPath dirにあるbaseOffsetのセグメントのインデックスファイルのパスを返す
+	IndexPath(dir string, baseOffset uint64) string
+	// Parse ファイル名がストアファイルかインデックスファイルのものであれば、そのセグメントのベースオフセットを返す
+	Parse(name string) (baseOffset uint64, ok bool)
+}
+
+// ExtNaming ベースオフセットに拡張子を付けたファイル名を使うNaming
+type ExtNaming struct {
+	StoreExt string
+	IndexExt string
+}
+
+// defaultNaming Config.Namingが指定されていない場合に使う、<ベースオフセット>.storeと<ベースオフセット>.indexの名前
+var defaultNaming = ExtNaming{StoreExt: ".store", IndexExt: ".index"}
+
+var _ Naming = ExtNaming{}
+
+func (n ExtNaming) StorePath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, n.StoreExt))
+}
+
+func (n ExtNaming) IndexPath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, n.IndexExt))
+}
+
+func (n ExtNaming) Parse(name string) (uint64, bool) {
+	ext := filepath.Ext(name)
+	if ext != n.StoreExt && ext != n.IndexExt {
+		return 0, false
+	}
+	off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return off, true
+}
+
+// naming セグメントのファイル名の付け方を返す。Namingが指定されていない場合は既定の名前を使う
+func (c Config) naming() Naming {
+	if c.Naming != nil {
+		return c.Naming
+	}
+	return defaultNaming
+}
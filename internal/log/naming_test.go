@@ -0,0 +1,57 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// paddedNaming ベースオフセットを20桁にそろえ、.logと.idxの拡張子を使うNaming
+type paddedNaming struct{}
+
+// Namingで指定した名前でセグメントを作成し、開き直しても同じレコードを読み出せるか
+func TestLogNaming(t *testing.T) {
+	c := Config{Naming: paddedNaming{}}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	want := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{
+		lockFileName,
+		"00000000000000000000.idx", "00000000000000000000.log",
+		"00000000000000000002.idx", "00000000000000000002.log",
+		"00000000000000000004.idx", "00000000000000000004.log",
+	}, names)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(5), log.NextOffset())
+	for off := uint64(0); off < 5; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+
+	// 拡張子だけを変える場合はExtNamingを使える
+	require.Equal(t, filepath.Join(dir, "3.log"), ExtNaming{StoreExt: ".log", IndexExt: ".idx"}.StorePath(dir, 3))
+	off, ok := ExtNaming{StoreExt: ".log", IndexExt: ".idx"}.Parse("3.idx")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), off)
+}
@@ -0,0 +1,173 @@
+package log
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// readBufs ReadIntoでストアから読み込むレコードのバイト列のバッファ
+var readBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// ReadInto offのレコードを、呼び出し側が用意したrecに読み出す。recの内容は読み出す前に消去する。
+// 値とキーはrecが持っているスライスの領域を再利用して書き込むので、recを使い回す場合、
+// 以前に読み出した値やキーを保持し続けるときはコピーしておくこと
+func (l *Log) ReadInto(off uint64, rec *api.Record) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return err
+	}
+	if err = s.readInto(off, rec); err != nil {
+		return err
+	}
+	if expired(rec) {
+		return api.ErrRecordExpired{Offset: rec.Offset}
+	}
+	return nil
+}
+
+func (s *segment) readInto(off uint64, rec *api.Record) error {
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+
+	bp := readBufs.Get().(*[]byte)
+	defer readBufs.Put(bp)
+	if *bp, err = s.store.readAppend(pos, (*bp)[:0]); err != nil {
+		return err
+	}
+
+	if err = unmarshalRecordInto(*bp, rec); err != nil {
+		return err
+	}
+	if err = decodeValue(rec); err != nil {
+		return err
+	}
+	// 重複排除したレコードは複数のオフセットで共有されているので、読み出したオフセットを設定する
+	rec.Offset = off
+	return nil
+}
+
+// readAppend posのレコードをbufの末尾に読み込んで返す。Readと異なり、bufの容量が足りる場合は新しい領域を割り当てない
+func (s *store) readAppend(pos uint64, buf []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return buf, err
+	}
+
+	start := len(buf)
+	buf = grow(buf, lenWidth)
+	if _, err := s.File.ReadAt(buf[start:], int64(pos)); err != nil {
+		return buf[:start], err
+	}
+	n := enc.Uint64(buf[start:])
+	buf = grow(buf[:start], n)
+	if _, err := s.File.ReadAt(buf[start:], int64(pos+lenWidth)); err != nil {
+		return buf[:start], err
+	}
+	return buf, nil
+}
+
+// grow bufの長さをnバイト伸ばす。容量が足りない場合のみ新しい領域に移す
+func grow(buf []byte, n uint64) []byte {
+	l := uint64(len(buf))
+	if uint64(cap(buf))-l < n {
+		b := make([]byte, l, l+n)
+		copy(b, buf)
+		buf = b
+	}
+	return buf[:l+n]
+}
+
+// unmarshalRecordInto bをrecに復号する。proto.Unmarshalと異なり、値とキーはrecのスライスの領域を再利用する。
+// INFO: Recordにフィールドを追加した場合は、ここにも追加すること。知らないフィールドは読み飛ばす
+func unmarshalRecordInto(b []byte, rec *api.Record) error {
+	value, key := rec.Value[:0], rec.Key[:0]
+	rec.Reset()
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.BytesType && (num == 1 || num == 5):
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if num == 1 {
+				value = append(value[:0], v...)
+				rec.Value = value
+			} else {
+				key = append(key[:0], v...)
+				rec.Key = key
+			}
+			n = m
+		case typ == protowire.VarintType && num >= 2 && num <= 10 && num != 5:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			switch num {
+			case 2:
+				rec.Offset = v
+			case 3:
+				rec.SchemaVersion = uint32(v)
+			case 4:
+				rec.Timestamp = int64(v)
+			case 6:
+				rec.Compacted = protowire.DecodeBool(v)
+			case 7:
+				rec.Codec = api.Codec(int32(v))
+			case 8:
+				rec.Ttl = int64(v)
+			case 9:
+				rec.BatchEnd = v
+			case 10:
+				rec.Compressed = protowire.DecodeBool(v)
+			}
+			n = m
+		case typ == protowire.BytesType && num == 12:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			rec.Id = string(v)
+			n = m
+		case typ == protowire.BytesType && num == 11:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			rec.DeadLetter = &api.DeadLetter{}
+			if err := proto.Unmarshal(v, rec.DeadLetter); err != nil {
+				return err
+			}
+			n = m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
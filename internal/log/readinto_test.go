@@ -0,0 +1,46 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// ReadIntoで使い回すレコードに、Readと同じ内容を読み出せるか
+func TestLogReadInto(t *testing.T) {
+	log := newTestLog(t, Config{})
+
+	records := []*api.Record{
+		{Value: []byte("hello world"), Key: []byte("greeting"), SchemaVersion: 2, Timestamp: 1234},
+		{Value: []byte("short")},
+		{Value: bytes.Repeat([]byte("compressed "), 10), Codec: api.Codec_CODEC_GZIP},
+		{Key: []byte("greeting"), Compacted: true},
+		{Value: []byte("identified"), Id: "2b0c7a8e-9f3d-4c61-8a2e-5d4f6b7c8d9e"},
+		{Value: []byte("failed"), DeadLetter: &api.DeadLetter{SourceTopic: "orders", SourceOffset: 3, Error: "boom"}},
+	}
+	for _, record := range records {
+		_, err := log.Append(proto.Clone(record).(*api.Record))
+		require.NoError(t, err)
+	}
+
+	rec := &api.Record{}
+	for off := range records {
+		want, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.NoError(t, log.ReadInto(uint64(off), rec))
+		require.True(t, proto.Equal(want, rec), "offset %d: want %v, got %v", off, want, rec)
+	}
+
+	// 容量が足りる場合は、値の領域を再利用する
+	require.NoError(t, log.ReadInto(0, rec))
+	value := &rec.Value[0]
+	require.NoError(t, log.ReadInto(1, rec))
+	require.Equal(t, []byte("short"), rec.Value)
+	require.Same(t, value, &rec.Value[0])
+
+	require.ErrorAs(t, log.ReadInto(uint64(len(records)), rec), &api.ErrOffsetOutOfRange{})
+}
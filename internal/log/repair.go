@@ -0,0 +1,229 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// Report VerifyAndRepairで検査し、修復した内容
+type Report struct {
+	// Segments 検査したセグメントのベースオフセット
+	Segments []uint64
+	// Repaired インデックスのエントリが欠けているか壊れていたため、ストアから作り直したオフセット
+	Repaired []uint64
+	// Dropped ストアのレコードが途中までしか書き込まれていないか壊れていたため、取り除いたオフセット
+	Dropped []uint64
+	// TruncatedBytes ストアの末尾から取り除いたバイト数
+	TruncatedBytes uint64
+}
+
+// VerifyAndRepair 閉じているログのすべてのセグメントについて、ストアのレコードとインデックスの整合性を検査し、修復できるものは修復する。
+// ストアの末尾の壊れたレコードは切り詰め、インデックスはストアに残ったレコードから作り直す。
+// 修復したセグメントのシールファイルは、チェックサムが合わなくなるので削除する。
+// 最後にログを開いてすべてのレコードを読み出せることを確認し、修復した内容を返す
+func VerifyAndRepair(dir string, c Config) (Report, error) {
+	var report Report
+	files, err := c.fs().ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+	for _, file := range files {
+		// ストアファイルのあるセグメントだけを検査する
+		off, ok := c.naming().Parse(file.Name())
+		if !ok || file.Name() != filepath.Base(c.naming().StorePath(dir, off)) {
+			continue
+		}
+		report.Segments = append(report.Segments, off)
+	}
+	sort.Slice(report.Segments, func(i, j int) bool {
+		return report.Segments[i] < report.Segments[j]
+	})
+
+	for _, base := range report.Segments {
+		if err = repairSegment(dir, base, c, &report); err != nil {
+			return report, fmt.Errorf("repair segment %d: %w", base, err)
+		}
+	}
+
+	// 修復したログを開き、すべてのレコードを読み出せるか確認する
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return report, err
+	}
+	for _, r := range l.PresentRanges() {
+		for off := r.From; off < r.To; off++ {
+			if _, err = l.Read(off); err != nil {
+				_ = l.Close()
+				return report, fmt.Errorf("verify offset %d: %w", off, err)
+			}
+		}
+	}
+	return report, l.Close()
+}
+
+// repairSegment ストアを先頭から読み、壊れたレコード以降を切り詰め、インデックスが残ったレコードと一致しない場合は作り直す
+func repairSegment(dir string, base uint64, c Config, report *Report) error {
+	storeFile, err := c.fs().OpenFile(c.naming().StorePath(dir, base), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	indexFile, err := c.fs().OpenFile(c.naming().IndexPath(dir, base), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	entries, partial, err := readIndexEntries(indexFile)
+	if err != nil {
+		return err
+	}
+
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	positions, end, err := scanStore(storeFile, size, entries)
+	if err != nil {
+		return err
+	}
+
+	// 重複排除したセグメントでは複数のエントリが同じレコードを指すので、レコードの並びからインデックスを作り直せない。
+	// ストアに残ったレコードを指すエントリまでを残す
+	var rebuilt []indexEntry
+	repaired := false
+	if c.Segment.Dedup {
+		valid := make(map[uint64]bool, len(positions))
+		for _, pos := range positions {
+			valid[pos] = true
+		}
+		for i, e := range entries {
+			if e.off != uint32(i) || !valid[e.pos] {
+				break
+			}
+			rebuilt = append(rebuilt, e)
+		}
+	} else {
+		for i, pos := range positions {
+			if i >= len(entries) || entries[i] != (indexEntry{uint32(i), pos}) {
+				report.Repaired = append(report.Repaired, base+uint64(i))
+				repaired = true
+			}
+			rebuilt = append(rebuilt, indexEntry{uint32(i), pos})
+		}
+	}
+	for i := len(rebuilt); i < len(entries); i++ {
+		// INFO: 正しく閉じられなかったインデックスの末尾は0で埋まっているので、取り除いたレコードとして数えない
+		if i > 0 && entries[i] == (indexEntry{}) {
+			continue
+		}
+		report.Dropped = append(report.Dropped, base+uint64(i))
+	}
+
+	changed := false
+	if end < size {
+		if err = storeFile.Truncate(int64(end)); err != nil {
+			return err
+		}
+		report.TruncatedBytes += size - end
+		changed = true
+	}
+	if partial || repaired || len(rebuilt) != len(entries) {
+		if err = writeIndexEntries(indexFile, rebuilt); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	if err = storeFile.Sync(); err != nil {
+		return err
+	}
+	if err = indexFile.Sync(); err != nil {
+		return err
+	}
+	if err = c.fs().Remove(sealPath(dir, base)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// indexEntry インデックスの1つのエントリ
+type indexEntry struct {
+	off uint32
+	pos uint64
+}
+
+// readIndexEntries インデックスファイルのエントリをすべて読み出す。エントリの幅に満たない末尾がある場合はpartialをtrueにする
+func readIndexEntries(f File) (entries []indexEntry, partial bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, fi.Size())
+	if _, err = f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	for i := uint64(0); i+entWidth <= uint64(len(b)); i += entWidth {
+		entries = append(entries, indexEntry{
+			off: enc.Uint32(b[i : i+offWidth]),
+			pos: enc.Uint64(b[i+offWidth : i+entWidth]),
+		})
+	}
+	return entries, uint64(len(b))%entWidth != 0, nil
+}
+
+// writeIndexEntries インデックスファイルをentriesの内容で置き換える
+func writeIndexEntries(f File, entries []indexEntry) error {
+	b := make([]byte, uint64(len(entries))*entWidth)
+	for i, e := range entries {
+		enc.PutUint32(b[uint64(i)*entWidth:], e.off)
+		enc.PutUint64(b[uint64(i)*entWidth+offWidth:], e.pos)
+	}
+	if err := f.Truncate(int64(len(b))); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(b, 0)
+	return err
+}
+
+// scanStore ストアを先頭から読み、完全に書き込まれていてレコードとして読み出せるものの位置と、その末尾の位置を返す。
+// INFO: 事前に確保した領域は0で埋まっており長さ0のレコードに見えるので、長さ0のレコードはインデックスが指している場合のみ数える
+func scanStore(f File, size uint64, entries []indexEntry) (positions []uint64, end uint64, err error) {
+	lenBuf := make([]byte, lenWidth)
+	for end+lenWidth <= size {
+		if _, err = f.ReadAt(lenBuf, int64(end)); err != nil {
+			return nil, 0, err
+		}
+		n := enc.Uint64(lenBuf)
+		if n > size-end-lenWidth {
+			break
+		}
+		if n == 0 {
+			i := len(positions)
+			if i >= len(entries) || entries[i] != (indexEntry{uint32(i), end}) {
+				break
+			}
+		}
+		p := make([]byte, n)
+		if _, err = f.ReadAt(p, int64(end+lenWidth)); err != nil {
+			return nil, 0, err
+		}
+		if err = proto.Unmarshal(p, &api.Record{}); err != nil {
+			break
+		}
+		positions = append(positions, end)
+		end += lenWidth + n
+	}
+	return positions, end, nil
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// VerifyAndRepairで、壊れたインデックスのエントリと途中まで書き込まれた末尾のレコードが修復されるか
+func TestVerifyAndRepair(t *testing.T) {
+	// 1つのセグメントに2件ずつ、[0, 5)のレコードを書き込む
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+	dir := log.Dir
+	want := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// オフセット3のインデックスのエントリが指す位置を壊す
+	index, err := os.OpenFile(filepath.Join(dir, "2.index"), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	pos := make([]byte, posWidth)
+	enc.PutUint64(pos, 999)
+	_, err = index.WriteAt(pos, int64(entWidth+offWidth))
+	require.NoError(t, err)
+	require.NoError(t, index.Close())
+
+	// オフセット4のレコードを途中まで書き込まれた状態にする
+	storePath := filepath.Join(dir, "4.store")
+	fi, err := os.Stat(storePath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(storePath, fi.Size()-3))
+
+	report, err := VerifyAndRepair(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2, 4}, report.Segments)
+	require.Equal(t, []uint64{3}, report.Repaired)
+	require.Equal(t, []uint64{4}, report.Dropped)
+	require.Equal(t, uint64(fi.Size()-3), report.TruncatedBytes)
+
+	// 修復したログは読み出せ、取り除いたオフセットから書き込みを続けられる
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 4; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+	off, err := log.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, log.Close())
+
+	// 修復済みのログでは何も変更しない
+	report, err = VerifyAndRepair(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, report.Repaired)
+	require.Empty(t, report.Dropped)
+	require.Zero(t, report.TruncatedBytes)
+}
@@ -0,0 +1,161 @@
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// RawSegment WalkSealedSegmentsで渡される、書き込みの終わったセグメントのファイルの内容
+type RawSegment interface {
+	BaseOffset() uint64
+	// NextOffset セグメントの最後のレコードの次のオフセットを返す
+	NextOffset() uint64
+	// Store ストアファイルのうち、レコードを書き込んだ範囲を読み出すリーダーを返す
+	Store() io.Reader
+	// Index インデックスファイルのうち、エントリを書き込んだ範囲を読み出すリーダーを返す
+	Index() io.Reader
+}
+
+// rawSegmentFiles WalkSealedSegmentsを呼び出した時点のセグメントのファイルと、書き込み済みの大きさ
+type rawSegmentFiles struct {
+	segmentFiles
+	storeSize, indexSize uint64
+}
+
+// WalkSealedSegments ベースオフセットがfrom以上で書き込みの終わったセグメントについて、ファイルの内容をオフセット順にfnに渡す。
+// アクティブセグメントは書き込み中なので渡さない。レプリカはWriteSegmentで受け取った内容を書き込み、NewLogで開ける。
+// fnがエラーを返した場合は、そのエラーを返して終了する
+func (l *Log) WalkSealedSegments(from uint64, fn func(RawSegment) error) error {
+	// INFO: WalkSegmentsと同様に、ロックを獲得している間に対象のセグメントを決めて書き出しておき、ファイルはロックの外で開く
+	l.mu.RLock()
+	if err := l.flushSegments(); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	var segments []rawSegmentFiles
+	for _, s := range l.segments {
+		if s.baseOffset < from || s == l.activeSegment {
+			continue
+		}
+		segments = append(segments, rawSegmentFiles{
+			segmentFiles: segmentFiles{
+				baseOffset: s.baseOffset,
+				nextOffset: s.nextOffset,
+				storePath:  s.store.Name(),
+				indexPath:  s.index.Name(),
+			},
+			storeSize: s.store.size,
+			indexSize: s.index.size,
+		})
+	}
+	fsys := l.Config.fs()
+	l.mu.RUnlock()
+
+	for _, s := range segments {
+		if err := walkRawSegment(fsys, s, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkRawSegment セグメントのファイルを開いてfnに渡し、fnが返ったら閉じる
+func walkRawSegment(fsys FS, s rawSegmentFiles, fn func(RawSegment) error) error {
+	store, err := fsys.OpenFile(s.storePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	index, err := fsys.OpenFile(s.indexPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	// INFO: 事前に確保したストアや、閉じる前のインデックスはファイルの方が大きいので、書き込み済みの範囲に限る
+	return fn(&rawSegment{
+		files: s,
+		store: io.NewSectionReader(store, 0, int64(s.storeSize)),
+		index: io.NewSectionReader(index, 0, int64(s.indexSize)),
+	})
+}
+
+type rawSegment struct {
+	files        rawSegmentFiles
+	store, index io.Reader
+}
+
+func (r *rawSegment) BaseOffset() uint64 {
+	return r.files.baseOffset
+}
+
+func (r *rawSegment) NextOffset() uint64 {
+	return r.files.nextOffset
+}
+
+func (r *rawSegment) Store() io.Reader {
+	return r.store
+}
+
+func (r *rawSegment) Index() io.Reader {
+	return r.index
+}
+
+// SegmentWriter WalkSealedSegmentsで読み出したセグメントのファイルを、別のログのディレクトリに書き込む
+type SegmentWriter struct {
+	fs           FS
+	store, index File
+}
+
+// NewSegmentWriter dirにベースオフセットがbaseOffsetのセグメントのファイルを作成する。既にある場合は空にして書き直す。
+// ファイル名はcのNamingに従うので、書き込んだ後にdirを同じ設定のNewLogで開く
+func NewSegmentWriter(dir string, c Config, baseOffset uint64) (*SegmentWriter, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	store, err := c.fs().OpenFile(c.naming().StorePath(dir, baseOffset), flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	index, err := c.fs().OpenFile(c.naming().IndexPath(dir, baseOffset), flag, 0600)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &SegmentWriter{fs: c.fs(), store: store, index: index}, nil
+}
+
+// WriteStore ストアファイルの続きにpを書き込む
+func (w *SegmentWriter) WriteStore(p []byte) error {
+	_, err := w.store.Write(p)
+	return fsError(err)
+}
+
+// WriteIndex インデックスファイルの続きにpを書き込む
+func (w *SegmentWriter) WriteIndex(p []byte) error {
+	_, err := w.index.Write(p)
+	return fsError(err)
+}
+
+// Close 書き込んだ内容を安定したストレージに同期してから、ファイルを閉じる
+func (w *SegmentWriter) Close() error {
+	var first error
+	for _, f := range []File{w.store, w.index} {
+		if err := f.Sync(); err != nil && first == nil {
+			first = fsError(err)
+		}
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Remove 書き込み途中のファイルを閉じて削除する。受け取りが途中で終わったセグメントを残さないために使う
+func (w *SegmentWriter) Remove() error {
+	for _, f := range []File{w.store, w.index} {
+		_ = f.Close()
+		if err := w.fs.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// resetRename Resetでディレクトリを入れ替えるリネーム。テストで失敗を注入するために変数にしている
+var resetRename = os.Rename
+
+// resetDirs Resetで使う、新しいログを作成するディレクトリと、元のログを退避するディレクトリを返す。
+// INFO: 中断したResetを開き直すときに見つけられるよう、名前はログのディレクトリから決める
+func resetDirs(dir string) (newDir, oldDir string) {
+	return workDir(dir, ".reset-new"), workDir(dir, ".reset-old")
+}
+
+// workDir ログのディレクトリと同じ親ディレクトリに作成する、作業用のディレクトリの名前を返す。
+// LogManagerがトピックとして開かないよう、"."で始まる隠しディレクトリにする
+func workDir(dir, suffix string) string {
+	dir = filepath.Clean(dir)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+suffix)
+}
+
+// Reset データをすべて削除し、新しいログを作成する。
+// 新しいログを隣のディレクトリに作成してからリネームで入れ替えるので、途中でクラッシュしても元のログか新しいログのどちらかが残る。
+// リネームが使えないOS以外のファイルシステムでは、ディレクトリを削除してから作り直す
+func (l *Log) Reset() error {
+	if err := l.writable(); err != nil {
+		return err
+	}
+	if l.Config.FS != nil {
+		if err := l.Remove(); err != nil {
+			return err
+		}
+		l.resumeBackground()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.retainedFrom = 0
+		if err := l.reopen(nil); err != nil {
+			return err
+		}
+		l.notifyRemoved(^uint64(0))
+		return nil
+	}
+
+	newDir, oldDir := resetDirs(l.Dir)
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(newDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(newDir)
+
+	// 新しいログのセグメントを作成し、閉じてディスクに書き出しておく
+	c := l.Config
+	c.Segment.IndexSyncInterval = 0
+	c.AutoCompact.Interval = 0
+	c.SealOnClose = false
+	c.OnSegmentSealed = nil
+	c.OnThreshold = nil
+	c.OnSegmentsRemoved = nil
+	c.Metrics = nil
+	c.Events = nil
+	nl, err := NewLog(newDir, c)
+	if err != nil {
+		return err
+	}
+	if err = nl.Close(); err != nil {
+		return err
+	}
+
+	if err = l.Close(); err != nil {
+		return err
+	}
+	// 開き直したログでは、Closeで停止したゴルーチンを起動し直す
+	l.resumeBackground()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// INFO: 元のディレクトリを退避してから新しいディレクトリを差し替える。
+	//  2つのリネームの間でクラッシュした場合は、次にNewLogで開いたときに新しいディレクトリへ入れ替える
+	if err = resetRename(l.Dir, oldDir); err != nil {
+		return l.reopen(err)
+	}
+	if err = resetRename(newDir, l.Dir); err != nil {
+		if rerr := resetRename(oldDir, l.Dir); rerr != nil {
+			return rerr
+		}
+		return l.reopen(err)
+	}
+	if err = syncDir(filepath.Dir(filepath.Clean(l.Dir))); err != nil {
+		return l.reopen(err)
+	}
+	// 入れ替えを終えたので、AppendWithRetentionで決めた範囲も元に戻す
+	l.retainedFrom = 0
+	if err = os.RemoveAll(oldDir); err != nil {
+		return l.reopen(err)
+	}
+
+	if err = l.reopen(nil); err != nil {
+		return err
+	}
+	l.notifyRemoved(^uint64(0))
+	return nil
+}
+
+// recoverReset 中断したResetの後始末をする
+func recoverReset(dir string) error {
+	newDir, oldDir := resetDirs(dir)
+	return recoverSwap(dir, newDir, oldDir)
+}
+
+// recoverSwap 中断したディレクトリの入れ替えの後始末をする。ログのディレクトリがない場合は、作成を終えた新しいログに入れ替え、
+// 新しいログがなければ退避した元のログを戻す。その後、残っている作業用のディレクトリを削除する
+func recoverSwap(dir, newDir, oldDir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		restored := false
+		for _, src := range []string{newDir, oldDir} {
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err := os.Rename(src, dir); err != nil {
+				return err
+			}
+			restored = true
+			break
+		}
+		// 入れ替えの途中でなければ何もしない
+		if !restored {
+			return nil
+		}
+	}
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// syncDir ディレクトリのエントリの変更を安定したストレージに同期する
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// Resetがディレクトリを入れ替える途中で失敗しても、元のログか新しいログのどちらかが残るか
+func TestLogReset(t *testing.T) {
+	parent, err := os.MkdirTemp("", "reset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	want := &api.Record{Value: []byte("hello world")}
+
+	// newLog 3件のレコードを持つログを作成する
+	newLog := func(t *testing.T, dir string) *Log {
+		require.NoError(t, os.Mkdir(dir, 0700))
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = log.Append(want)
+			require.NoError(t, err)
+		}
+		return log
+	}
+	// requireRecords dirを開き直し、nextOffsetまでのレコードが読み出せることを確認する
+	requireRecords := func(t *testing.T, dir string, nextOffset uint64) {
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		require.Equal(t, nextOffset, log.NextOffset())
+		for off := uint64(0); off < nextOffset; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, read.Value)
+		}
+	}
+	// requireNoLeftovers 作業用のディレクトリが残っていないことを確認する
+	requireNoLeftovers := func(t *testing.T, dir string) {
+		newDir, oldDir := resetDirs(dir)
+		for _, d := range []string{newDir, oldDir} {
+			_, err := os.Stat(d)
+			require.True(t, os.IsNotExist(err), d)
+		}
+	}
+
+	t.Run("succeeds", func(t *testing.T) {
+		dir := filepath.Join(parent, "succeeds")
+		log := newLog(t, dir)
+		require.NoError(t, log.Reset())
+
+		// リセット後のログは空で、そのまま書き込める
+		_, err := log.Read(0)
+		require.Error(t, err)
+		off, err := log.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+		require.NoError(t, log.Close())
+
+		requireRecords(t, dir, 1)
+		requireNoLeftovers(t, dir)
+	})
+
+	t.Run("rolls back when the swap fails", func(t *testing.T) {
+		dir := filepath.Join(parent, "rollback")
+		log := newLog(t, dir)
+
+		newDir, _ := resetDirs(dir)
+		defer func() { resetRename = os.Rename }()
+		resetRename = func(from, to string) error {
+			if from == newDir {
+				return errors.New("injected rename failure")
+			}
+			return os.Rename(from, to)
+		}
+
+		require.Error(t, log.Reset())
+		// 元のログのまま読み書きできる
+		read, err := log.Read(2)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+		require.NoError(t, log.Close())
+
+		requireRecords(t, dir, 3)
+		requireNoLeftovers(t, dir)
+	})
+
+	t.Run("recovers the old log after an interrupted swap", func(t *testing.T) {
+		dir := filepath.Join(parent, "interrupted")
+		log := newLog(t, dir)
+
+		// 退避した後のリネームがすべて失敗し、ログのディレクトリがない状態で中断する
+		_, oldDir := resetDirs(dir)
+		defer func() { resetRename = os.Rename }()
+		resetRename = func(from, to string) error {
+			if to == oldDir {
+				return os.Rename(from, to)
+			}
+			return errors.New("injected rename failure")
+		}
+		require.Error(t, log.Reset())
+		_, err := os.Stat(dir)
+		require.True(t, os.IsNotExist(err))
+
+		// 開き直すと元のログが戻る
+		requireRecords(t, dir, 3)
+		requireNoLeftovers(t, dir)
+	})
+
+	t.Run("recovers the new log after a crash between renames", func(t *testing.T) {
+		dir := filepath.Join(parent, "crashed")
+		log := newLog(t, dir)
+		require.NoError(t, log.Close())
+
+		// 新しいログを作成し、元のログを退避したところでクラッシュした状態を作る
+		newDir, oldDir := resetDirs(dir)
+		require.NoError(t, os.Mkdir(newDir, 0700))
+		nl, err := NewLog(newDir, c)
+		require.NoError(t, err)
+		require.NoError(t, nl.Close())
+		require.NoError(t, os.Rename(dir, oldDir))
+
+		// 開き直すと入れ替えが完了し、新しい空のログになる
+		requireRecords(t, dir, 0)
+		requireNoLeftovers(t, dir)
+	})
+}
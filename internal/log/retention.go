@@ -0,0 +1,88 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// AppendWithRetention レコードを追加し、同じロックの中で最新のmaxRecords件より古いレコードを読み出せなくする。
+// セグメント単位で削除できるものは削除し、残ったセグメントの古いレコードはErrOffsetOutOfRangeを返す。
+// 読み出せない範囲はメモリにのみ保持するので、開き直すと削除されなかったセグメントのレコードは再び読み出せる。
+// maxRecordsが0の場合はAppendと同じ
+func (l *Log) AppendWithRetention(record *api.Record, maxRecords uint64) (uint64, error) {
+	l.mu.Lock()
+	off, err := l.append(record)
+	if err != nil || maxRecords == 0 || off+1 <= maxRecords {
+		l.mu.Unlock()
+		return off, err
+	}
+
+	lowest := off + 1 - maxRecords
+	if lowest > l.retainedFrom {
+		l.retainedFrom = lowest
+	}
+	// すべてのレコードがlowestより前のセグメントは削除する
+	if err = l.removeSegmentsBelow(lowest); err != nil {
+		return off, err
+	}
+	return off, nil
+}
+
+// lowestOffset 読み出せる最小のオフセットを返す。ロックを獲得した状態で呼び出す
+func (l *Log) lowestOffset() uint64 {
+	if lowest := l.segments[0].baseOffset; lowest > l.retainedFrom {
+		return lowest
+	}
+	return l.retainedFrom
+}
+
+// TruncateBefore 最新のレコードの時刻がtより前のセグメントを、古い順に削除する。
+// 時刻がtより前でないセグメントに達したら、それより新しいセグメントは調べない。途中のセグメントだけを削除すると読み出せない範囲ができるため。
+// セグメントごとの時刻をサイドカーファイルに記録する代わりに、最新のレコードのtimestampを使う。
+// Produceは時刻のないレコードに受け付けた時刻を付与するので、記録を二重に持たずに済み、詰め直しやWriteSegmentで複製したセグメントでも時刻が変わらない。
+// Appendで直接追加した時刻を持たないレコードの場合は、ストアファイルの最終更新時刻を使う。
+// アクティブセグメントは書き込み先なので、空であっても削除しない
+func (l *Log) TruncateBefore(t time.Time) error {
+	if err := l.writable(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	// 最初の時刻がtより前でないセグメントのベースオフセットより前のセグメントを削除する
+	lowest := l.activeSegment.baseOffset
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		newer, err := s.newerThan(t)
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		if newer {
+			lowest = s.baseOffset
+			break
+		}
+	}
+	return l.removeSegmentsBelow(lowest)
+}
+
+// newerThan セグメントの最新のレコードの時刻がt以降かを判定する。レコードのないセグメントはfalseを返す
+func (s *segment) newerThan(t time.Time) (bool, error) {
+	if s.nextOffset == s.baseOffset {
+		return false, nil
+	}
+	record, err := s.Read(s.nextOffset - 1)
+	if err != nil {
+		return false, err
+	}
+	if record.Timestamp != 0 {
+		return !time.Unix(0, record.Timestamp).Before(t), nil
+	}
+	// INFO: 読み出しでバッファの内容はファイルに書き出されているので、最終更新時刻は最後のレコードを書き込んだ時刻以降になる
+	fi, err := s.store.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !fi.ModTime().Before(t), nil
+}
@@ -0,0 +1,162 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// AppendWithRetentionで、読み出せるレコードが最新のmaxRecords件に保たれるか
+func TestLogAppendWithRetention(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	const maxRecords = 3
+	for i := uint64(0); i < 10; i++ {
+		off, err := log.AppendWithRetention(&api.Record{Value: []byte("hello world")}, maxRecords)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+
+		// 読み出せるレコードは常に最新のmaxRecords件まで
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		highest, err := log.highestOffset()
+		require.NoError(t, err)
+		live := highest - lowest + 1
+		require.LessOrEqual(t, live, uint64(maxRecords))
+		if i+1 >= maxRecords {
+			require.Equal(t, uint64(maxRecords), live)
+		}
+	}
+
+	// 古いオフセットは、セグメントが残っていても読み出せない
+	for off := uint64(0); off < 7; off++ {
+		_, err := log.Read(off)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+	}
+	for off := uint64(7); off < 10; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+	// すべてのレコードが範囲外になったセグメントは削除されている
+	require.Equal(t, uint64(6), log.segments[0].baseOffset)
+
+	// Iteratorも読み出せる範囲から始まる
+	record, err := log.Iterator().Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), record.Offset)
+
+	// 範囲外のレコードは、残っているセグメントをまとめて読み出す場合も返さない
+	_, _, err = log.ReadUpToBytes(6, 1024)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+	records, next, err := log.ReadUpToBytes(7, 1024)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, uint64(10), next)
+
+	_, err = log.FindLast(9, func(r *api.Record) bool { return r.Offset == 6 })
+	require.Equal(t, api.ErrNoMatchingRecord{From: 9}, err)
+
+	records, err = log.ReadSegment(6)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(7), records[0].Offset)
+
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	record = &api.Record{}
+	require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+enc.Uint64(b[:lenWidth])], record))
+	require.Equal(t, uint64(7), record.Offset)
+
+	var data, index bytes.Buffer
+	require.NoError(t, log.ExportArchive(&data, &index))
+	archive, err := OpenArchive(bytes.NewReader(data.Bytes()), &index)
+	require.NoError(t, err)
+	lowest, err := archive.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), lowest)
+
+	// 詰め直した後も、範囲外のレコードは読み出せない
+	require.NoError(t, log.CompactAndSwap())
+	for off := uint64(0); off < 7; off++ {
+		_, err := log.Read(off)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+	}
+	for off := uint64(7); off < 10; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), lowest)
+	off, err := log.AppendWithRetention(&api.Record{Value: []byte("hello world")}, maxRecords)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+// 最新のレコードの時刻が指定した時刻より前のセグメントだけを、古い順に削除するか
+func TestLogTruncateBefore(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	// 空のアクティブセグメントしかない場合は何も削除しない
+	require.NoError(t, log.TruncateBefore(time.Now().Add(time.Hour)))
+	require.Len(t, log.segments, 1)
+
+	// 最初のセグメントのレコードは時刻を持たないので、ストアファイルの最終更新時刻を使う。
+	// 3番目のセグメントは2番目より古い時刻を持つ
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, ts := range []time.Duration{-1, -1, 3 * time.Hour, 4 * time.Hour, time.Hour, 2 * time.Hour, 5 * time.Hour} {
+		record := &api.Record{Value: []byte("hello world")}
+		if ts >= 0 {
+			record.Timestamp = base.Add(ts).UnixNano()
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+	require.NoError(t, log.Flush())
+	require.NoError(t, os.Chtimes(log.segments[0].store.Name(), base, base))
+
+	require.NoError(t, log.TruncateBefore(base.Add(90*time.Minute)))
+	require.Len(t, log.segments, 3)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// 時刻が新しいセグメントに達したら、それより後ろのセグメントは古くても削除しない
+	require.NoError(t, log.TruncateBefore(base.Add(150*time.Minute)))
+	require.Len(t, log.segments, 3)
+
+	// アクティブセグメントは古くても残る
+	require.NoError(t, log.TruncateBefore(base.Add(24*time.Hour)))
+	require.Len(t, log.segments, 1)
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+
+	// 開き直しても同じ範囲を読み出せる
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	read, err := log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(5*time.Hour).UnixNano(), read.Timestamp)
+}
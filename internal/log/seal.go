@@ -0,0 +1,93 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// シールファイルの内容。次のオフセットとストアのチェックサムを並べる
+	sealWidth = 8 + sha256.Size
+)
+
+// sealPath セグメントのシールファイルのパスを返す
+func sealPath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".sealed"))
+}
+
+// storeChecksum ストアの実データのチェックサムを計算する
+func (s *segment) storeChecksum() ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(s.store, 0, int64(s.store.size))); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// seal セグメントの次のオフセットとストアのチェックサムをシールファイルに書き込み、以降は書き込めないセグメントとする
+func (s *segment) seal(dir string) error {
+	if err := s.store.flush(); err != nil {
+		return err
+	}
+	sum, err := s.storeChecksum()
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, sealWidth)
+	enc.PutUint64(b[:8], s.nextOffset)
+	copy(b[8:], sum[:])
+
+	f, err := s.config.fs().OpenFile(sealPath(dir, s.baseOffset), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	s.sealed = true
+	return nil
+}
+
+// loadSeal シールファイルがある場合は、セグメントの内容が封じたときから変わっていないかを確認する
+func (s *segment) loadSeal(dir string) error {
+	f, err := s.config.fs().OpenFile(sealPath(dir, s.baseOffset), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := make([]byte, sealWidth)
+	if _, err = io.ReadFull(f, b); err != nil {
+		return fmt.Errorf("segment %d: invalid seal: %w", s.baseOffset, err)
+	}
+	if next := enc.Uint64(b[:8]); next != s.nextOffset {
+		return fmt.Errorf("segment %d: sealed at next offset %d, index has %d", s.baseOffset, next, s.nextOffset)
+	}
+	sum, err := s.storeChecksum()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum[:], b[8:]) {
+		return fmt.Errorf("segment %d: store checksum does not match seal", s.baseOffset)
+	}
+	s.sealed = true
+	return nil
+}
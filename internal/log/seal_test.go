@@ -0,0 +1,45 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// SealOnCloseで閉じたアクティブセグメントが封じられ、開き直すと新しいアクティブセグメントが作成されるか
+func TestLogSealOnClose(t *testing.T) {
+	c := Config{SealOnClose: true}
+	log := newTestLog(t, c)
+	dir := log.Dir
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	_, err := os.Stat(filepath.Join(dir, "0.sealed"))
+	require.NoError(t, err)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 2)
+	require.True(t, log.segments[0].sealed)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+	require.False(t, log.activeSegment.sealed)
+
+	// 封じたセグメントのレコードも読み出せ、新しいレコードはアクティブセグメントに追加される
+	_, err = log.Read(2)
+	require.NoError(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+
+	// 封じた後にストアが書き換えられた場合は開けない
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), []byte("corrupted"), 0600))
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
@@ -1,7 +1,8 @@
 package log
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"errors"
 	"os"
 	"path/filepath"
 
@@ -10,11 +11,30 @@ import (
 	api "github.com/radish-miyazaki/proglog/api/v1"
 )
 
+// RecordLocation ストアファイル内でレコードが占めるバイト範囲。
+// [Position, Position+Length)の範囲に、長さのプレフィックスを除いたシリアライズ済みのレコードが格納されている
+type RecordLocation struct {
+	BaseOffset uint64
+	StorePath  string
+	Position   uint64
+	Length     uint64
+}
+
+// fileOpener セグメントのファイルを開く。テストでエラーを注入するために変数にしている
+var fileOpener = os.OpenFile
+
+// storeAppend ストアにレコードを追加する。テストで書き込みの失敗を注入するために変数にしている
+var storeAppend = func(s *store, p []byte) (n uint64, pos uint64, err error) {
+	return s.Append(p)
+}
+
 type segment struct {
 	store                  *store
 	index                  *index
 	baseOffset, nextOffset uint64 // 相対オフセットを計算するためbaseとnextと2つ有する
 	config                 Config
+	// sealed SealOnCloseで封じられたセグメントの場合はtrue。以降はレコードを追加しない
+	sealed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -25,7 +45,15 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	// INFO: ストアファイルをオープンする。
 	//  ファイルが存在しない場合はos.O_Createファイルモードフラグをos.OpenFileの引数として渡して、ファイルを作成する。
 	//  ストアファイルを作成する際には、os.O_APPENDフラグを渡して、書き込み時にOSがファイルを追加するようにしている。
-	storeFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	//  ただし領域を事前に確保する場合は、確保した領域の末尾に追記されないようos.O_APPENDを外す。
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.Segment.PreallocateStore {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	storeFile, err := c.fs().OpenFile(c.naming().StorePath(dir, baseOffset), flag, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -35,13 +63,32 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 
 	// INFO: インデックスファイルをオープンする。
 	//  ストアファイル同様、ファイルが存在しない場合はファイルを作成する。
-	indexFile, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), os.O_RDWR|os.O_CREATE, 0600)
+	flag = os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	indexFile, err := c.fs().OpenFile(c.naming().IndexPath(dir, baseOffset), flag, 0600)
 	if err != nil {
 		return nil, err
 	}
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if c.ReadOnly {
+		s.index.trimWritten(s.store.size)
+	}
+
+	// 領域を確保したストアの実データの末尾は、インデックスが指す位置をもとに求める
+	if c.Segment.PreallocateStore && !c.ReadOnly {
+		if err = s.store.preallocate(c.Segment.MaxStoreBytes, s.index.lastPosition()); err != nil {
+			return nil, err
+		}
+	}
+	if c.Segment.Dedup && !c.ReadOnly {
+		if err = s.store.enableDedup(dedupKey); err != nil {
+			return nil, err
+		}
+	}
 
 	// 次のオフセットを設定して、次に追加されるレコードの準備をする。
 	if off, _, err := s.index.Read(-1); err != nil {
@@ -51,22 +98,78 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		//  空でない場合、次に書き込まれるレコードのオフセットはベースセグメントと相対オフセットの和に1を加算する
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	if err = s.loadSeal(dir); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+// dedupKey 重複排除で同じ内容とみなすためのハッシュを、ストアに保存するレコードのバイト列から求める。
+// オフセットと時刻は内容に含めないので、重複とみなしたレコードは最初に保存したレコードの時刻を返す。
+// 有効期間のあるレコードは時刻によって読み出せる期間が変わるので、重複排除しない
+func dedupKey(p []byte) ([sha256.Size]byte, bool) {
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil || record.Ttl > 0 {
+		return [sha256.Size]byte{}, false
+	}
+	record.Offset = 0
+	record.Timestamp = 0
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(b), true
+}
+
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	offset, _, err = s.append(record)
+	return offset, err
+}
+
+// append レコードを追加し、ストアファイル内でレコードが占める位置も返す
+func (s *segment) append(record *api.Record) (offset uint64, loc RecordLocation, err error) {
+	// インデックスに書き込めないことが分かっている場合は、ストアにも書き込まない
+	if err := s.index.err(); err != nil {
+		return 0, loc, err
+	}
+
+	// クライアントが圧縮した値はそのまま保存して返すので、サーバの圧縮とは併用できない
+	if record.Compressed && record.Codec != api.Codec_CODEC_NONE {
+		return 0, loc, api.ErrInvalidRecord{Err: errors.New("compressed record cannot have a codec")}
+	}
+
 	cur := s.nextOffset
 	record.Offset = cur
+	if s.config.Segment.RecordIDs && record.Id == "" && !record.Compacted {
+		if record.Id, err = newRecordID(); err != nil {
+			return 0, loc, err
+		}
+	}
 
-	p, err := proto.Marshal(record)
+	// INFO: 重複排除が有効な場合、オフセットを含めずに保存する。オフセットは読み出し時にインデックスから復元する
+	//  圧縮方式が指定されている場合は、値を圧縮して方式とともに保存する
+	stored := record
+	if s.config.Segment.Dedup || record.Codec != api.Codec_CODEC_NONE {
+		stored = proto.Clone(record).(*api.Record)
+		if s.config.Segment.Dedup {
+			stored.Offset = 0
+		}
+		if stored.Value, err = encodeValue(record.Codec, record.Value); err != nil {
+			return 0, loc, err
+		}
+	}
+	p, err := proto.Marshal(stored)
 	if err != nil {
-		return 0, err
+		return 0, loc, err
+	}
+	if err = s.checkRecordSize(uint64(len(p)) + lenWidth); err != nil {
+		return 0, loc, err
 	}
 
 	// ストアファイルにレコードを追加
-	_, pos, err := s.store.Append(p)
+	_, pos, err := storeAppend(s.store, p)
 	if err != nil {
-		return 0, err
+		return 0, loc, err
 	}
 
 	// インデックスファイルに追加したレコードの相対オフセットと位置を追記
@@ -74,36 +177,92 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		uint32(s.nextOffset-uint64(s.baseOffset)),
 		pos,
 	); err != nil {
-		return 0, err
+		return 0, loc, err
 	}
 
 	// 次のAppendの実行に備えて、nextOffsetを1加算
 	s.nextOffset++
-	return cur, nil
+	return cur, RecordLocation{
+		BaseOffset: s.baseOffset,
+		StorePath:  s.store.Name(),
+		Position:   pos + lenWidth,
+		Length:     uint64(len(p)),
+	}, nil
+}
+
+// checkRecordSize 長さを含めてsizeバイトのレコードを書き込めるかを確認する。
+// 領域を確保したストアは大きさが決まっているので、空のセグメントにも収まらないレコードはセグメントを切り替えても書き込めない。
+// 領域を確保しない場合、上限を超えるレコードもそのまま書き込み、書き込んだ後にセグメントを切り替える
+func (s *segment) checkRecordSize(size uint64) error {
+	if s.config.Segment.PreallocateStore && size > s.config.Segment.MaxStoreBytes {
+		return api.ErrRecordTooLarge{Size: size, Max: s.config.Segment.MaxStoreBytes}
+	}
+	return nil
 }
 
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	record, _, err := s.readWithLocation(off)
+	return record, err
+}
+
+// readWithLocation レコードを読み出し、ストアファイル内でレコードが占める位置も返す
+func (s *segment) readWithLocation(off uint64) (*api.Record, RecordLocation, error) {
+	var loc RecordLocation
 	// 相対オフセットをもとに、インデックスファイルからレコードの位置を取得
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
 	if err != nil {
-		return nil, err
+		return nil, loc, err
 	}
 
 	// 位置をもとに、ストアファイルからレコードを取得
 	p, err := s.store.Read(pos)
 	if err != nil {
-		return nil, err
+		return nil, loc, err
 	}
 
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, loc, err
+	}
+	if err = decodeValue(record); err != nil {
+		return nil, loc, err
+	}
+	// 重複排除したレコードは複数のオフセットで共有されているので、読み出したオフセットを設定する
+	record.Offset = off
+	return record, RecordLocation{
+		BaseOffset: s.baseOffset,
+		StorePath:  s.store.Name(),
+		Position:   pos + lenWidth,
+		Length:     uint64(len(p)),
+	}, nil
+}
+
+// position offのレコードのストアファイル内の位置を返す。offがセグメントのレコードより後ろの場合は、ストアの末尾を返す
+func (s *segment) position(off uint64) (uint64, error) {
+	if off >= s.nextOffset {
+		return s.store.size, nil
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	return pos, err
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes ||
-		s.index.isMaxed()
+	return s.maxedCause() != ""
+}
+
+// maxedCause セグメントが上限に達している原因を返す。達していない場合は空文字を返す
+func (s *segment) maxedCause() string {
+	switch {
+	case s.sealed:
+		return rolloverSealed
+	case s.store.size >= s.config.Segment.MaxStoreBytes:
+		return rolloverStore
+	case s.index.size >= s.config.Segment.MaxIndexBytes || s.index.isMaxed():
+		return rolloverIndex
+	case s.config.Segment.MaxRecords != 0 && s.nextOffset-s.baseOffset >= s.config.Segment.MaxRecords:
+		return rolloverRecords
+	}
+	return ""
 }
 
 // Remove セグメントを閉じて、インデックスファイルとストアファイルを削除する
@@ -112,11 +271,16 @@ func (s *segment) Remove() error {
 		return err
 	}
 
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.config.fs().Remove(s.index.Name()); err != nil {
+		return err
+	}
+
+	if err := s.config.fs().Remove(s.store.Name()); err != nil {
 		return err
 	}
 
-	if err := os.Remove(s.store.Name()); err != nil {
+	// 封じられていないセグメントにはシールファイルはない
+	if err := s.config.fs().Remove(sealPath(filepath.Dir(s.store.Name()), s.baseOffset)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
@@ -126,6 +290,8 @@ func (s *segment) Remove() error {
 // Close インデックスファイルとストアファイルを閉じる
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
+		// INFO: インデックスを閉じられなくても、ストアのファイルディスクリプタは閉じておく
+		_ = s.store.Close()
 		return err
 	}
 
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"testing"
@@ -62,3 +63,46 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 }
+
+// 圧縮方式の異なるレコードを同じセグメントに書き込んでも、すべて読み出せるか
+func TestSegmentCodecs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	value := bytes.Repeat([]byte("hello world "), 50)
+	codecs := []api.Codec{api.Codec_CODEC_NONE, api.Codec_CODEC_GZIP, api.Codec_CODEC_FLATE}
+	var sizes []uint64
+	for _, codec := range codecs {
+		_, loc, err := s.append(&api.Record{Value: value, Codec: codec})
+		require.NoError(t, err)
+		sizes = append(sizes, loc.Length)
+	}
+	// 圧縮したレコードはストア上で小さくなる
+	require.Less(t, sizes[1], sizes[0])
+	require.Less(t, sizes[2], sizes[0])
+
+	// 開き直しても、レコードごとの方式で展開される
+	require.NoError(t, s.Close())
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i, codec := range codecs {
+		got, err := s.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, value, got.Value)
+		require.Equal(t, codec, got.Codec)
+	}
+
+	// 未知の方式は書き込まない
+	_, err = s.Append(&api.Record{Value: value, Codec: api.Codec(99)})
+	var invalid api.ErrInvalidRecord
+	require.ErrorAs(t, err, &invalid)
+	require.Equal(t, uint64(3), s.nextOffset)
+}
@@ -2,7 +2,10 @@ package log
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
 )
@@ -18,14 +21,20 @@ const (
 )
 
 type store struct {
-	*os.File
+	File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// preallocated 事前に領域を確保している場合、ファイルサイズと実データ量は一致しない
+	preallocated bool
+	// dedup 重複排除が有効な場合の、内容のハッシュからストア内の位置へのマップ
+	dedup map[[sha256.Size]byte]uint64
+	// dedupKey 書き込む内容から重複を判定するハッシュを求める。falseを返した内容は重複排除しない
+	dedupKey func(p []byte) ([sha256.Size]byte, bool)
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File) (*store, error) {
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +52,17 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 	// INFO: システムコール数を減らしてパフォーマンスを改善させるために、ファイルに直接書き込むのではなく、
 	//  バッファ付きライターに書き込んでいる。
+	// INFO: 重複排除が有効で同じ内容が既に書き込まれている場合は、書き込まずにその位置を返す
+	var h [sha256.Size]byte
+	var keyed bool
+	if s.dedup != nil {
+		if h, keyed = s.dedupKey(p); keyed {
+			if pos, ok := s.dedup[h]; ok {
+				return 0, pos, nil
+			}
+		}
+	}
+
 	pos = s.size
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
@@ -53,9 +73,106 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	}
 	w += lenWidth
 	s.size += uint64(w)
+	if keyed {
+		s.dedup[h] = pos
+	}
 	return uint64(w), pos, nil
 }
 
+// AppendFrom rから読み出したnバイトを、長さとともにストアに追加する。
+// rがnバイトに満たない場合は、途中まで書き込んだ内容を取り除いてエラーを返す。
+// 重複排除が有効な場合、内容を読み出す前に重複を判定できないので必ず追記するが、以降のAppendで重複とみなせるようハッシュは記録する
+func (s *store) AppendFrom(r io.Reader, n uint64) (w uint64, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var content bytes.Buffer
+	if s.dedup != nil {
+		r = io.TeeReader(r, &content)
+	}
+
+	pos = s.size
+	if err := binary.Write(s.buf, enc, n); err != nil {
+		return 0, 0, err
+	}
+	if _, err := io.CopyN(s.buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if rerr := s.discardFrom(pos); rerr != nil {
+			return 0, 0, rerr
+		}
+		return 0, 0, err
+	}
+	s.size += lenWidth + n
+	if s.dedup != nil {
+		if h, ok := s.dedupKey(content.Bytes()); ok {
+			if _, dup := s.dedup[h]; !dup {
+				s.dedup[h] = pos
+			}
+		}
+	}
+	return lenWidth + n, pos, nil
+}
+
+// discardFrom pos以降に書き込んだ内容を取り除き、次の書き込み位置をposに戻す
+func (s *store) discardFrom(pos uint64) error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	// INFO: 事前に確保した領域は切り詰めず、実データの末尾として扱う位置だけを戻す
+	if !s.preallocated {
+		if err := s.File.Truncate(int64(pos)); err != nil {
+			return err
+		}
+	}
+	_, err := s.File.Seek(int64(pos), io.SeekStart)
+	return err
+}
+
+// truncate pos以降に書き込んだレコードを取り除く
+func (s *store) truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.discardFrom(pos); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
+// enableDedup keyで重複を判定する重複排除を有効にする。既存のレコードを走査して、内容のハッシュと位置のマップを再構築する
+func (s *store) enableDedup(key func(p []byte) ([sha256.Size]byte, bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	s.dedup = make(map[[sha256.Size]byte]uint64)
+	s.dedupKey = key
+	size := make([]byte, lenWidth)
+	for pos := uint64(0); pos < s.size; {
+		if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		b := make([]byte, enc.Uint64(size))
+		if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+			return err
+		}
+		// 同じ内容が複数ある場合は、最初の位置を使う
+		if h, ok := key(b); ok {
+			if _, dup := s.dedup[h]; !dup {
+				s.dedup[h] = pos
+			}
+		}
+		pos += lenWidth + uint64(len(b))
+	}
+	return nil
+}
+
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -77,6 +194,33 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	return b, nil
 }
 
+// flush バッファに溜まっているデータをファイルに書き出す
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buf.Flush()
+}
+
+// buffered バッファに溜まっていて、まだファイルに書き出されていないバイト数を返す
+func (s *store) buffered() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return uint64(s.buf.Buffered())
+}
+
+// sync バッファの内容をファイルに書き出し、安定したストレージに同期する
+func (s *store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -84,9 +228,72 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	if err := s.buf.Flush(); err != nil {
 		return 0, err
 	}
+
+	// INFO: 事前に確保した領域は実データではないので、実データの末尾以降は読み出さない
+	if s.preallocated {
+		if uint64(off) >= s.size {
+			return 0, io.EOF
+		}
+		if rest := s.size - uint64(off); uint64(len(p)) > rest {
+			n, err := s.File.ReadAt(p[:rest], off)
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
 	return s.File.ReadAt(p, off)
 }
 
+// preallocate ファイルをnバイトまで事前に確保し、書き込み位置を実データの末尾に合わせる。
+// lastはインデックスが指す最も後ろのレコードの位置で、インデックスにエントリがない場合は負の値を渡す。
+// ファイルはos.O_APPENDなしで開かれている必要がある
+func (s *store) preallocate(n uint64, last int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.recoverSize(last); err != nil {
+		return err
+	}
+	if _, err := s.File.Seek(int64(s.size), io.SeekStart); err != nil {
+		return err
+	}
+	if n > s.size {
+		// OSのファイル以外では、ファイルを拡張して領域を確保する
+		f, ok := s.File.(*os.File)
+		if !ok {
+			if err := s.File.Truncate(int64(n)); err != nil {
+				return err
+			}
+		} else if err := fallocate(f, int64(n)); err != nil {
+			return err
+		}
+	}
+	s.preallocated = true
+	return nil
+}
+
+// recoverSize 長さのプレフィックスを先頭からたどって実データの末尾を求め、sizeに設定する。ロックを獲得した状態で呼び出す。
+// Closeせずに終了した場合、ファイルは確保した領域の大きさのままなので、ファイルの大きさを実データ量とみなせない。
+// 確保した領域は0で埋まっていて空のレコードと区別できないので、インデックスが指す位置lastより後ろにある長さが0のフレームか、
+// ファイルに収まらないフレームに達したところを末尾とみなす
+func (s *store) recoverSize(last int64) error {
+	size := make([]byte, lenWidth)
+	var pos uint64
+	for pos+lenWidth <= s.size {
+		if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		n := enc.Uint64(size)
+		if (n == 0 && int64(pos) > last) || n > s.size-pos-lenWidth {
+			break
+		}
+		pos += lenWidth + n
+	}
+	s.size = pos
+	return nil
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -94,5 +301,11 @@ func (s *store) Close() error {
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
+	// インデックスと同様に、ファイルを実際のデータ量まで切り詰める
+	if s.preallocated {
+		if err := s.File.Truncate(int64(s.size)); err != nil {
+			return err
+		}
+	}
 	return s.File.Close()
 }
@@ -1,7 +1,11 @@
 package log
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -107,3 +111,142 @@ func openFile(name string) (file *os.File, size int64, err error) {
 
 	return f, fi.Size(), nil
 }
+
+func TestStorePreallocate(t *testing.T) {
+	f, err := os.OpenFile(
+		filepath.Join(t.TempDir(), "store_preallocate_test"),
+		os.O_RDWR|os.O_CREATE,
+		0600,
+	)
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.preallocate(1024, -1))
+
+	// 作成時にファイルが確保されているか
+	_, size, err := openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), size)
+
+	testAppend(t, s)
+	testRead(t, s)
+	testReadAt(t, s)
+
+	// 実データの末尾以降は読み出せない
+	b := make([]byte, lenWidth)
+	_, err = s.ReadAt(b, int64(width*3))
+	require.Equal(t, io.EOF, err)
+
+	// クローズ時に実データ量まで切り詰められるか
+	require.NoError(t, s.Close())
+	_, size, err = openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(width*3), size)
+
+	// 再度開いても既存のデータの後ろに追記されるか
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.preallocate(1024, int64(width*2)))
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width*3, pos)
+	testRead(t, s)
+
+	// Closeせずに終了した場合も、確保した領域を実データとみなさずに追記できるか
+	require.NoError(t, s.buf.Flush())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, size, err = openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), size)
+	crashed, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, crashed.preallocate(1024, int64(pos)))
+	require.Equal(t, width*4, crashed.size)
+	_, pos, err = crashed.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width*4, pos)
+	read, err := crashed.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// 空のレコードの後ろに書き込んだレコードも、インデックスが指していれば失われない
+	_, empty, err := crashed.Append(nil)
+	require.NoError(t, err)
+	_, pos, err = crashed.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, crashed.buf.Flush())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	recovered, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, recovered.preallocate(1024, int64(pos)))
+	require.Equal(t, pos+width, recovered.size)
+	read, err = recovered.Read(empty)
+	require.NoError(t, err)
+	require.Empty(t, read)
+	read, err = recovered.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, recovered.Close())
+	require.NoError(t, crashed.File.Close())
+	require.NoError(t, s.File.Close())
+}
+
+func TestStoreDedup(t *testing.T) {
+	f, err := os.CreateTemp("", "store_dedup_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.enableDedup(rawDedupKey))
+
+	n, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width, n)
+
+	// 同じ内容はストアを大きくせず、最初の位置を共有する
+	n, dup, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), n)
+	require.Equal(t, pos, dup)
+	require.Equal(t, width, s.size)
+
+	// 異なる内容は追記される
+	_, other, err := s.Append([]byte("goodbye world"))
+	require.NoError(t, err)
+	require.Equal(t, width, other)
+	require.NoError(t, s.Close())
+
+	// 再度開いたときにハッシュのマップが再構築されるか
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.enableDedup(rawDedupKey))
+	size := s.size
+	_, dup, err = s.Append([]byte("goodbye world"))
+	require.NoError(t, err)
+	require.Equal(t, other, dup)
+	require.Equal(t, size, s.size)
+
+	// AppendFromで書き込んだ内容も、以降のAppendで重複とみなされる
+	copied := []byte("copied world")
+	_, from, err := s.AppendFrom(bytes.NewReader(copied), uint64(len(copied)))
+	require.NoError(t, err)
+	size = s.size
+	_, dup, err = s.Append(copied)
+	require.NoError(t, err)
+	require.Equal(t, from, dup)
+	require.Equal(t, size, s.size)
+	require.NoError(t, s.Close())
+}
+
+// rawDedupKey 内容のバイト列全体で重複を判定する
+func rawDedupKey(p []byte) ([sha256.Size]byte, bool) {
+	return sha256.Sum256(p), true
+}
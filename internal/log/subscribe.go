@@ -0,0 +1,74 @@
+package log
+
+import (
+	"context"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// Subscription Subscribeを呼び出した後に追加されたレコードを、追加された順に読み出す
+type Subscription struct {
+	log  *Log
+	next uint64
+}
+
+// Subscribe 次に追加されるレコードから読み出すSubscriptionを返す。
+// 書き込みと同じロックの中で次のオフセットを決めるので、呼び出した後に追加されたレコードを取りこぼさない
+func (l *Log) Subscribe() *Subscription {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return &Subscription{log: l, next: l.activeSegment.nextOffset}
+}
+
+// Offset 次に読み出すレコードのオフセットを返す
+func (s *Subscription) Offset() uint64 {
+	return s.next
+}
+
+// Next 次のレコードを返す。まだ追加されていない場合は、追加されるかctxが終了するまで待つ。有効期間の過ぎたレコードは読み飛ばす
+func (s *Subscription) Next(ctx context.Context) (*api.Record, error) {
+	l := s.log
+	for {
+		// INFO: 次のオフセットの確認と待機するチャネルの取得を読み込みのロックの中で行い、
+		//  その間に追加されたレコードの通知を取りこぼさないようにする
+		l.mu.RLock()
+		if s.next < l.activeSegment.nextOffset {
+			l.mu.RUnlock()
+			record, err := l.Read(s.next)
+			if _, ok := err.(api.ErrRecordExpired); ok {
+				s.next++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.next++
+			return record, nil
+		}
+		l.appendedMu.Lock()
+		if l.appended == nil {
+			l.appended = make(chan struct{})
+		}
+		appended := l.appended
+		l.appendedMu.Unlock()
+		l.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// notifyAppended レコードの追加を待っているSubscriptionを起こす。書き込みのロックを獲得した状態で呼び出す
+func (l *Log) notifyAppended() {
+	l.appendedMu.Lock()
+	defer l.appendedMu.Unlock()
+
+	if l.appended != nil {
+		close(l.appended)
+		l.appended = nil
+	}
+}
@@ -0,0 +1,51 @@
+package log
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+func TestLogSubscribe(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	// 購読前に追加されたレコードは返さない
+	_, err := log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	sub := log.Subscribe()
+	require.Equal(t, uint64(1), sub.Offset())
+
+	// レコードが追加されるまで待つ
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = sub.Next(ctx)
+	cancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	values := make(chan string)
+	go func() {
+		defer close(values)
+		for i := 0; i < 3; i++ {
+			record, err := sub.Next(context.Background())
+			if err != nil {
+				return
+			}
+			values <- string(record.Value)
+		}
+	}()
+	// セグメントの切り替えをまたいでも順に届く
+	for _, value := range []string{"after-1", "after-2", "after-3"} {
+		_, err = log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	var got []string
+	for value := range values {
+		got = append(got, value)
+	}
+	require.Equal(t, []string{"after-1", "after-2", "after-3"}, got)
+}
@@ -0,0 +1,107 @@
+package log
+
+import (
+	"context"
+)
+
+// Sync まだ永続化されていないセグメントのストアとインデックスを安定したストレージに同期する。
+// アクティブセグメントは新しいレコードがなくても同期する
+func (l *Log) Sync() error {
+	// INFO: 同期中にインデックスがアンマップされたりレコードが追加されたりしないよう、読み込みのロックを獲得しておく
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+
+	l.syncMu.Lock()
+	synced := l.syncedOffset
+	l.syncMu.Unlock()
+
+	// 後ろのセグメントから、前回の同期以降にレコードが追加されたセグメントを同期する
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s != l.activeSegment && s.nextOffset <= synced {
+			break
+		}
+		if err := s.store.sync(); err != nil {
+			return fsError(err)
+		}
+		if err := indexSync(s.index); err != nil {
+			return err
+		}
+	}
+
+	l.syncMu.Lock()
+	l.syncedOffset = l.activeSegment.nextOffset
+	close(l.synced)
+	l.synced = make(chan struct{})
+	l.syncMu.Unlock()
+
+	return nil
+}
+
+// Flush バッファに溜まっているレコードをファイルに書き出す。Syncと異なり安定したストレージへの同期は行わないので、
+// 別のプロセスからファイルを読み出せるようにはなるが、OSがクラッシュした場合は失われうる。WaitForSyncで待っているゴルーチンも起こさない
+func (l *Log) Flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.flushSegments()
+}
+
+// flushSegments すべてのセグメントのバッファをファイルに書き出す。ロックを獲得した状態で呼び出す
+func (l *Log) flushSegments() error {
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if err := s.store.flush(); err != nil {
+			return fsError(err)
+		}
+		// メモリにマップしていないインデックスは、ファイルに書き戻すまで他から見えない
+		if !s.index.mapped {
+			if err := s.index.syncMap(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnflushedBytes アクティブセグメントのストアで、まだファイルに書き出されていないバイト数を返す
+func (l *Log) UnflushedBytes() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.activeSegment.store.buffered()
+}
+
+// SyncedOffset 永続化済みのオフセットを返す。このオフセットより前のレコードは安定したストレージに同期されている
+func (l *Log) SyncedOffset() uint64 {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	return l.syncedOffset
+}
+
+// WaitForSync offsetのレコードが永続化されるまで待つ。
+// IndexSyncIntervalによる定期的な同期か、Syncの呼び出しと組み合わせて使う
+func (l *Log) WaitForSync(ctx context.Context, offset uint64) error {
+	for {
+		l.syncMu.Lock()
+		if offset < l.syncedOffset {
+			l.syncMu.Unlock()
+			return nil
+		}
+		synced := l.synced
+		l.syncMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-synced:
+		}
+	}
+}
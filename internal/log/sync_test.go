@@ -0,0 +1,140 @@
+package log
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// 設定した間隔でアクティブセグメントのインデックスが同期されるか
+func TestLogIndexSyncInterval(t *testing.T) {
+	ticks := fakeTicks(t)
+	c := Config{}
+	c.Segment.IndexSyncInterval = time.Minute
+	log := newTestLog(t, c)
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), log.SyncedOffset())
+
+	ticks <- time.Now()
+	ticks <- time.Now()
+	require.Equal(t, uint64(1), log.SyncedOffset())
+
+	// Close後は同期するゴルーチンが残っていない
+	require.NoError(t, log.Close())
+	select {
+	case ticks <- time.Now():
+		t.Fatal("index sync goroutine is still running after Close")
+	default:
+	}
+}
+
+// 定期的な同期でオフセットが永続化されるまで待てるか
+func TestLogWaitForSync(t *testing.T) {
+	var syncs int32
+	orig := indexSync
+	defer func() { indexSync = orig }()
+	indexSync = func(i *index) error {
+		atomic.AddInt32(&syncs, 1)
+		return orig(i)
+	}
+
+	ticks := fakeTicks(t)
+	c := Config{}
+	c.Segment.IndexSyncInterval = time.Minute
+	log := newTestLog(t, c)
+	dir := log.Dir
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	before := atomic.LoadInt32(&syncs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waited := make(chan error)
+	go func() { waited <- log.WaitForSync(ctx, off) }()
+	ticks <- time.Now()
+	require.NoError(t, <-waited)
+	require.Greater(t, atomic.LoadInt32(&syncs), before)
+
+	// 同期されない場合はコンテキストの期限で戻る
+	require.NoError(t, log.Close())
+	c.Segment.IndexSyncInterval = 0
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.WaitForSync(ctx, off))
+
+	// 明示的にSyncすると戻る
+	require.NoError(t, log.Sync())
+	require.NoError(t, log.WaitForSync(context.Background(), off))
+}
+
+// 書き出されていないバイト数がSyncで0になるか
+func TestLogUnflushedBytes(t *testing.T) {
+	log := newTestLog(t, Config{})
+	require.Equal(t, uint64(0), log.UnflushedBytes())
+
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, log.activeSegment.store.size, log.UnflushedBytes())
+
+	require.NoError(t, log.Sync())
+	require.Equal(t, uint64(0), log.UnflushedBytes())
+}
+
+// Flushでバッファの内容がファイルに書き出され、同期はされないか
+func TestLogFlush(t *testing.T) {
+	var synced int32
+	orig := indexSync
+	defer func() { indexSync = orig }()
+	indexSync = func(i *index) error {
+		atomic.AddInt32(&synced, 1)
+		return orig(i)
+	}
+
+	log := newTestLog(t, Config{})
+	dir := log.Dir
+
+	want := &api.Record{Value: []byte("hello world")}
+	_, err := log.Append(want)
+	require.NoError(t, err)
+	require.NotZero(t, log.UnflushedBytes())
+
+	require.NoError(t, log.Flush())
+	require.Zero(t, log.UnflushedBytes())
+	require.Zero(t, atomic.LoadInt32(&synced))
+
+	// 別のプロセスと同じく、ファイルを直接読み出しても最新のレコードが見える
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, int(log.activeSegment.store.size), len(b))
+
+	// Readerも最新のレコードまで読み出せる
+	b, err = io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	read := &api.Record{}
+	require.NoError(t, proto.Unmarshal(b[lenWidth:], read))
+	require.Equal(t, want.Value, read.Value)
+
+	// 同期はしていないので、永続化済みのオフセットは進まない
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, log.WaitForSync(ctx, 0), context.DeadlineExceeded)
+}
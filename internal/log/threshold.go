@@ -0,0 +1,114 @@
+package log
+
+import "errors"
+
+// errDiskFreeUnsupported 空き容量を取得できない環境やファイルシステムで返すエラー
+var errDiskFreeUnsupported = errors.New("disk free is not supported")
+
+// Stats ログ全体の大きさと、ログのディレクトリがあるファイルシステムの空き容量
+type Stats struct {
+	// Segments セグメントの数
+	Segments int
+	// TotalBytes 各セグメントのストアとインデックスに書き込んだバイト数の合計
+	TotalBytes uint64
+	// DiskFree ファイルシステムの空き容量。取得できない場合は0
+	DiskFree uint64
+}
+
+// Stats ログの現在の大きさとディスクの空き容量を返す
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	stats := l.stats()
+	l.mu.RUnlock()
+
+	stats.DiskFree, _ = l.diskFree()
+	return stats
+}
+
+// stats セグメントの数と書き込んだバイト数を返す。ロックを獲得した状態で呼び出す
+func (l *Log) stats() Stats {
+	stats := Stats{Segments: len(l.segments)}
+	for _, s := range l.segments {
+		stats.TotalBytes += s.store.size + s.index.size
+	}
+	return stats
+}
+
+// diskFree ログのディレクトリがあるファイルシステムの空き容量を返す。OS以外のファイルシステムでは取得できない
+func (l *Log) diskFree() (uint64, error) {
+	if l.Config.FS != nil {
+		return 0, errDiskFreeUnsupported
+	}
+	return diskFree(l.Dir)
+}
+
+// ThresholdKind OnThresholdを呼び出す条件の種類
+type ThresholdKind int
+
+const (
+	// ThresholdTotalBytes 書き込んだバイト数の合計がThresholds.TotalBytes以上になった
+	ThresholdTotalBytes ThresholdKind = iota
+	// ThresholdSegments セグメントの数がThresholds.Segments以上になった
+	ThresholdSegments
+	// ThresholdDiskFree ディスクの空き容量がThresholds.MinDiskFreeを下回った
+	ThresholdDiskFree
+)
+
+func (k ThresholdKind) String() string {
+	switch k {
+	case ThresholdTotalBytes:
+		return "total_bytes"
+	case ThresholdSegments:
+		return "segments"
+	case ThresholdDiskFree:
+		return "disk_free"
+	}
+	return "unknown"
+}
+
+// ThresholdEvent OnThresholdに渡す、しきい値を超えたか元に戻ったことを表すイベント
+type ThresholdEvent struct {
+	Kind ThresholdKind
+	// Value しきい値と比べた現在の値
+	Value uint64
+	// Limit 設定されたしきい値
+	Limit uint64
+	// Cleared しきい値を超えた状態から元に戻った場合はtrue
+	Cleared bool
+}
+
+// checkThresholds 現在の大きさをしきい値と比べ、状態が変わったものについてOnThresholdを呼び出す。
+// 追加のたびに呼び出さないよう、しきい値を超えたときと元に戻ったときにだけ呼び出す。ロックを獲得した状態で呼び出す
+func (l *Log) checkThresholds() {
+	if l.Config.OnThreshold == nil {
+		return
+	}
+	t := l.Config.Thresholds
+	stats := l.stats()
+
+	l.thresholdMu.Lock()
+	defer l.thresholdMu.Unlock()
+
+	update := func(kind ThresholdKind, value, limit uint64, crossed bool) {
+		if l.thresholdCrossed == nil {
+			l.thresholdCrossed = make(map[ThresholdKind]bool)
+		}
+		if l.thresholdCrossed[kind] == crossed {
+			return
+		}
+		l.thresholdCrossed[kind] = crossed
+		l.Config.OnThreshold(ThresholdEvent{Kind: kind, Value: value, Limit: limit, Cleared: !crossed})
+	}
+	if t.TotalBytes > 0 {
+		update(ThresholdTotalBytes, stats.TotalBytes, t.TotalBytes, stats.TotalBytes >= t.TotalBytes)
+	}
+	if t.Segments > 0 {
+		update(ThresholdSegments, uint64(stats.Segments), uint64(t.Segments), stats.Segments >= t.Segments)
+	}
+	if t.MinDiskFree > 0 {
+		// 空き容量を取得できない場合は判定しない
+		if free, err := l.diskFree(); err == nil {
+			update(ThresholdDiskFree, free, t.MinDiskFree, free < t.MinDiskFree)
+		}
+	}
+}
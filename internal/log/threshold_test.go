@@ -0,0 +1,43 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// しきい値を超えたときに一度だけOnThresholdが呼び出され、元に戻ると再び呼び出されるか
+func TestLogOnThreshold(t *testing.T) {
+	var events []ThresholdEvent
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Thresholds.Segments = 3
+	c.OnThreshold = func(e ThresholdEvent) {
+		events = append(events, e)
+	}
+	log := newTestLog(t, c)
+
+	// 1つのセグメントに2件格納できるので、5件目で3つ目のセグメントに切り替わる
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Empty(t, events)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []ThresholdEvent{
+		{Kind: ThresholdSegments, Value: 3, Limit: 3},
+	}, events)
+	require.Equal(t, 5, log.Stats().Segments)
+
+	// 古いセグメントを削除して下回ると、元に戻ったことを通知する
+	require.NoError(t, log.Truncate(5))
+	require.Equal(t, []ThresholdEvent{
+		{Kind: ThresholdSegments, Value: 3, Limit: 3},
+		{Kind: ThresholdSegments, Value: 2, Limit: 3, Cleared: true},
+	}, events)
+}
@@ -0,0 +1,26 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// ttlNow レコードの有効期間を判定する現在時刻。テストで時間を進めるために変数にしている
+var ttlNow = time.Now
+
+// expired レコードの有効期間が過ぎているかを判定する。TTLが0のレコードは期限切れにならない
+func expired(record *api.Record) bool {
+	return record.Ttl > 0 && record.Timestamp+record.Ttl <= ttlNow().UnixNano()
+}
+
+// liveRecord 読み出したレコードの有効期間が過ぎている場合は、ErrRecordExpiredを返す
+func liveRecord(record *api.Record, err error) (*api.Record, error) {
+	if err != nil {
+		return nil, err
+	}
+	if expired(record) {
+		return nil, api.ErrRecordExpired{Offset: record.Offset}
+	}
+	return record, nil
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+func TestLogRecordTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ttlNow = func() time.Time { return now }
+	defer func() { ttlNow = time.Now }()
+
+	log := newTestLog(t, Config{})
+
+	// 時刻のないレコードには追加した時刻が付与される
+	short, err := log.Append(&api.Record{Value: []byte("short"), Ttl: int64(time.Second)})
+	require.NoError(t, err)
+	forever, err := log.Append(&api.Record{Value: []byte("forever")})
+	require.NoError(t, err)
+
+	// 有効期間内は読み出せる
+	record, err := log.Read(short)
+	require.NoError(t, err)
+	require.Equal(t, []byte("short"), record.Value)
+	require.Equal(t, now.UnixNano(), record.Timestamp)
+
+	// 有効期間を過ぎると、どの読み出し方でも期限切れになる
+	now = now.Add(time.Second)
+	_, err = log.Read(short)
+	require.Equal(t, api.ErrRecordExpired{Offset: short}, err)
+	_, _, err = log.ReadWithPosition(short)
+	require.Equal(t, api.ErrRecordExpired{Offset: short}, err)
+	require.Equal(t, api.ErrRecordExpired{Offset: short}, log.ReadInto(short, &api.Record{}))
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// 順に読み出す場合は、期限切れのレコードを読み飛ばす
+	record, err = log.Iterator().Next()
+	require.NoError(t, err)
+	require.Equal(t, forever, record.Offset)
+	sub := &Subscription{log: log, next: short}
+	record, err = sub.Next(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, forever, record.Offset)
+	records, next, err := log.ReadUpToBytes(short, 1024)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, forever, records[0].Offset)
+	require.Equal(t, forever+1, next)
+	records, err = log.ReadSegment(0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, forever, records[0].Offset)
+	_, err = log.FindLast(forever, func(r *api.Record) bool { return r.Offset == short })
+	require.Equal(t, api.ErrNoMatchingRecord{From: forever}, err)
+
+	// 有効期間のないレコードは期限切れにならない
+	record, err = log.Read(forever)
+	require.NoError(t, err)
+	require.Equal(t, []byte("forever"), record.Value)
+
+	// 詰め直すと値が取り除かれ、オフセットは保たれる
+	require.NoError(t, log.CompactAndSwap())
+	_, err = log.Read(short)
+	require.Equal(t, api.ErrRecordExpired{Offset: short}, err)
+	raw, err := log.activeSegment.Read(short)
+	require.NoError(t, err)
+	require.Empty(t, raw.Value)
+	require.True(t, raw.Compacted)
+	record, err = log.Read(forever)
+	require.NoError(t, err)
+	require.Equal(t, forever, record.Offset)
+}
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// SegmentReader WalkSegmentsで渡される、1つのセグメントのレコードをオフセット順に読み出すリーダー
+type SegmentReader interface {
+	BaseOffset() uint64
+	// NextOffset セグメントの最後のレコードの次のオフセットを返す
+	NextOffset() uint64
+	// Next 次のレコードを返す。セグメントの末尾に達した場合はio.EOFを返す
+	Next() (*api.Record, error)
+}
+
+// segmentFiles WalkSegmentsを呼び出した時点のセグメントの範囲とファイル
+type segmentFiles struct {
+	baseOffset, nextOffset uint64
+	storePath, indexPath   string
+}
+
+// WalkSegments セグメントのファイルをオフセット順に1つずつ開いてfnに渡し、fnが返ると閉じてから次のセグメントに進む。
+// 開いたままのセグメントとは別にファイルを開くので、同時に開くのは1つのセグメントのファイルだけで済む。
+// アクティブセグメントは最後に渡し、呼び出した後に追加されたレコードは含まない。fnがエラーを返した場合は、そのエラーを返して終了する
+func (l *Log) WalkSegments(fn func(SegmentReader) error) error {
+	// INFO: ロックを獲得している間に対象のセグメントを決め、バッファの内容を書き出しておく。
+	//  読み出している間は書き込みを妨げないよう、ロックを解放してからファイルを開く
+	l.mu.RLock()
+	if err := l.flushSegments(); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	segments := make([]segmentFiles, 0, len(l.segments))
+	for _, s := range l.segments {
+		segments = append(segments, segmentFiles{
+			baseOffset: s.baseOffset,
+			nextOffset: s.nextOffset,
+			storePath:  s.store.Name(),
+			indexPath:  s.index.Name(),
+		})
+	}
+	fsys := l.Config.fs()
+	l.mu.RUnlock()
+
+	for _, s := range segments {
+		if err := walkSegment(fsys, s, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSegment セグメントのファイルを開いてfnに渡し、fnが返ったら閉じる
+func walkSegment(fsys FS, s segmentFiles, fn func(SegmentReader) error) error {
+	store, err := fsys.OpenFile(s.storePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	index, err := fsys.OpenFile(s.indexPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	return fn(&segmentReader{
+		files: s,
+		store: store,
+		index: index,
+		off:   s.baseOffset,
+	})
+}
+
+type segmentReader struct {
+	files segmentFiles
+	store File
+	index File
+	// off 次に読み出すレコードのオフセット
+	off uint64
+}
+
+func (r *segmentReader) BaseOffset() uint64 {
+	return r.files.baseOffset
+}
+
+func (r *segmentReader) NextOffset() uint64 {
+	return r.files.nextOffset
+}
+
+func (r *segmentReader) Next() (*api.Record, error) {
+	if r.off >= r.files.nextOffset {
+		return nil, io.EOF
+	}
+
+	// インデックスのエントリからストア内の位置を求める
+	entry := make([]byte, entWidth)
+	if _, err := r.index.ReadAt(entry, int64((r.off-r.files.baseOffset)*entWidth)); err != nil {
+		return nil, err
+	}
+	pos := enc.Uint64(entry[offWidth:])
+
+	size := make([]byte, lenWidth)
+	if _, err := r.store.ReadAt(size, int64(pos)); err != nil {
+		return nil, err
+	}
+	p := make([]byte, enc.Uint64(size))
+	if _, err := r.store.ReadAt(p, int64(pos+lenWidth)); err != nil {
+		return nil, err
+	}
+
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	if err := decodeValue(record); err != nil {
+		return nil, err
+	}
+	// 重複排除したレコードはオフセットを持たないので、インデックスの位置から設定する
+	record.Offset = r.off
+	r.off++
+	return record, nil
+}
@@ -0,0 +1,87 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// trackingFS 開いているファイルの数を数えるFS
+type trackingFS struct {
+	FS
+	open int32
+}
+
+func (t *trackingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := t.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&t.open, 1)
+	return &trackedFile{File: f, fs: t}, nil
+}
+
+type trackedFile struct {
+	File
+	fs *trackingFS
+}
+
+func (f *trackedFile) Close() error {
+	atomic.AddInt32(&f.fs.open, -1)
+	return f.File.Close()
+}
+
+// セグメントを1つずつ開きながら、すべてのレコードを一度ずつ読み出せるか
+func TestLogWalkSegments(t *testing.T) {
+	fsys := &trackingFS{FS: osFS{}}
+	c := Config{FS: fsys}
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	// 1セグメントに2件ずつ格納される
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// ログ自身が開いているファイルは数えない
+	baseline := atomic.LoadInt32(&fsys.open)
+
+	var bases []uint64
+	var offsets []uint64
+	err := log.WalkSegments(func(r SegmentReader) error {
+		// 同時に開いているのは1つのセグメントのストアとインデックスだけ
+		require.Equal(t, baseline+2, atomic.LoadInt32(&fsys.open))
+		bases = append(bases, r.BaseOffset())
+		for {
+			record, err := r.Next()
+			if err == io.EOF {
+				return nil
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", record.Offset)), record.Value)
+			offsets = append(offsets, record.Offset)
+		}
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2, 4}, bases)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+	require.Equal(t, baseline, atomic.LoadInt32(&fsys.open))
+
+	// fnのエラーで途中で終了し、開いたファイルは閉じられる
+	stop := errors.New("stop")
+	var visited int
+	err = log.WalkSegments(func(r SegmentReader) error {
+		visited++
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 1, visited)
+	require.Equal(t, baseline, atomic.LoadInt32(&fsys.open))
+}
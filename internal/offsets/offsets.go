@@ -0,0 +1,119 @@
+package offsets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Store コンシューマグループごとにコミットされたオフセットを記録する
+type Store struct {
+	mu        sync.Mutex
+	path      string
+	committed map[string]uint64
+}
+
+// New pathにあるファイルからコミット済みのオフセットを復元してStoreを作成する
+func New(path string) (*Store, error) {
+	s := &Store{
+		path:      path,
+		committed: make(map[string]uint64),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &s.committed); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Commit グループのオフセットをoffsetにする。forceがfalseの場合、コミット済みのオフセットより小さい値はFailedPreconditionで拒否する
+func (s *Store) Commit(group string, offset uint64, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.committed[group]
+	if ok && offset < prev && !force {
+		msg := fmt.Sprintf(
+			"group %s cannot commit offset %d before committed offset %d",
+			group,
+			offset,
+			prev,
+		)
+		st := status.New(codes.FailedPrecondition, msg)
+		return st.Err()
+	}
+
+	s.committed[group] = offset
+	if err := s.persist(); err != nil {
+		// 永続化に失敗した場合は、コミットしたオフセットを元に戻す
+		if ok {
+			s.committed[group] = prev
+		} else {
+			delete(s.committed, group)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Committed グループのコミット済みのオフセットを返す。コミットされていない場合はNotFoundを返す
+func (s *Store) Committed(group string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.committed[group]
+	if !ok {
+		st := status.New(codes.NotFound, fmt.Sprintf("group %s has no committed offset", group))
+		return 0, st.Err()
+	}
+	return offset, nil
+}
+
+// persist オフセットを一時ファイルに書き込んで同期してからリネームし、コミットが失われないようにする
+func (s *Store) persist() error {
+	b, err := json.Marshal(s.committed)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	// INFO: リネームを永続化するため、親ディレクトリも同期する
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
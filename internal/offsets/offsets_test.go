@@ -0,0 +1,49 @@
+package offsets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "offsets.json")
+	s, err := New(path)
+	require.NoError(t, err)
+
+	// コミットされていないグループはNotFound
+	_, err = s.Committed("billing")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	require.NoError(t, s.Commit("billing", 5, false))
+	off, err := s.Committed("billing")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// 戻す方向のコミットは拒否され、強制した場合のみ受け付ける
+	err = s.Commit("billing", 3, false)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.NoError(t, s.Commit("billing", 5, false))
+	require.NoError(t, s.Commit("billing", 3, true))
+
+	// 別のグループは影響を受けない
+	require.NoError(t, s.Commit("search", 10, false))
+
+	// 再起動後もファイルから復元される
+	s, err = New(path)
+	require.NoError(t, err)
+	off, err = s.Committed("billing")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = s.Committed("search")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
@@ -0,0 +1,235 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// persistInterval 使用量をサイドカーファイルに書き出す間隔。書き込みのたびにファイルを書き換えないよう、まとめて書き出す
+const persistInterval = time.Second
+
+// Accountant サブジェクトごとにログに保存しているバイト数を記録し、上限を超える書き込みを拒否する。
+// 書き込んだバイト数をトピックのセグメントとサブジェクトごとにまとめて記録し、セグメントが削除されるとその分を使用量から差し引く。
+// 記録の大きさはレコードの数ではなく、セグメントとサブジェクトの数に比例する
+type Accountant struct {
+	mu    sync.Mutex
+	path  string
+	limit uint64
+	usage map[string]uint64
+	// charges トピックごとの、セグメントに書き込んだバイト数の記録。ベースオフセット順に並んでいる
+	charges map[string][]segmentCharge
+	// dirty 最後に書き出してから使用量が変わった場合はtrue
+	dirty bool
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// segmentCharge 1つのセグメントに書き込んだ、サブジェクトごとのバイト数
+type segmentCharge struct {
+	Base  uint64            `json:"base"`
+	Bytes map[string]uint64 `json:"bytes"`
+}
+
+// New pathにあるサイドカーファイルから使用量を復元してAccountantを作成する。
+// 使用量はバックグラウンドで定期的に書き出すので、使い終わったらCloseで書き出しを終えること
+func New(path string, limit uint64) (*Accountant, error) {
+	a := &Accountant{
+		path:    path,
+		limit:   limit,
+		usage:   make(map[string]uint64),
+		charges: make(map[string][]segmentCharge),
+		done:    make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &a.charges); err != nil {
+			return nil, err
+		}
+	}
+	// 使用量はセグメントごとの記録から求め直す
+	for _, charges := range a.charges {
+		for _, c := range charges {
+			for subject, n := range c.Bytes {
+				a.usage[subject] += n
+			}
+		}
+	}
+
+	a.wg.Add(1)
+	go a.persistLoop()
+	return a, nil
+}
+
+// Allow サブジェクトがさらにnバイトを書き込めるかを確認する。上限を超える場合はResourceExhaustedを返す
+func (a *Accountant) Allow(subject string, n uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used := a.usage[subject]
+	if used+n > a.limit {
+		msg := fmt.Sprintf(
+			"%s exceeded quota: used %d of %d bytes",
+			subject,
+			used,
+			a.limit,
+		)
+		st := status.New(codes.ResourceExhausted, msg)
+		return st.Err()
+	}
+	return nil
+}
+
+// Charge トピックのベースオフセットがsegmentのセグメントに追加したnバイトのレコードを、サブジェクトの使用量に加える。追加に成功した後に呼び出す
+func (a *Accountant) Charge(subject, topic string, segment, n uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	charges := a.charges[topic]
+	// INFO: ほとんどの書き込みはアクティブセグメントへのものなので、最後の記録から確認する。
+	//  同時に書き込んだリクエストは追加した順に呼び出されるとは限らないので、見つからない場合はベースオフセット順の位置に挿入する
+	i := len(charges) - 1
+	if i < 0 || charges[i].Base != segment {
+		i = sort.Search(len(charges), func(i int) bool {
+			return charges[i].Base >= segment
+		})
+		if i == len(charges) || charges[i].Base != segment {
+			charges = append(charges, segmentCharge{})
+			copy(charges[i+1:], charges[i:])
+			charges[i] = segmentCharge{Base: segment, Bytes: make(map[string]uint64)}
+			a.charges[topic] = charges
+		}
+	}
+	charges[i].Bytes[subject] += n
+
+	a.usage[subject] += n
+	a.dirty = true
+}
+
+// Release トピックのベースオフセットがlowestより前のセグメントに書き込んだ分を、サブジェクトの使用量から差し引く。
+// ログのConfig.OnSegmentsRemovedに設定し、セグメントが削除されたときに残っている最初のセグメントのベースオフセットとともに呼び出されるようにする
+func (a *Accountant) Release(topic string, lowest uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	charges := a.charges[topic]
+	i := sort.Search(len(charges), func(i int) bool {
+		return charges[i].Base >= lowest
+	})
+	if i == 0 {
+		return
+	}
+	for _, c := range charges[:i] {
+		for subject, n := range c.Bytes {
+			if a.usage[subject] <= n {
+				delete(a.usage, subject)
+				continue
+			}
+			a.usage[subject] -= n
+		}
+	}
+	if i == len(charges) {
+		delete(a.charges, topic)
+	} else {
+		a.charges[topic] = append([]segmentCharge(nil), charges[i:]...)
+	}
+	a.dirty = true
+}
+
+// Usage サブジェクトの現在の使用量を返す
+func (a *Accountant) Usage(subject string) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.usage[subject]
+}
+
+// Flush 最後に書き出してから使用量が変わっている場合は、サイドカーファイルに書き出す
+func (a *Accountant) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.dirty {
+		return nil
+	}
+	if err := a.persist(); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// Close バックグラウンドの書き出しを停止し、残っている使用量を書き出す
+func (a *Accountant) Close() error {
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+	}
+	a.wg.Wait()
+	return a.Flush()
+}
+
+// persistLoop persistIntervalごとに使用量を書き出す
+func (a *Accountant) persistLoop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			// 失敗した場合でも、次の周期かClose時に改めて書き出される
+			_ = a.Flush()
+		}
+	}
+}
+
+// persist 記録を一時ファイルに書き込んで同期してからリネームし、書き込み途中の状態が残らないようにする。ロックを獲得した状態で呼び出す
+func (a *Accountant) persist() error {
+	b, err := json.Marshal(a.charges)
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+
+	// INFO: リネームを永続化するため、親ディレクトリも同期する
+	dir, err := os.Open(filepath.Dir(a.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,73 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccountant(t *testing.T) {
+	dir, err := os.MkdirTemp("", "quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "quota.json")
+	a, err := New(path, 10)
+	require.NoError(t, err)
+
+	// 上限までは書き込める
+	require.NoError(t, a.Allow("root", 6))
+	a.Charge("root", "", 0, 6)
+	require.NoError(t, a.Allow("root", 4))
+	a.Charge("root", "", 2, 4)
+
+	// 上限を超えるサブジェクトは拒否される
+	err = a.Allow("root", 1)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, uint64(10), a.Usage("root"))
+
+	// 別のサブジェクトは影響を受けない
+	require.NoError(t, a.Allow("nobody", 5))
+	a.Charge("nobody", "", 2, 2)
+	a.Charge("nobody", "", 2, 3)
+
+	// 同じセグメントへの書き込みはまとめて記録される
+	require.Len(t, a.charges[""], 2)
+	require.Equal(t, map[string]uint64{"root": 4, "nobody": 5}, a.charges[""][1].Bytes)
+
+	// 前のセグメントへの書き込みが後から記録されても、ベースオフセット順に保たれる
+	a.Charge("nobody", "", 1, 0)
+	require.Len(t, a.charges[""], 3)
+	require.Equal(t, uint64(1), a.charges[""][1].Base)
+
+	// 閉じるまでに使用量が書き出され、再起動後もサイドカーファイルから復元される
+	require.NoError(t, a.Close())
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+	a, err = New(path, 10)
+	require.NoError(t, err)
+	defer a.Close()
+	require.Equal(t, uint64(10), a.Usage("root"))
+	require.Equal(t, uint64(5), a.Usage("nobody"))
+	err = a.Allow("root", 1)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// 削除されたセグメントに書き込んだ分は使用量から差し引かれる
+	a.Release("", 2)
+	require.Equal(t, uint64(4), a.Usage("root"))
+	require.Equal(t, uint64(5), a.Usage("nobody"))
+	require.NoError(t, a.Allow("root", 6))
+
+	// 別のトピックの削除は影響しない
+	a.Release("other", 3)
+	require.Equal(t, uint64(4), a.Usage("root"))
+
+	a.Release("", ^uint64(0))
+	require.Equal(t, uint64(0), a.Usage("root"))
+	require.Equal(t, uint64(0), a.Usage("nobody"))
+	require.Empty(t, a.charges)
+}
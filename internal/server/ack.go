@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+)
+
+// ackWindow ConsumeStreamで送信したがackされていないレコードを管理する
+type ackWindow struct {
+	// max ackされていないレコードの上限。0の場合は制限しない
+	max uint64
+	// acks クライアントから受信したackのオフセット。クライアントが送信を終えるとクローズされる
+	acks <-chan uint64
+	// pending 送信してackされていないレコードのオフセット(送信順)
+	pending []uint64
+	// highest これまでにackされた最大のオフセット
+	highest uint64
+	acked   bool
+	// onAck 最大のオフセットが更新されたときに呼び出される
+	onAck func(offset uint64)
+}
+
+// wait ackされていないレコードが上限未満になるまで待つ。
+// クライアントがこれ以上ackを送らない場合やctxが終了した場合はfalseを返す
+func (w *ackWindow) wait(ctx context.Context) bool {
+	// 届いているackを先に反映する
+drain:
+	for w.acks != nil {
+		select {
+		case off, ok := <-w.acks:
+			if !ok {
+				w.acks = nil
+				break drain
+			}
+			w.ack(off)
+		default:
+			break drain
+		}
+	}
+
+	for w.max != 0 && uint64(len(w.pending)) >= w.max {
+		if w.acks == nil {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case off, ok := <-w.acks:
+			if !ok {
+				w.acks = nil
+				continue
+			}
+			w.ack(off)
+		}
+	}
+	return true
+}
+
+// sent offsetのレコードを送信したことを記録する
+func (w *ackWindow) sent(offset uint64) {
+	if w.max == 0 {
+		return
+	}
+	w.pending = append(w.pending, offset)
+}
+
+// ack 送信したレコードのうちoffsetまでをackされたものとする
+func (w *ackWindow) ack(offset uint64) {
+	// INFO: 送信していないオフセットや、まとめて先のオフセットをackされる場合もあるので、offset以下をすべて取り除く
+	pending := w.pending[:0]
+	for _, off := range w.pending {
+		if off > offset {
+			pending = append(pending, off)
+		}
+	}
+	w.pending = pending
+	if !w.acked || offset > w.highest {
+		w.highest, w.acked = offset, true
+		if w.onAck != nil {
+			w.onAck(offset)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/stats"
+
+	"github.com/radish-miyazaki/proglog/internal/auth"
+)
+
+// cachingAuthorizer 接続ごとに認可の判定をキャッシュできるAuthorizer
+type cachingAuthorizer interface {
+	Authorizer
+	NewCache() *auth.Cache
+}
+
+type authCacheContextKey struct{}
+
+var _ stats.Handler = (*authCacheHandler)(nil)
+
+// authCacheHandler 接続ごとに認可のキャッシュを作成してコンテキストに格納する。
+// サブジェクトはTLSの接続ごとに決まるので、同じ接続のRPCでは同じ判定を使い回せる
+type authCacheHandler struct {
+	authorizer cachingAuthorizer
+}
+
+func (h *authCacheHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, authCacheContextKey{}, h.authorizer.NewCache())
+}
+
+func (h *authCacheHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *authCacheHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (h *authCacheHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+// authorizer 接続のキャッシュがある場合はそれを、ない場合は設定のAuthorizerを返す。
+// EventBusが設定されている場合は、拒否をイベントとして発行する
+func (s *grpcServer) authorizer(ctx context.Context) Authorizer {
+	var a Authorizer = s.Authorizer
+	if cache, ok := ctx.Value(authCacheContextKey{}).(*auth.Cache); ok {
+		a = cache
+	}
+	if s.EventBus != nil {
+		return eventAuthorizer{Authorizer: a, bus: s.EventBus}
+	}
+	return a
+}
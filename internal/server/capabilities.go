@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"sort"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// Version サーバのビルドバージョン。ビルド時に -ldflags "-X" で上書きする
+var Version = "dev"
+
+// Capabilitiesで返す機能名
+const (
+	FeatureTopics              = "topics"
+	FeatureQuota               = "quota"
+	FeatureExpectedOffset      = "expected_offset"
+	FeatureSchemaVersionFilter = "schema_version_filter"
+	FeatureFollow              = "follow"
+	FeatureOffsetRange         = "offset_range"
+	FeatureReverse             = "reverse"
+	FeatureCommittedOffsets    = "committed_offsets"
+	FeatureNewOnly             = "new_only"
+	FeatureProduceSync         = "produce_sync"
+	FeatureValueFilter         = "value_filter"
+	FeatureMetadata            = "metadata"
+	FeatureReplicateSegments   = "replicate_segments"
+	FeatureWatermarks          = "watermarks"
+	FeatureProduceStats        = "produce_stats"
+	FeatureEvents              = "events"
+	FeatureDeadLetter          = "dead_letter"
+)
+
+// Capabilities サーバのバージョンと、設定から有効になっている機能の一覧を返す
+func (s *grpcServer) Capabilities(ctx context.Context, req *api.CapabilitiesRequest) (*api.CapabilitiesResponse, error) {
+	return &api.CapabilitiesResponse{
+		Version:  Version,
+		Features: s.features(),
+	}, nil
+}
+
+func (s *grpcServer) features() []string {
+	features := []string{
+		FeatureExpectedOffset,
+		FeatureSchemaVersionFilter,
+		FeatureFollow,
+		FeatureOffsetRange,
+		FeatureReverse,
+		FeatureNewOnly,
+		FeatureProduceSync,
+		FeatureValueFilter,
+		FeatureMetadata,
+		FeatureReplicateSegments,
+		FeatureWatermarks,
+		FeatureProduceStats,
+	}
+	if s.Topics != nil {
+		features = append(features, FeatureTopics)
+	}
+	if s.Quota != nil {
+		features = append(features, FeatureQuota)
+	}
+	if s.Offsets != nil {
+		features = append(features, FeatureCommittedOffsets)
+	}
+	if s.EventBus != nil {
+		features = append(features, FeatureEvents)
+	}
+	if s.DeadLetterTopic != "" {
+		features = append(features, FeatureDeadLetter)
+	}
+	sort.Strings(features)
+
+	return features
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// ConnectionInfo 接続しているクライアントの情報
+type ConnectionInfo struct {
+	// Addr クライアントのアドレス
+	Addr string
+	// Subject 最後のRPCで認証したサブジェクト。まだRPCを呼び出していない場合は空
+	Subject string
+	// ConnectedAt 接続した時刻
+	ConnectedAt time.Time
+	// ActiveStreams 処理中のストリーミングRPCの数
+	ActiveStreams int
+}
+
+// ConnectionTracker 接続しているクライアントを記録する。Configに設定すると、NewGRPCServerで作成したサーバの接続を記録する
+type ConnectionTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+// trackedConn 記録している接続。ConnectionTrackerのロックで保護する
+type trackedConn struct {
+	info ConnectionInfo
+}
+
+// Connections 接続しているクライアントの一覧を、接続した順に返す
+func (t *ConnectionTracker) Connections() []ConnectionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := make([]ConnectionInfo, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c.info)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns
+}
+
+// update ctxの接続の情報をfnで更新する。記録していない接続の場合は何もしない
+func (t *ConnectionTracker) update(ctx context.Context, fn func(*ConnectionInfo)) {
+	c, ok := ctx.Value(trackedConnContextKey{}).(*trackedConn)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&c.info)
+}
+
+type trackedConnContextKey struct{}
+
+var _ stats.Handler = (*connStatsHandler)(nil)
+
+// connStatsHandler 接続の確立と切断をConnectionTrackerに記録する
+type connStatsHandler struct {
+	tracker *ConnectionTracker
+}
+
+func (h *connStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	c := &trackedConn{info: ConnectionInfo{
+		Addr:        info.RemoteAddr.String(),
+		ConnectedAt: time.Now(),
+	}}
+
+	h.tracker.mu.Lock()
+	h.tracker.conns[c] = struct{}{}
+	h.tracker.mu.Unlock()
+
+	return context.WithValue(ctx, trackedConnContextKey{}, c)
+}
+
+func (h *connStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *connStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnEnd); !ok {
+		return
+	}
+	if c, ok := ctx.Value(trackedConnContextKey{}).(*trackedConn); ok {
+		h.tracker.mu.Lock()
+		delete(h.tracker.conns, c)
+		h.tracker.mu.Unlock()
+	}
+}
+
+func (h *connStatsHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+// connectionTracker 認証したサブジェクトと処理中のストリーミングRPCの数を接続の情報に記録するInterceptorを返す。
+// INFO: サブジェクトを使うので、認証の後に置く
+func connectionTracker(t *ConnectionTracker) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	unary := func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		t.update(ctx, func(c *ConnectionInfo) {
+			c.Subject = subject(ctx)
+		})
+		return handler(ctx, req)
+	}
+
+	stream := func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx := stream.Context()
+		t.update(ctx, func(c *ConnectionInfo) {
+			c.Subject = subject(ctx)
+			c.ActiveStreams++
+		})
+		defer t.update(ctx, func(c *ConnectionInfo) {
+			c.ActiveStreams--
+		})
+		return handler(srv, stream)
+	}
+
+	return unary, stream
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ProduceDeadLetter 処理に失敗したレコードに元のトピックとオフセット、理由のヘッダーを付与し、DeadLetterTopicに追加する。
+// 書き込みの認可やクォータはデッドレターのトピックへのProduceとして扱う
+func (s *grpcServer) ProduceDeadLetter(ctx context.Context, req *api.ProduceDeadLetterRequest) (*api.ProduceResponse, error) {
+	if s.DeadLetterTopic == "" {
+		return nil, status.New(codes.Unimplemented, "dead letter topic is not configured").Err()
+	}
+	if req.Record == nil {
+		return nil, status.New(codes.InvalidArgument, "record is required").Err()
+	}
+
+	return s.produce(ctx, &api.ProduceRequest{
+		Record: api.NewDeadLetterRecord(req.Record, req.SourceTopic, req.Error),
+		Topic:  s.DeadLetterTopic,
+	}, false)
+}
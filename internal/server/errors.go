@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errToStatus ハンドラが返したエラーを、クライアントに返すgRPCのステータスに変換する。
+// ラップされた型付きのエラーも取り出し、詳細を持たない場合は理由を示すErrorInfoを付与する
+func errToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return status.New(codes.Internal, err.Error()).Err()
+	}
+	st := se.GRPCStatus()
+	if len(st.Details()) > 0 {
+		return st.Err()
+	}
+	reason := errorReason(se)
+	if reason == "" {
+		return st.Err()
+	}
+	std, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: "proglog",
+	})
+	if derr != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
+
+// errorReason ログの型付きのエラーに対応するErrorInfoの理由を返す。対応しないエラーの場合は空文字を返す
+func errorReason(err interface{}) string {
+	switch err.(type) {
+	case api.ErrOffsetOutOfRange:
+		return "OFFSET_OUT_OF_RANGE"
+	case api.ErrOffsetUnavailable:
+		return "OFFSET_UNAVAILABLE"
+	case api.ErrIndexUnhealthy:
+		return "INDEX_UNHEALTHY"
+	case api.ErrDiskFull:
+		return "DISK_FULL"
+	case api.ErrReadOnlyFilesystem:
+		return "READ_ONLY_FILESYSTEM"
+	case api.ErrCircuitOpen:
+		return "CIRCUIT_OPEN"
+	case api.ErrLogClosed:
+		return "LOG_CLOSED"
+	case api.ErrReadScanLimit:
+		return "READ_SCAN_LIMIT"
+	case api.ErrOffsetNotSynced:
+		return "OFFSET_NOT_SYNCED"
+	case api.ErrHighestMismatch:
+		return "HIGHEST_MISMATCH"
+	case api.ErrRecordTooLarge:
+		return "RECORD_TOO_LARGE"
+	case api.ErrInvalidRecord:
+		return "INVALID_RECORD"
+	case api.ErrInvalidTopic:
+		return "INVALID_TOPIC"
+	case api.ErrTooManyTopics:
+		return "TOO_MANY_TOPICS"
+	case api.ErrSegmentNotFound:
+		return "SEGMENT_NOT_FOUND"
+	case api.ErrKeyNotFound:
+		return "KEY_NOT_FOUND"
+	case api.ErrRecordExpired:
+		return "RECORD_EXPIRED"
+	case api.ErrNoMatchingRecord:
+		return "NO_MATCHING_RECORD"
+	}
+	return ""
+}
+
+func errorUnaryServerInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, errToStatus(err)
+}
+
+func errorStreamServerInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return errToStatus(handler(srv, stream))
+}
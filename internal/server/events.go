@@ -0,0 +1,78 @@
+package server
+
+import (
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/auth"
+	"github.com/radish-miyazaki/proglog/internal/events"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// eventsBuffer Eventsのストリームごとに、送信を待たずに溜めておけるイベントの数
+const eventsBuffer = 256
+
+// Events 購読を開始した後に発行されたイベントを、ストリームが終了するまで送り続ける。
+// 購読を開始してからヘッダーを送るので、クライアントはヘッダーを受け取った後に起きたイベントを取りこぼさない
+func (s *grpcServer) Events(req *api.EventsRequest, stream api.Log_EventsServer) error {
+	ctx := stream.Context()
+	if err := s.authorizer(ctx).Authorize(
+		subject(ctx),
+		objectWildcard,
+		eventsAction,
+		attributes(ctx, "", 0),
+	); err != nil {
+		return err
+	}
+	if s.EventBus == nil {
+		return status.New(codes.Unimplemented, "events are not enabled on the server").Err()
+	}
+
+	kinds := make(map[string]bool, len(req.Kinds))
+	for _, k := range req.Kinds {
+		kinds[k] = true
+	}
+
+	sub := s.EventBus.Subscribe(eventsBuffer)
+	defer sub.Close()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-sub.C():
+			if len(kinds) > 0 && !kinds[e.Kind] {
+				continue
+			}
+			if err := stream.Send(&api.Event{
+				Kind:      e.Kind,
+				Timestamp: e.Time.UnixNano(),
+				Attrs:     e.Attrs,
+				Dropped:   e.Dropped,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// eventAuthorizer 認可を拒否したときにAuthDeniedのイベントを発行するAuthorizer
+type eventAuthorizer struct {
+	Authorizer
+	bus *events.Bus
+}
+
+func (a eventAuthorizer) Authorize(subject, object, action string, attrs auth.Attributes) error {
+	err := a.Authorizer.Authorize(subject, object, action, attrs)
+	if status.Code(err) == codes.PermissionDenied {
+		a.bus.Publish(events.AuthDenied, map[string]string{
+			"subject": subject,
+			"object":  object,
+			"action":  action,
+		})
+	}
+	return err
+}
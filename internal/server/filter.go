@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxValueRegexLength value_regexとして受け付けるパターンの長さの上限
+	maxValueRegexLength = 1024
+	// maxValueRegexInsts value_regexをコンパイルしたプログラムの命令数の上限。
+	// INFO: RE2の照合は入力の長さに対して線形だが、{1000}のような繰り返しは命令数を膨らませ、照合のたびのコストとメモリを増やす
+	maxValueRegexInsts = 10000
+)
+
+// recordFilter ConsumeRequestで指定された条件に一致するレコードを選ぶ
+type recordFilter struct {
+	req      *api.ConsumeRequest
+	contains []byte
+	re       *regexp.Regexp
+}
+
+// newRecordFilter reqの条件から、レコードを選ぶフィルターを作成する。
+// value_regexが不正か上限を超える場合はInvalidArgumentを返す
+func newRecordFilter(req *api.ConsumeRequest) (*recordFilter, error) {
+	f := &recordFilter{req: req, contains: req.ValueContains}
+	if req.ValueRegex == "" {
+		return f, nil
+	}
+
+	if len(req.ValueRegex) > maxValueRegexLength {
+		return nil, status.New(
+			codes.InvalidArgument,
+			fmt.Sprintf("value_regex is too long: %d bytes, max %d", len(req.ValueRegex), maxValueRegexLength),
+		).Err()
+	}
+	parsed, err := syntax.Parse(req.ValueRegex, syntax.Perl)
+	if err != nil {
+		return nil, status.New(codes.InvalidArgument, fmt.Sprintf("invalid value_regex: %v", err)).Err()
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, status.New(codes.InvalidArgument, fmt.Sprintf("invalid value_regex: %v", err)).Err()
+	}
+	if len(prog.Inst) > maxValueRegexInsts {
+		return nil, status.New(codes.InvalidArgument, "value_regex is too complex").Err()
+	}
+	if f.re, err = regexp.Compile(req.ValueRegex); err != nil {
+		return nil, status.New(codes.InvalidArgument, fmt.Sprintf("invalid value_regex: %v", err)).Err()
+	}
+
+	return f, nil
+}
+
+// match recordがスキーマバージョンの範囲内で、値の条件に一致するかを判定する
+func (f *recordFilter) match(record *api.Record) bool {
+	if !schemaCompatible(f.req, record) {
+		return false
+	}
+	if len(f.contains) > 0 && !bytes.Contains(record.Value, f.contains) {
+		return false
+	}
+	return f.re == nil || f.re.Match(record.Value)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// syncedLog 同期済みのオフセットを返し、同期されるまで待てるログ。Followerの場合に使う
+type syncedLog interface {
+	SyncedOffset() uint64
+	WaitForSync(ctx context.Context, offset uint64) error
+}
+
+// checkSynced Followerの場合、offのレコードが同期済みかを確認する。同期されていない場合はErrOffsetNotSyncedを返す
+func (s *grpcServer) checkSynced(clog CommitLog, off uint64) error {
+	if !s.Follower {
+		return nil
+	}
+	sl, ok := clog.(syncedLog)
+	if !ok {
+		return status.New(codes.Unimplemented, "follower reads are not supported by the log").Err()
+	}
+	if synced := sl.SyncedOffset(); off >= synced {
+		return api.ErrOffsetNotSynced{Offset: off, Synced: synced}
+	}
+	return nil
+}
+
+// waitSynced Followerの場合、topicのログのoffのレコードが同期されるまで待つ
+func (s *grpcServer) waitSynced(ctx context.Context, topic string, off uint64) error {
+	if !s.Follower {
+		return nil
+	}
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return err
+	}
+	sl, ok := clog.(syncedLog)
+	if !ok {
+		return status.New(codes.Unimplemented, "follower reads are not supported by the log").Err()
+	}
+	return sl.WaitForSync(ctx, off)
+}
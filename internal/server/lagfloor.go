@@ -0,0 +1,24 @@
+package server
+
+import (
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkVisible ConsumeLagFloorが設定されている場合、offのレコードがログの末尾からConsumeLagFloor以上離れているかを確認する。
+// 末尾に近すぎるレコードはまだ追加されていないものとして扱い、ErrOffsetOutOfRangeを返す
+func (s *grpcServer) checkVisible(clog CommitLog, off uint64) error {
+	if s.ConsumeLagFloor == 0 {
+		return nil
+	}
+	ol, ok := clog.(offsetLog)
+	if !ok {
+		return status.New(codes.Unimplemented, "consume lag floor is not supported by the log").Err()
+	}
+	// INFO: 読み出せる最大のオフセットは、最大のオフセット(次のオフセットの1つ前)からConsumeLagFloorを引いたもの
+	if off+s.ConsumeLagFloor >= ol.NextOffset() {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return nil
+}
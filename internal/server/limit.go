@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// concurrencyLimiter 同時に処理するRPCをn件までに制限するInterceptorを返す。
+// 上限に達している場合、新しいRPCは待たずにResourceExhaustedで拒否する。ストリーミングRPCは終了するまで1件として数える
+func concurrencyLimiter(n int64) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	sem := semaphore.NewWeighted(n)
+	errExhausted := status.New(codes.ResourceExhausted, "too many concurrent requests").Err()
+
+	unary := func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if !sem.TryAcquire(1) {
+			return nil, errExhausted
+		}
+		defer sem.Release(1)
+		return handler(ctx, req)
+	}
+
+	stream := func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if !sem.TryAcquire(1) {
+			return errExhausted
+		}
+		defer sem.Release(1)
+		return handler(srv, stream)
+	}
+
+	return unary, stream
+}
+
+// streamDurationLimiter ストリーミングRPCのコンテキストをdで終了させ、DeadlineExceededを返すInterceptorを返す。
+// INFO: ハンドラーはコンテキストの終了を見て戻るので、戻った後にステータスを差し替える
+func streamDurationLimiter(d time.Duration) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		// INFO: WrapServerStreamは包み済みのストリームをそのまま返すので、差し替える前のコンテキストを取っておく
+		parent := stream.Context()
+		ctx, cancel := context.WithTimeout(parent, d)
+		defer cancel()
+
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = ctx
+		err := handler(srv, wrapped)
+		// クライアントが切断したのではなく、上限に達して終了した場合
+		if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return status.New(codes.DeadlineExceeded, fmt.Sprintf("stream exceeded max duration %s", d)).Err()
+		}
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metadataLog 読み出せるオフセットの範囲を返せるログ
+type metadataLog interface {
+	LowestOffset() (uint64, error)
+	NextOffset() uint64
+	PresentRanges() []log.OffsetRange
+}
+
+// GetMetadata ログの読み出せるオフセットの範囲を返す。include_rangesを指定した場合は、欠損を除いた範囲を連続したオフセットごとに返す
+func (s *grpcServer) GetMetadata(ctx context.Context, req *api.GetMetadataRequest) (*api.GetMetadataResponse, error) {
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
+		subject(ctx),
+		object(topic),
+		consumeAction,
+		attributes(ctx, topic, 0),
+	); err != nil {
+		return nil, err
+	}
+
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := clog.(metadataLog)
+	if !ok {
+		return nil, status.New(codes.Unimplemented, "metadata is not supported by the log").Err()
+	}
+
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetMetadataResponse{
+		LowestOffset: lowest,
+		NextOffset:   l.NextOffset(),
+	}
+	if req.IncludeRanges {
+		for _, r := range l.PresentRanges() {
+			res.Ranges = append(res.Ranges, &api.OffsetRun{Start: r.From, Length: r.To - r.From})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics コンシューマの進捗を把握するためのメトリクス
+type Metrics struct {
+	ackedOffset *prometheus.GaugeVec
+	consumerLag *prometheus.GaugeVec
+
+	// mu 遅れを記録しているストリームを保護する
+	mu sync.Mutex
+	// lags トピックごとの、遅れを記録しているストリーム
+	lags map[string]map[*lagStream]struct{}
+	// logNext トピックごとの、appendedで通知された次に追加されるオフセットの最大値
+	logNext map[string]uint64
+}
+
+// lagStream 遅れを記録しているConsumeStream
+type lagStream struct {
+	labels []string
+	topic  string
+	// next 次に送信するオフセット
+	next uint64
+}
+
+// NewMetrics メトリクスを作成してregに登録する
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		ackedOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Name:      "consumer_acked_offset",
+			Help:      "Highest offset acknowledged by ConsumeStream consumers, by subject and topic.",
+		}, []string{"subject", "topic"}),
+		consumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Name:      "consumer_lag",
+			Help:      "Number of records appended to the log but not yet sent on an active ConsumeStream.",
+		}, []string{"stream", "subject", "topic"}),
+		lags:    make(map[string]map[*lagStream]struct{}),
+		logNext: make(map[string]uint64),
+	}
+
+	for _, c := range []prometheus.Collector{m.ackedOffset, m.consumerLag} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// INFO: Metricsが設定されていないサーバでも呼び出せるよう、nilの場合は何もしない
+
+func (m *Metrics) ack(subject, topic string, offset uint64) {
+	if m == nil {
+		return
+	}
+	m.ackedOffset.WithLabelValues(subject, topic).Set(float64(offset))
+}
+
+// watchLag ストリームの遅れの記録を始める。nextは次に送信するオフセット、logNextはログに次に追加されるオフセット
+func (m *Metrics) watchLag(id uint64, subject, topic string, next, logNext uint64) *lagStream {
+	if m == nil {
+		return nil
+	}
+	st := &lagStream{
+		labels: []string{strconv.FormatUint(id, 10), subject, topic},
+		topic:  topic,
+		next:   next,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lags[topic] == nil {
+		m.lags[topic] = make(map[*lagStream]struct{})
+	}
+	m.lags[topic][st] = struct{}{}
+	m.setLag(st, logNext)
+	return st
+}
+
+// unwatchLag ストリームの遅れの記録をやめ、メトリクスから取り除く
+func (m *Metrics) unwatchLag(st *lagStream) {
+	if m == nil || st == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.lags[st.topic], st)
+	m.consumerLag.DeleteLabelValues(st.labels...)
+}
+
+// sent ストリームでoffsetのレコードを送信したことを記録する
+func (m *Metrics) sent(st *lagStream, offset, logNext uint64) {
+	if m == nil || st == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st.next = offset + 1
+	m.setLag(st, logNext)
+}
+
+// appended トピックにレコードが追加されたことを、そのトピックを読み出しているストリームの遅れに反映する
+func (m *Metrics) appended(topic string, logNext uint64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// INFO: 同時に追加された場合に通知の順序が入れ替わっても、遅れを小さく見積もらないようにする
+	if logNext < m.logNext[topic] {
+		return
+	}
+	m.logNext[topic] = logNext
+	for st := range m.lags[topic] {
+		m.setLag(st, logNext)
+	}
+}
+
+// setLag m.muを獲得した状態で呼び出す
+func (m *Metrics) setLag(st *lagStream, logNext uint64) {
+	var lag uint64
+	if logNext > st.next {
+		lag = logNext - st.next
+	}
+	m.consumerLag.WithLabelValues(st.labels...).Set(float64(lag))
+}
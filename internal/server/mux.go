@@ -0,0 +1,32 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// NewMuxServer gRPCのサービスとJSONのHTTPサーバを同じポートで提供するhttp.Serverを返す。
+// HTTP/2でContent-Typeがapplication/grpcのリクエストをgRPCに、それ以外をHTTPサーバに振り分ける。
+// TLSはhttp.Serverで終端するので、grpcOptsにgrpc.Credsを渡さず、ServeTLS(l, "", "")で起動すること
+func NewMuxServer(config *Config, tlsConfig *tls.Config, grpcOpts ...grpc.ServerOption) (*http.Server, error) {
+	gsrv, err := NewGRPCServer(config, grpcOpts...)
+	if err != nil {
+		return nil, err
+	}
+	hsrv := NewHTTPServer("")
+
+	return &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// INFO: gRPCはTLSの情報をリクエストから受け取るので、クライアント証明書による認証はそのまま機能する
+			if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				gsrv.ServeHTTP(w, r)
+				return
+			}
+			hsrv.Handler.ServeHTTP(w, r)
+		}),
+	}, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CommitOffset コンシューマグループが処理を終えたオフセットを記録する。オフセットを戻す場合はforceの指定が必要
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Offset); err != nil {
+		return nil, err
+	}
+
+	if err := s.Offsets.Commit(req.Group, req.Offset, req.Force); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// CommittedOffset コンシューマグループが最後にコミットしたオフセットを返す
+func (s *grpcServer) CommittedOffset(ctx context.Context, req *api.CommittedOffsetRequest) (*api.CommittedOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, 0); err != nil {
+		return nil, err
+	}
+
+	offset, err := s.Offsets.Committed(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CommittedOffsetResponse{Offset: offset}, nil
+}
+
+// authorizeGroup オフセットのコミットは読み出しの進捗なので、consumeの権限で認可する
+func (s *grpcServer) authorizeGroup(ctx context.Context, group string, offset uint64) error {
+	if s.Offsets == nil {
+		return status.New(codes.Unimplemented, "committed offsets are not enabled").Err()
+	}
+	if group == "" {
+		return status.New(codes.InvalidArgument, "group is required").Err()
+	}
+
+	return s.authorizer(ctx).Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+		attributes(ctx, "", offset),
+	)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"google.golang.org/grpc"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+)
+
+// RegisterLogServer 呼び出し側が作成したgRPCサーバにLogサービスを登録する。他のサービスと同じサーバで提供する場合に使う。
+// インターセプターはLogサービスのメソッドにだけ適用するので、同じサーバの他のサービスには影響しない。
+// ConnectionTimeoutと接続ごとの認可のキャッシュ、接続の記録はサーバのオプションなので、NewGRPCServerで作成したサーバでのみ有効になる
+func RegisterLogServer(s *grpc.Server, config *Config) error {
+	return registerLogServer(s, config, authenticate)
+}
+
+func registerLogServer(s grpc.ServiceRegistrar, config *Config, authFunc grpc_auth.AuthFunc) error {
+	srv, err := newGrpcServer(config)
+	if err != nil {
+		return err
+	}
+
+	unary, stream := interceptors(config, authFunc)
+	s.RegisterService(interceptedServiceDesc(&api.Log_ServiceDesc, unary, stream), srv)
+	return nil
+}
+
+// interceptedServiceDesc descの各メソッドのハンドラーを、インターセプターを通して呼び出すようにしたServiceDescを返す。
+// INFO: サーバ全体のインターセプターが設定されている場合は、その内側で適用する
+func interceptedServiceDesc(
+	desc *grpc.ServiceDesc,
+	unary grpc.UnaryServerInterceptor,
+	stream grpc.StreamServerInterceptor,
+) *grpc.ServiceDesc {
+	d := *desc
+
+	d.Methods = make([]grpc.MethodDesc, len(desc.Methods))
+	for i, m := range desc.Methods {
+		handler := m.Handler
+		d.Methods[i] = grpc.MethodDesc{
+			MethodName: m.MethodName,
+			Handler: func(
+				srv interface{},
+				ctx context.Context,
+				dec func(interface{}) error,
+				outer grpc.UnaryServerInterceptor,
+			) (interface{}, error) {
+				interceptor := unary
+				if outer != nil {
+					interceptor = grpc_middleware.ChainUnaryServer(outer, unary)
+				}
+				return handler(srv, ctx, dec, interceptor)
+			},
+		}
+	}
+
+	d.Streams = make([]grpc.StreamDesc, len(desc.Streams))
+	for i, sd := range desc.Streams {
+		handler := sd.Handler
+		info := &grpc.StreamServerInfo{
+			FullMethod:     "/" + desc.ServiceName + "/" + sd.StreamName,
+			IsClientStream: sd.ClientStreams,
+			IsServerStream: sd.ServerStreams,
+		}
+		d.Streams[i] = sd
+		d.Streams[i].Handler = func(srv interface{}, ss grpc.ServerStream) error {
+			return stream(srv, ss, info, handler)
+		}
+	}
+
+	return &d
+}
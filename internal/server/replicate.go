@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// replicateChunkSize ReplicateSegmentsで1つのメッセージに載せるファイルのバイト数
+const replicateChunkSize = 64 * 1024
+
+// segmentLog 書き込みの終わったセグメントのファイルの内容を読み出せるログ
+type segmentLog interface {
+	WalkSealedSegments(from uint64, fn func(log.RawSegment) error) error
+}
+
+// ReplicateSegments ベースオフセットがfrom_base_offset以上で書き込みの終わったセグメントについて、
+// ストアとインデックスの内容を分割して送る。レコードごとに追加し直さずにレプリカを作成するためのRPCで、replicateの権限を必要とする
+func (s *grpcServer) ReplicateSegments(req *api.ReplicateSegmentsRequest, stream api.Log_ReplicateSegmentsServer) error {
+	ctx := stream.Context()
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
+		subject(ctx),
+		object(topic),
+		replicateAction,
+		attributes(ctx, topic, 0),
+	); err != nil {
+		return err
+	}
+
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return err
+	}
+	l, ok := clog.(segmentLog)
+	if !ok {
+		return status.New(codes.Unimplemented, "segment replication is not supported by the log").Err()
+	}
+
+	return l.WalkSealedSegments(req.FromBaseOffset, func(seg log.RawSegment) error {
+		if err := sendSegmentFile(stream, seg, api.SegmentFile_SEGMENT_FILE_STORE, seg.Store()); err != nil {
+			return err
+		}
+		if err := sendSegmentFile(stream, seg, api.SegmentFile_SEGMENT_FILE_INDEX, seg.Index()); err != nil {
+			return err
+		}
+		// データを持たないチャンクでセグメントの終わりを知らせる
+		return stream.Send(&api.SegmentChunk{
+			BaseOffset: seg.BaseOffset(),
+			NextOffset: seg.NextOffset(),
+			File:       api.SegmentFile_SEGMENT_FILE_INDEX,
+			Last:       true,
+		})
+	})
+}
+
+// sendSegmentFile rの内容をreplicateChunkSizeずつ分割して送る
+func sendSegmentFile(stream api.Log_ReplicateSegmentsServer, seg log.RawSegment, file api.SegmentFile, r io.Reader) error {
+	for {
+		// INFO: 送信したメッセージは統計のハンドラなどが後から参照しうるので、バッファを使い回さない
+		buf := make([]byte, replicateChunkSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if serr := stream.Send(&api.SegmentChunk{
+				BaseOffset: seg.BaseOffset(),
+				NextOffset: seg.NextOffset(),
+				File:       file,
+				Data:       buf[:n],
+			}); serr != nil {
+				return serr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
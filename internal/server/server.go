@@ -5,67 +5,216 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"io"
+	"sync/atomic"
+	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/auth"
+	"github.com/radish-miyazaki/proglog/internal/events"
+	"github.com/radish-miyazaki/proglog/internal/log"
+	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
-	CommitLog  CommitLog
+	// CommitLog トピックを指定しないリクエストに使うデフォルトのログ。
+	// nilの場合、リクエストのフィールドでもx-topicのメタデータでもトピックを指定しないリクエストはInvalidArgumentで拒否する
+	CommitLog CommitLog
+	// Topics トピックごとのログ。トピックが指定されたリクエストはこちらに振り分ける
+	Topics     *log.LogManager
 	Authorizer Authorizer
+	// Quota サブジェクトごとの保存量の上限。nilの場合は制限しない
+	Quota Quota
+	// Offsets コンシューマグループのコミット済みオフセットの保存先。nilの場合はCommitOffsetとCommittedOffsetはUnimplementedを返す
+	Offsets OffsetStore
+	// ConnectionTimeout TLSハンドシェイクを含む接続の確立にかけられる時間。0の場合はgRPCのデフォルト値を使う
+	ConnectionTimeout time.Duration
+	// MaxConcurrentRequests 同時に処理するRPCの上限。超えたRPCはResourceExhaustedで拒否する。0の場合は制限しない
+	MaxConcurrentRequests int64
+	// MaxFollowStreams 新しいレコードを待ち続けるConsumeStream(followまたはnew_only)を同時に開ける上限。
+	// 超えたストリームはResourceExhaustedで拒否する。0の場合は制限しない
+	MaxFollowStreams int64
+	// MaxStreamDuration ProduceStreamとConsumeStreamを開いておける時間。超えたストリームはDeadlineExceededで終了し、
+	// クライアントに再接続させる。0の場合は制限しない
+	MaxStreamDuration time.Duration
+	// MaxUnackedRecords ConsumeStreamで、クライアントからackされていない状態で送信するレコードの上限。0の場合は制限しない
+	MaxUnackedRecords uint64
+	// Metrics コンシューマの進捗を記録するメトリクス。nilの場合は記録しない
+	Metrics *Metrics
+	// Follower リーダーから複製するフォロワーとして動かす。ログの同期済みのオフセット以降のレコードは、
+	// 複製が途中かもしれないので読み出しをErrOffsetNotSyncedで拒否する。フォローするストリームは同期されるまで待つ
+	Follower bool
+	// EventBus ログや認可で発生したイベントの配信先。nilの場合はEventsはUnimplementedを返す
+	EventBus *events.Bus
+	// Connections 接続しているクライアントの記録先。nilの場合は記録しない
+	Connections *ConnectionTracker
+	// DeadLetterTopic ProduceDeadLetterで書き込むトピック。空の場合はProduceDeadLetterはUnimplementedを返す
+	DeadLetterTopic string
+	// ConsumeLagFloor ログの最大のオフセットからこの数以内のレコードは、並べ替えや重複排除の途中かもしれないので読み出させない。
+	// 最大のオフセットからConsumeLagFloorを引いたものを読み出せる最大のオフセットとし、それより後ろはErrOffsetOutOfRangeを返す。
+	// フォローするストリームは後続のレコードが追加されるまで待つ。0の場合は制限しない
+	ConsumeLagFloor uint64
 }
 
 type Authorizer interface {
-	Authorize(subject, object, action string) error
+	Authorize(subject, object, action string, attrs auth.Attributes) error
+}
+
+// Quota サブジェクトごとにログに保存しているバイト数を記録する。
+// 削除されたセグメントの分を差し引くには、ログのConfig.OnSegmentsRemovedから使用量を減らす必要がある
+type Quota interface {
+	// Allow サブジェクトがさらにnバイトを書き込めるかを確認する。上限を超える場合はResourceExhaustedを返す
+	Allow(subject string, n uint64) error
+	// Charge トピックのベースオフセットがsegmentのセグメントに追加したnバイトのレコードを、サブジェクトの使用量に加える
+	Charge(subject, topic string, segment, n uint64)
+}
+
+type OffsetStore interface {
+	Commit(group string, offset uint64, force bool) error
+	Committed(group string) (uint64, error)
 }
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendAt(*api.Record, uint64) (uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// syncableLog 追加したレコードを安定したストレージに同期できるログ
+type syncableLog interface {
+	Sync() error
+}
+
+// offsetLog 次に追加されるオフセットを返せるログ。コンシューマの遅れを記録するために使う
+type offsetLog interface {
+	NextOffset() uint64
+}
+
+// lowestLog 読み出せる最も小さいオフセットを返せるログ
+type lowestLog interface {
+	LowestOffset() (uint64, error)
+}
+
+// statsLog 大きさと次に追加されるオフセットを返せるログ。include_statsを指定したProduceで使う
+type statsLog interface {
+	Stats() log.Stats
+	NextOffset() uint64
+}
+
+// segmentBaseLog レコードを含むセグメントのベースオフセットを返せるログ。使用量をセグメントごとにまとめて記録するために使う
+type segmentBaseLog interface {
+	SegmentBase(off uint64) (uint64, error)
+}
+
+// subscribableLog 購読を開始した後に追加されたレコードを待って読み出せるログ
+type subscribableLog interface {
+	Subscribe() *log.Subscription
+}
+
 const (
-	objectWildcard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	objectWildcard  = "*"
+	produceAction   = "produce"
+	consumeAction   = "consume"
+	replicateAction = "replicate"
+	eventsAction    = "events"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
 
 func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
-	grpcOpts = append(grpcOpts, grpc.StreamInterceptor(
-		// Stream（複数リクエスト）で用いるためのInterceptor
-		grpc_middleware.ChainStreamServer(
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)),
-		// Unary（単一リクエスト）で用いるためのInterceptor
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_auth.UnaryServerInterceptor(authenticate),
-		)),
-	)
+	return newGRPCServer(config, authenticate, grpcOpts...)
+}
+
+// NewGRPCServerH2C TLSを終端するプロキシの背後で動かすためのサーバを作成する。
+// grpc.Credsを渡さずに平文のリスナーでServeすると、gRPCは平文のHTTP/2(h2c)で提供される。
+// クライアント証明書の代わりに、プロキシが付与するidentityHeaderの値をサブジェクトとして扱うので、
+// プロキシ以外からは接続できないネットワークで使うこと
+func NewGRPCServerH2C(config *Config, identityHeader string, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
+	return newGRPCServer(config, authenticateHeader(identityHeader), grpcOpts...)
+}
+
+func newGRPCServer(config *Config, authFunc grpc_auth.AuthFunc, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
+	// INFO: ハンドシェイクを終えずに接続を占有し続けるクライアントを切断する
+	if config.ConnectionTimeout > 0 {
+		grpcOpts = append(grpcOpts, grpc.ConnectionTimeout(config.ConnectionTimeout))
+	}
+
+	// 認可の判定を接続ごとにキャッシュできる場合は、接続の確立時にキャッシュを作成する
+	if a, ok := config.Authorizer.(cachingAuthorizer); ok {
+		grpcOpts = append(grpcOpts, grpc.StatsHandler(&authCacheHandler{authorizer: a}))
+	}
+	if config.Connections != nil {
+		grpcOpts = append(grpcOpts, grpc.StatsHandler(&connStatsHandler{tracker: config.Connections}))
+	}
 
 	gsrv := grpc.NewServer(grpcOpts...)
-	srv, err := newGrpcServer(config)
-	if err != nil {
+	if err := registerLogServer(gsrv, config, authFunc); err != nil {
 		return nil, err
 	}
-
-	api.RegisterLogServer(gsrv, srv)
 	return gsrv, nil
 }
 
+// interceptors Logサービスのメソッドに適用するインターセプターを返す
+func interceptors(config *Config, authFunc grpc_auth.AuthFunc) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	var streamInterceptors []grpc.StreamServerInterceptor
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	// INFO: 過負荷を避けるため、認証より前に同時実行数を制限する
+	if config.MaxConcurrentRequests > 0 {
+		unary, stream := concurrencyLimiter(config.MaxConcurrentRequests)
+		unaryInterceptors = append(unaryInterceptors, unary)
+		streamInterceptors = append(streamInterceptors, stream)
+	}
+
+	// INFO: 認証や認可も含めたすべてのエラーをgRPCのステータスに変換するため、最初に置く
+	// Unary（単一リクエスト）で用いるためのInterceptor
+	unaryInterceptors = append(unaryInterceptors,
+		errorUnaryServerInterceptor,
+		grpc_auth.UnaryServerInterceptor(authFunc),
+	)
+	// Stream（複数リクエスト）で用いるためのInterceptor
+	streamInterceptors = append(streamInterceptors,
+		errorStreamServerInterceptor,
+		grpc_auth.StreamServerInterceptor(authFunc),
+	)
+	if config.Connections != nil {
+		unary, stream := connectionTracker(config.Connections)
+		unaryInterceptors = append(unaryInterceptors, unary)
+		streamInterceptors = append(streamInterceptors, stream)
+	}
+	unary := grpc_middleware.ChainUnaryServer(append(unaryInterceptors,
+		topicUnaryServerInterceptor,
+	)...)
+	if config.MaxStreamDuration > 0 {
+		streamInterceptors = append(streamInterceptors, streamDurationLimiter(config.MaxStreamDuration))
+	}
+	stream := grpc_middleware.ChainStreamServer(append(streamInterceptors,
+		topicStreamServerInterceptor,
+	)...)
+	return unary, stream
+}
+
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// follows 新しいレコードを待ち続けるストリームの数を制限する。MaxFollowStreamsが0の場合はnil
+	follows *semaphore.Weighted
+	// streamIDs コンシューマの遅れのメトリクスで、ストリームを区別するための連番
+	streamIDs uint64
 }
 
 func newGrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		Config: config,
 	}
+	if config.MaxFollowStreams > 0 {
+		srv.follows = semaphore.NewWeighted(config.MaxFollowStreams)
+	}
 	return srv, nil
 }
 
@@ -86,53 +235,243 @@ func authenticate(ctx context.Context) (context.Context, error) {
 	return ctx, nil
 }
 
+// authenticateHeader 信頼できるプロキシが付与したヘッダーの値をサブジェクトとするAuthFuncを返す
+func authenticateHeader(header string) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		var subject string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(header); len(values) > 0 {
+				subject = values[0]
+			}
+		}
+
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
+}
+
 func subject(ctx context.Context) string {
 	return ctx.Value(subjectContextKey{}).(string)
 }
 
 type subjectContextKey struct{}
 
+// attributes 認可の判定に使うリクエストの属性を返す
+func attributes(ctx context.Context, topic string, offset uint64) auth.Attributes {
+	attrs := auth.Attributes{
+		Time:   time.Now(),
+		Topic:  topic,
+		Offset: offset,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs.Peer = p.Addr.String()
+	}
+	return attrs
+}
+
+// object 認可の対象となるオブジェクトを返す。トピックが指定されていない場合はワイルドカードとする
+func object(topic string) string {
+	if topic == "" {
+		return objectWildcard
+	}
+	return topic
+}
+
+// commitLog トピックに対応するログを返す。トピックが空の場合はデフォルトのログを返し、デフォルトのログがない場合はInvalidArgumentを返す
+func (s *grpcServer) commitLog(topic string) (CommitLog, error) {
+	if topic == "" {
+		if s.CommitLog == nil {
+			return nil, status.New(codes.InvalidArgument, "topic is required").Err()
+		}
+		return s.CommitLog, nil
+	}
+	if s.Topics == nil {
+		return nil, status.New(codes.Unimplemented, "topics are not enabled").Err()
+	}
+	return s.Topics.Get(topic)
+}
+
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(
+	return s.produce(ctx, req, false)
+}
+
+// ProduceSync Produceと同様にレコードを追加し、ディスクに同期してから応答する
+func (s *grpcServer) ProduceSync(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	return s.produce(ctx, req, true)
+}
+
+// produce レコードを追加する。durableがtrueの場合は、追加したレコードをディスクに同期してから返す
+func (s *grpcServer) produce(ctx context.Context, req *api.ProduceRequest, durable bool) (*api.ProduceResponse, error) {
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
 		subject(ctx),
-		objectWildcard,
+		object(topic),
 		produceAction,
+		attributes(ctx, topic, req.ExpectedOffset),
 	); err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	clog, err := s.commitLog(topic)
 	if err != nil {
 		return nil, err
 	}
+	var sl syncableLog
+	if durable {
+		var ok bool
+		if sl, ok = clog.(syncableLog); !ok {
+			return nil, status.New(codes.Unimplemented, "produce sync is not supported by the log").Err()
+		}
+	}
+	var stl statsLog
+	if req.IncludeStats {
+		var ok bool
+		if stl, ok = clog.(statsLog); !ok {
+			return nil, status.New(codes.Unimplemented, "produce stats is not supported by the log").Err()
+		}
+	}
+
+	// クライアントが時刻を指定していない場合は、受け付けた時刻を付与する
+	if req.Record != nil && req.Record.Timestamp == 0 {
+		req.Record.Timestamp = time.Now().UnixNano()
+	}
+
+	// INFO: 書き込めなかったレコードを使用量に数えないよう、ここでは上限を確認するだけにして、追加に成功してから加える
+	size := uint64(proto.Size(req.Record))
+	if s.Quota != nil {
+		if err = s.Quota.Allow(subject(ctx), size); err != nil {
+			return nil, err
+		}
+	}
+
+	var offset uint64
+	if req.ExpectedOffset != 0 {
+		offset, err = clog.AppendAt(req.Record, req.ExpectedOffset)
+	} else {
+		offset, err = clog.Append(req.Record)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Quota != nil {
+		s.Quota.Charge(subject(ctx), topic, segmentOf(clog, offset), size)
+	}
+	s.Metrics.appended(topic, offset+1)
+	// INFO: 同期は追加したセグメントを含め、まだ同期されていないセグメントをすべて対象にするので、
+	//  他のリクエストの追加でセグメントが切り替わっていても、追加したレコードは永続化される
+	if durable {
+		if err = sl.Sync(); err != nil {
+			return nil, err
+		}
+	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	res := &api.ProduceResponse{Offset: offset, Timestamp: req.Record.Timestamp}
+	if stl != nil {
+		stats := stl.Stats()
+		res.Stats = &api.LogStats{
+			NextOffset: stl.NextOffset(),
+			Segments:   uint64(stats.Segments),
+			TotalBytes: stats.TotalBytes,
+			DiskFree:   stats.DiskFree,
+		}
+	}
+	return res, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(
+	filter, err := newRecordFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.consume(ctx, req, filter)
+}
+
+// consume reqのオフセット以降で、filterに一致する最初のレコードを返す
+func (s *grpcServer) consume(ctx context.Context, req *api.ConsumeRequest, filter *recordFilter) (*api.ConsumeResponse, error) {
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
 		subject(ctx),
-		objectWildcard,
+		object(topic),
 		consumeAction,
+		attributes(ctx, topic, req.Offset),
 	); err != nil {
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	clog, err := s.commitLog(topic)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ConsumeResponse{Record: record}, nil
+	// 条件に一致しないレコードと有効期間の過ぎたレコードは読み飛ばし、一致する最初のレコードを返す
+	off := req.Offset
+	for {
+		record, err := clog.Read(off)
+		if _, ok := err.(api.ErrRecordExpired); ok {
+			off++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = s.checkVisible(clog, record.Offset); err != nil {
+			return nil, err
+		}
+		if err = s.checkSynced(clog, record.Offset); err != nil {
+			return nil, err
+		}
+		if filter.match(record) {
+			return &api.ConsumeResponse{Record: record}, nil
+		}
+		off = record.Offset + 1
+	}
+}
+
+// schemaCompatible レコードのスキーマバージョンがリクエストで指定された範囲内かを判定する。
+// MaxSchemaVersionが0の場合は上限を設けない
+func schemaCompatible(req *api.ConsumeRequest, record *api.Record) bool {
+	if record.SchemaVersion < req.MinSchemaVersion {
+		return false
+	}
+	return req.MaxSchemaVersion == 0 || record.SchemaVersion <= req.MaxSchemaVersion
 }
 
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	// INFO: Recvはストリームのコンテキストが終了するまで戻らないので、MaxStreamDurationで終了できるよう別のゴルーチンで受信する
+	ctx := stream.Context()
+	type received struct {
+		req *api.ProduceRequest
+		err error
+	}
+	reqs := make(chan received)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case reqs <- received{req, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
 	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		var r received
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r = <-reqs:
 		}
-		res, err := s.Produce(stream.Context(), req)
+		// クライアントが送信を終えた場合は正常に終了する
+		if r.err == io.EOF {
+			return nil
+		}
+		if r.err != nil {
+			return r.err
+		}
+		res, err := s.Produce(ctx, r.req)
 		if err != nil {
 			return err
 		}
@@ -143,25 +482,388 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
-func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+func (s *grpcServer) ConsumeStream(stream api.Log_ConsumeStreamServer) error {
+	// 最初のメッセージで読み出す範囲を受け取る
+	msg, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	req := msg.GetRequest()
+	if req == nil {
+		return status.New(codes.InvalidArgument, "first message must be a consume request").Err()
+	}
+	filter, err := newRecordFilter(req)
+	if err != nil {
+		return err
+	}
+	if req.ToOffset != nil {
+		if req.EndOffset != 0 || req.Reverse {
+			return status.New(codes.InvalidArgument, "to_offset cannot be combined with end_offset or reverse").Err()
+		}
+		if *req.ToOffset < req.Offset && !req.NewOnly {
+			return status.New(codes.InvalidArgument, "to_offset must be >= offset").Err()
+		}
+	}
+	// to_offsetを指定した場合は、書き込まれるまで待つ
+	follow := req.Follow || req.ToOffset != nil
+
+	// 新しいレコードを待ち続けるストリームは、終了するまで枠を占有する
+	if s.follows != nil && ((follow && !req.Reverse) || req.NewOnly) {
+		if !s.follows.TryAcquire(1) {
+			return status.New(codes.ResourceExhausted, "too many follow streams").Err()
+		}
+		defer s.follows.Release(1)
+	}
+
+	ctx := stream.Context()
+	topic := requestTopic(ctx, req.Topic)
+	sub := subject(ctx)
+	wm, err := s.newWatermarker(topic, req)
+	if err != nil {
+		return err
+	}
+	acks := make(chan uint64)
+	go func() {
+		defer close(acks)
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if ack := msg.GetAck(); ack != nil {
+				select {
+				case acks <- ack.Offset:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	w := &ackWindow{
+		max:  s.MaxUnackedRecords,
+		acks: acks,
+		onAck: func(offset uint64) {
+			s.Metrics.ack(sub, topic, offset)
+		},
+	}
+
+	// 古い順に読み出すストリームでは、ログの末尾からの遅れを記録する
+	var lag *lagStream
+	var ol offsetLog
+	if s.Metrics != nil && !req.Reverse {
+		if clog, err := s.commitLog(topic); err == nil {
+			ol, _ = clog.(offsetLog)
+		}
+	}
+	if ol != nil {
+		logNext := ol.NextOffset()
+		next := req.Offset
+		if req.NewOnly {
+			next = logNext
+		}
+		lag = s.Metrics.watchLag(atomic.AddUint64(&s.streamIDs, 1), sub, topic, next, logNext)
+		defer s.Metrics.unwatchLag(lag)
+	}
+
+	// send ackされていないレコードが上限に達している場合は、ackを待ってから送信する。
+	// これ以上送信できない場合はfalseを返す
+	send := func(res *api.ConsumeResponse) (bool, error) {
+		if !w.wait(ctx) {
+			return false, nil
+		}
+		if err := stream.Send(res); err != nil {
+			return false, err
+		}
+		w.sent(res.Record.Offset)
+		if ol != nil {
+			s.Metrics.sent(lag, res.Record.Offset, ol.NextOffset())
+		}
+		return true, nil
+	}
+
+	if req.NewOnly {
+		if req.Reverse {
+			return status.New(codes.InvalidArgument, "new_only cannot be combined with reverse").Err()
+		}
+		return s.consumeNewOnly(ctx, stream, req, filter, wm, send)
+	}
+	if req.Reverse {
+		return s.consumeReverse(ctx, stream, req, filter, wm, send)
+	}
+
+	end, bounded := consumeEnd(req)
 	for {
 		select {
-		case <-stream.Context().Done():
+		case <-ctx.Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			if err := wm.sendIfDue(stream); err != nil {
+				return err
+			}
+			// INFO: フォローモードでは読み出す前に購読を開始し、読み出してから待ち始めるまでに追加されたレコードの通知を取りこぼさないようにする
+			var appended *log.Subscription
+			if follow {
+				appended = s.subscribe(topic)
+			}
+			res, err := s.consume(ctx, req, filter)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
-				continue
+				// to_offsetまで読み出す前に、読み出すはずのレコードが削除された場合は終了する
+				if req.ToOffset != nil && s.truncatedBefore(topic, req.Offset) {
+					return err
+				}
+				// フォローモードの場合は、レコードが追加されるまで待つ
+				if follow {
+					waitAppended(ctx, wm, appended)
+					continue
+				}
+				return err
+			case api.ErrOffsetNotSynced:
+				// フォローモードの場合は、同期されるまで待つ
+				if follow {
+					wctx, cancel := wm.waitContext(ctx)
+					err = s.waitSynced(wctx, topic, req.Offset)
+					cancel()
+					if err != nil && wctx.Err() == nil {
+						return err
+					}
+					continue
+				}
+				return err
 			default:
 				return err
 			}
 
-			if err = stream.Send(res); err != nil {
+			// 範囲の上限を超えた場合は終了する
+			if bounded && res.Record.Offset > end {
+				return nil
+			}
+
+			if ok, err := send(res); !ok {
+				return err
+			}
+			if bounded && res.Record.Offset == end {
+				return nil
+			}
+			// 読み飛ばしたレコードがある場合に備えて、返したレコードの次から読み出す
+			req.Offset = res.Record.Offset + 1
+		}
+	}
+}
+
+// consumeNewOnly 購読を開始した後に追加されたレコードを返す
+func (s *grpcServer) consumeNewOnly(
+	ctx context.Context,
+	stream api.Log_ConsumeStreamServer,
+	req *api.ConsumeRequest,
+	filter *recordFilter,
+	wm *watermarker,
+	send func(*api.ConsumeResponse) (bool, error),
+) error {
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
+		subject(ctx),
+		object(topic),
+		consumeAction,
+		attributes(ctx, topic, req.Offset),
+	); err != nil {
+		return err
+	}
+
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return err
+	}
+	l, ok := clog.(subscribableLog)
+	if !ok {
+		return status.New(codes.Unimplemented, "new_only is not supported by the log").Err()
+	}
+
+	// INFO: 購読を開始してからヘッダーを送信し、クライアントに以降の書き込みが届くことを知らせる
+	sub := l.Subscribe()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	end, bounded := consumeEnd(req)
+	// INFO: ConsumeLagFloorが設定されている場合、受け取ったレコードは後続のレコードが追加されて読み出せるようになるまで溜めておく
+	var pending []*api.Record
+	for {
+		if err := wm.sendIfDue(stream); err != nil {
+			return err
+		}
+		wctx, cancel := wm.waitContext(ctx)
+		record, err := sub.Next(wctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// 次のウォーターマークを送る時刻になった
+			if wctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+		pending = append(pending, record)
+
+		for len(pending) > 0 {
+			record := pending[0]
+			if err = s.checkVisible(clog, record.Offset); err != nil {
+				if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+					break
+				}
+				return err
+			}
+			pending = pending[1:]
+
+			if bounded && record.Offset > end {
+				return nil
+			}
+			if err = s.waitSynced(ctx, topic, record.Offset); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
 				return err
 			}
-			req.Offset++
+			if filter.match(record) {
+				if ok, err := send(&api.ConsumeResponse{Record: record}); !ok {
+					return err
+				}
+			}
+			if bounded && record.Offset == end {
+				return nil
+			}
+		}
+	}
+}
+
+// consumeEnd ConsumeStreamで返すオフセットの上限(この値を含む)と、上限があるかを返す
+func consumeEnd(req *api.ConsumeRequest) (uint64, bool) {
+	if req.ToOffset != nil {
+		return *req.ToOffset, true
+	}
+	return req.EndOffset, req.EndOffset != 0
+}
+
+// truncatedBefore offのレコードが、ログの先頭から削除されているかを返す
+func (s *grpcServer) truncatedBefore(topic string, off uint64) bool {
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return false
+	}
+	l, ok := clog.(lowestLog)
+	if !ok {
+		return false
+	}
+	lowest, err := l.LowestOffset()
+	return err == nil && off < lowest
+}
+
+// segmentOf offのレコードを含むセグメントのベースオフセットを返す。
+// セグメントを返せないログの場合はoffを返し、レコードごとに使用量を記録する
+func segmentOf(clog CommitLog, off uint64) uint64 {
+	if l, ok := clog.(segmentBaseLog); ok {
+		if base, err := l.SegmentBase(off); err == nil {
+			return base
+		}
+	}
+	return off
+}
+
+// followPollInterval 追加を通知できないログをフォローモードで読み出す場合に、次に読み出しを試みるまで待つ間隔
+const followPollInterval = 100 * time.Millisecond
+
+// subscribe トピックのログの購読を開始する。購読できないログの場合はnilを返す
+func (s *grpcServer) subscribe(topic string) *log.Subscription {
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return nil
+	}
+	l, ok := clog.(subscribableLog)
+	if !ok {
+		return nil
+	}
+	return l.Subscribe()
+}
+
+// waitAppended subを開始した後にレコードが追加されるか、次のウォーターマークを送る時刻になるか、ctxが終了するまで待つ。
+// subがnilの場合は、followPollIntervalだけ待つ
+func waitAppended(ctx context.Context, wm *watermarker, sub *log.Subscription) {
+	wctx, cancel := wm.waitContext(ctx)
+	defer cancel()
+
+	if sub == nil {
+		select {
+		case <-wctx.Done():
+		case <-time.After(followPollInterval):
+		}
+		return
+	}
+	_, _ = sub.Next(wctx)
+}
+
+// consumeReverse [Offset, EndOffset]の範囲のレコードを新しい順に返す
+func (s *grpcServer) consumeReverse(
+	ctx context.Context,
+	stream api.Log_ConsumeStreamServer,
+	req *api.ConsumeRequest,
+	filter *recordFilter,
+	wm *watermarker,
+	send func(*api.ConsumeResponse) (bool, error),
+) error {
+	topic := requestTopic(ctx, req.Topic)
+	if err := s.authorizer(ctx).Authorize(
+		subject(ctx),
+		object(topic),
+		consumeAction,
+		attributes(ctx, topic, req.EndOffset),
+	); err != nil {
+		return err
+	}
+
+	if req.EndOffset == 0 || req.EndOffset < req.Offset {
+		return status.New(codes.InvalidArgument, "reverse consume requires end_offset >= offset").Err()
+	}
+
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return err
+	}
+	for off := req.EndOffset; ; off-- {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err := wm.sendIfDue(stream); err != nil {
+			return err
+		}
+
+		// 有効期間の過ぎたレコードは読み飛ばす
+		record, err := clog.Read(off)
+		_, expired := err.(api.ErrRecordExpired)
+		if err != nil && !expired {
+			return err
+		}
+		if err = s.checkVisible(clog, off); err != nil {
+			return err
+		}
+		if err = s.checkSynced(clog, off); err != nil {
+			return err
+		}
+		if !expired && filter.match(record) {
+			if ok, err := send(&api.ConsumeResponse{Record: record}); !ok {
+				return err
+			}
+		}
+		// 範囲の下限に達したら終了する
+		if off == req.Offset {
+			return nil
 		}
 	}
 }
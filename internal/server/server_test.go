@@ -1,21 +1,46 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	api "github.com/radish-miyazaki/proglog/api/v1"
 	"github.com/radish-miyazaki/proglog/internal/auth"
+	"github.com/radish-miyazaki/proglog/internal/client"
 	"github.com/radish-miyazaki/proglog/internal/config"
+	"github.com/radish-miyazaki/proglog/internal/events"
 	"github.com/radish-miyazaki/proglog/internal/log"
+	"github.com/radish-miyazaki/proglog/internal/offsets"
+	"github.com/radish-miyazaki/proglog/internal/quota"
 )
 
 func TestServer(t *testing.T) {
@@ -29,6 +54,16 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
 		"unauthorized fails":                                 testUnauthorized,
+		"produce/consume to multiple topics succeeds":        testProduceConsumeTopics,
+		"produce with expected offset":                       testProduceExpectedOffset,
+		"consume filtered by schema version":                 testConsumeSchemaVersion,
+		"consume filtered by value":                          testConsumeValueFilter,
+		"capabilities reflect config":                        testCapabilities,
+		"empty produce stream closes cleanly":                testEmptyProduceStream,
+		"produce/consume with topic metadata":                testTopicMetadata,
+		"consume stream on empty log":                        testConsumeStreamEmptyLog,
+		"consume stream in reverse within a range":           testConsumeStreamReverse,
+		"produce stream echoes timestamps":                   testProduceStreamTimestamps,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -99,10 +134,16 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
+	topicsDir, err := os.MkdirTemp("", "server-topics-test")
+	require.NoError(t, err)
+	topics, err := log.NewLogManager(topicsDir, log.Config{})
+	require.NoError(t, err)
+
 	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	require.NoError(t, err)
 	cfg = &Config{
 		CommitLog:  clog,
+		Topics:     topics,
 		Authorizer: authorizer,
 	}
 	if fn != nil {
@@ -125,6 +166,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		server.Stop()
 		l.Close()
 		clog.Remove()
+		topics.Remove()
 	}
 }
 
@@ -181,6 +223,9 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, _ *Config)
 		Offset: 1,
 	}}
 
+	// サーバが付与した時刻
+	timestamps := make([]int64, len(records))
+
 	// ストリームの書き出しのテスト
 	{
 		stream, err := client.ProduceStream(ctx)
@@ -197,13 +242,14 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, _ *Config)
 			if res.Offset != uint64(offset) {
 				t.Fatalf("got offset: %d, want: %d", res.Offset, offset)
 			}
+			timestamps[offset] = res.Timestamp
 		}
 	}
 
 	// ストリームの読み出しのテスト
 	{
 		// ConsumeRequestには最初のオフセットをセット
-		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+		stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 0})
 		require.NoError(t, err)
 
 		for i, record := range records {
@@ -211,8 +257,9 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, _ *Config)
 			require.NoError(t, err)
 
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: timestamps[i],
 			})
 		}
 	}
@@ -245,3 +292,1909 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 		t.Fatalf("got code: %d, want code: %d", gotCode, wantCode)
 	}
 }
+
+func testProduceConsumeTopics(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+
+	topics := map[string][]string{
+		"orders":   {"order-1", "order-2"},
+		"payments": {"payment-1"},
+	}
+
+	// トピックごとにレコードを書き込む。オフセットはトピックごとに0から採番される
+	for topic, values := range topics {
+		for i, value := range values {
+			produce, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte(value)},
+				Topic:  topic,
+			})
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), produce.Offset)
+		}
+	}
+
+	// トピックごとに独立して読み出せるか
+	for topic, values := range topics {
+		for i, value := range values {
+			consume, err := client.Consume(ctx, &api.ConsumeRequest{
+				Offset: uint64(i),
+				Topic:  topic,
+			})
+			require.NoError(t, err)
+			require.Equal(t, []byte(value), consume.Record.Value)
+		}
+
+		_, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: uint64(len(values)),
+			Topic:  topic,
+		})
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+	}
+
+	// デフォルトのログには書き込まれていない
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// ディレクトリとして使えないトピック名は拒否される
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "../escape",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testProduceExpectedOffset(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	// 期待したオフセットと次のオフセットが一致する場合は書き込める
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		ExpectedOffset: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), produce.Offset)
+
+	// 一致しない場合は実際の次のオフセットが返ってくる
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		ExpectedOffset: 5,
+	})
+	require.Nil(t, produce)
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+
+	var info *errdetails.ErrorInfo
+	for _, d := range st.Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, "3", info.Metadata["actual_offset"])
+}
+
+func testConsumeSchemaVersion(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+
+	for _, version := range []uint32{1, 2, 1, 3} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:         []byte(fmt.Sprintf("version %d", version)),
+				SchemaVersion: version,
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	// 範囲外のレコードは読み飛ばされ、範囲内の次のレコードが返ってくる
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:           1,
+		MinSchemaVersion: 1,
+		MaxSchemaVersion: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+
+	// ストリームではバージョン1のレコードだけが元のオフセットのまま届く
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{
+		MinSchemaVersion: 1,
+		MaxSchemaVersion: 1,
+	})
+	require.NoError(t, err)
+	for _, want := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+		require.Equal(t, uint32(1), res.Record.SchemaVersion)
+	}
+
+	// 下限のみの指定では、それ以上のバージョンがすべて届く
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:           0,
+		MinSchemaVersion: 3,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), consume.Record.Offset)
+}
+
+func testConsumeValueFilter(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for _, value := range []string{"order:1", "user:1", "order:22", "user:2", "order:x"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+
+	// 一致しないレコードは読み飛ばされ、一致する次のレコードが返ってくる
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:        1,
+		ValueContains: []byte("order"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+
+	// ストリームでは一致するレコードだけが元のオフセットのまま届く
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{
+		ValueRegex: `^order:\d+$`,
+	})
+	require.NoError(t, err)
+	for _, want := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// 両方を指定すると、両方に一致するレコードだけが届く
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{
+		ValueContains: []byte("2"),
+		ValueRegex:    `^user:`,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+
+	// 不正なパターンや、上限を超えるパターンは拒否される
+	for _, pattern := range []string{
+		`order(`,
+		strings.Repeat("a", maxValueRegexLength+1),
+		`(a{1000}){1000}`,
+		strings.Repeat(`a{1000}`, 11),
+	} {
+		_, err = client.Consume(ctx, &api.ConsumeRequest{ValueRegex: pattern})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), pattern)
+	}
+}
+
+func testCapabilities(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	res, err := client.Capabilities(ctx, &api.CapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Equal(t, Version, res.Version)
+
+	// テストのサーバはトピックが有効で、クォータは設定されていない
+	require.NotNil(t, config.Topics)
+	require.Nil(t, config.Quota)
+	require.Equal(t, []string{
+		FeatureExpectedOffset,
+		FeatureFollow,
+		FeatureMetadata,
+		FeatureNewOnly,
+		FeatureOffsetRange,
+		FeatureProduceStats,
+		FeatureProduceSync,
+		FeatureReplicateSegments,
+		FeatureReverse,
+		FeatureSchemaVersionFilter,
+		FeatureTopics,
+		FeatureValueFilter,
+		FeatureWatermarks,
+	}, res.Features)
+
+	// 設定を変えると報告される機能も変わる
+	srv, err := newGrpcServer(&Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		FeatureExpectedOffset,
+		FeatureFollow,
+		FeatureMetadata,
+		FeatureNewOnly,
+		FeatureOffsetRange,
+		FeatureProduceStats,
+		FeatureProduceSync,
+		FeatureReplicateSegments,
+		FeatureReverse,
+		FeatureSchemaVersionFilter,
+		FeatureValueFilter,
+		FeatureWatermarks,
+	}, srv.features())
+}
+
+func TestServerH2C(t *testing.T) {
+	const identityHeader = "x-client-subject"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-h2c-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	// TLSの設定なしでサーバを作成し、平文のHTTP/2で提供する
+	server, err := NewGRPCServerH2C(&Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+	}, identityHeader)
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	produce := func(subject string) error {
+		ctx := context.Background()
+		if subject != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, identityHeader, subject)
+		}
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+
+	// ヘッダーのサブジェクトで認可される
+	require.NoError(t, produce("root"))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce("nobody")))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce("")))
+}
+
+func testEmptyProduceStream(t *testing.T, client, _ api.LogClient, _ *Config) {
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	// 何も送信せずに閉じても、エラーなく終了する
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testConsumeStreamEmptyLog(t *testing.T, client, _ api.LogClient, _ *Config) {
+	// 空のログではOutOfRangeで終了する
+	stream, err := consumeStream(context.Background(), client, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// フォローモードではレコードが追加されるまで待つ
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{Offset: 0, Follow: true})
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+}
+
+// countingAuthorizer 認可した回数を数える
+type countingAuthorizer struct {
+	Authorizer
+	n atomic.Int64
+}
+
+func (a *countingAuthorizer) Authorize(subject, object, action string, attrs auth.Attributes) error {
+	a.n.Add(1)
+	return a.Authorizer.Authorize(subject, object, action, attrs)
+}
+
+// フォローモードでログの末尾に追いついたストリームが、読み出しを繰り返さずに追加を待つか
+func TestServerConsumeStreamFollowWaits(t *testing.T) {
+	var counter *countingAuthorizer
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		counter = &countingAuthorizer{Authorizer: c.Authorizer}
+		c.Authorizer = counter
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 0, Follow: true})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return counter.n.Load() > 0
+	}, time.Second, time.Millisecond)
+
+	// 待っている間は読み出しを試みない
+	waiting := counter.n.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.LessOrEqual(t, counter.n.Load()-waiting, int64(1))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+}
+
+func testConsumeStreamReverse(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// セグメントをまたぐよう、小さいセグメントのログに書き込む
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.MaxIndexBytes = 1024
+	require.NoError(t, config.CommitLog.(*log.Log).UpdateConfig(c))
+	for i := 0; i < 6; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{
+		Offset:    1,
+		EndOffset: 4,
+		Reverse:   true,
+	})
+	require.NoError(t, err)
+
+	// 範囲内のレコードが新しい順に返され、下限で終了する
+	for want := uint64(4); want >= 1; want-- {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// 順方向でも範囲の上限で終了する
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{Offset: 3, EndOffset: 4})
+	require.NoError(t, err)
+	for want := uint64(3); want <= 4; want++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// 上限のない逆順の読み出しは拒否される
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{Offset: 1, Reverse: true})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testProduceStreamTimestamps(t *testing.T, client, _ api.LogClient, _ *Config) {
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	// 時刻を指定しない場合は、サーバが付与した時刻が単調に返される
+	var last int64
+	for i := 0; i < 5; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		}))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.NotZero(t, res.Timestamp)
+		require.GreaterOrEqual(t, res.Timestamp, last)
+		last = res.Timestamp
+	}
+
+	// 指定した時刻はそのまま返される
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world"), Timestamp: 42},
+	}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), res.Timestamp)
+}
+
+// consumeStream ConsumeStreamを開始して、最初のメッセージとしてreqを送信する
+func consumeStream(ctx context.Context, client api.LogClient, req *api.ConsumeRequest) (api.Log_ConsumeStreamClient, error) {
+	stream, err := client.ConsumeStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&api.ConsumeStreamRequest{
+		Message: &api.ConsumeStreamRequest_Request{Request: req},
+	})
+	return stream, err
+}
+
+// 条件に一致するレコードがなくても、追加に合わせて進むウォーターマークが定期的に届くか
+func TestServerConsumeStreamWatermarks(t *testing.T) {
+	for name, req := range map[string]*api.ConsumeRequest{
+		"follow":   {Follow: true},
+		"new only": {NewOnly: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, _, config, teardown := setupTest(t, func(c *Config) {
+				metrics, err := NewMetrics(prometheus.NewRegistry())
+				require.NoError(t, err)
+				c.Metrics = metrics
+			})
+			defer teardown()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			produce := func() {
+				_, err := client.Produce(ctx, &api.ProduceRequest{
+					Record: &api.Record{Value: []byte("hello world")},
+				})
+				require.NoError(t, err)
+			}
+			for i := 0; i < 3; i++ {
+				produce()
+			}
+
+			req.ValueContains = []byte("no match")
+			req.WatermarkIntervalMs = 20
+			stream, err := consumeStream(ctx, client, req)
+			require.NoError(t, err)
+
+			// highestに達するまでウォーターマークを受け取り、レコードが届かないことを確認する
+			waitFor := func(highest uint64) {
+				for {
+					res, err := stream.Recv()
+					require.NoError(t, err)
+					require.Nil(t, res.Record)
+					require.NotNil(t, res.Watermark)
+					require.LessOrEqual(t, res.Watermark.HighestOffset, highest)
+					if res.Watermark.HighestOffset == highest {
+						return
+					}
+				}
+			}
+			waitFor(2)
+			produce()
+			produce()
+			waitFor(4)
+
+			// INFO: ログを閉じる前にストリームを終了させる。ストリームが終了すると、そのストリームの遅れは取り除かれる
+			cancel()
+			require.Eventually(t, func() bool {
+				return testutil.CollectAndCount(config.Metrics.consumerLag) == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestServerConsumeStreamAck(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+		c.Metrics = metrics
+		c.MaxUnackedRecords = 2
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 8; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	recv := make(chan uint64)
+	go func() {
+		defer close(recv)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case recv <- res.Record.Offset:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	ack := func(offset uint64) {
+		require.NoError(t, stream.Send(&api.ConsumeStreamRequest{
+			Message: &api.ConsumeStreamRequest_Ack{Ack: &api.ConsumeAck{Offset: offset}},
+		}))
+	}
+	paused := func() {
+		select {
+		case off := <-recv:
+			t.Fatalf("received offset %d past the un-acked window", off)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// ackされていないレコードが上限に達すると送信が止まる
+	require.Equal(t, uint64(0), <-recv)
+	require.Equal(t, uint64(1), <-recv)
+	paused()
+
+	// ackすると次のレコードが送られる
+	ack(0)
+	require.Equal(t, uint64(2), <-recv)
+	paused()
+
+	// まとめてackすると、その分だけ送られる
+	ack(2)
+	require.Equal(t, uint64(3), <-recv)
+	require.Equal(t, uint64(4), <-recv)
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(config.Metrics.ackedOffset.WithLabelValues("root", "")) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// 送信したどのオフセットとも一致しないackでも、それ以下はすべてackされたものとする
+	paused()
+	ack(10)
+	require.Equal(t, uint64(5), <-recv)
+	require.Equal(t, uint64(6), <-recv)
+	paused()
+}
+
+func TestServerConnectionTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	server, err := NewGRPCServer(&Config{
+		ConnectionTimeout: 100 * time.Millisecond,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	// TCPで接続したまま、TLSのハンドシェイクを始めずに待つ
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+
+	// タイムアウト後にサーバから切断される
+	require.Equal(t, io.EOF, err)
+	require.Greater(t, time.Since(start), 50*time.Millisecond)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func testTopicMetadata(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-topic", "orders")
+
+	// メタデータで指定したトピックに書き込まれる
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	orders, err := config.Topics.Get("orders")
+	require.NoError(t, err)
+	read, err := orders.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// ストリームでもメタデータのトピックが使われる
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	// 不正なトピックはInvalidArgumentになる
+	for _, topic := range []string{"", "../orders"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-topic", topic)
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+// デフォルトのログがない場合、トピックを指定しないリクエストはInvalidArgumentで拒否されるか
+func TestServerTopicRequired(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = nil
+	})
+	defer teardown()
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// メタデータでトピックを指定すれば書き込める
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-topic", "orders")
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	orders, err := config.Topics.Get("orders")
+	require.NoError(t, err)
+	read, err := orders.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func TestServerMaxConcurrentRequests(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxConcurrentRequests = 1
+	})
+	defer teardown()
+
+	// 空のログをフォローするストリームで、唯一の枠を占有する
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := consumeStream(ctx, client, &api.ConsumeRequest{Follow: true})
+	require.NoError(t, err)
+
+	capabilities := func() error {
+		_, err := client.Capabilities(context.Background(), &api.CapabilitiesRequest{})
+		return err
+	}
+	require.Eventually(t, func() bool {
+		return status.Code(capabilities()) == codes.ResourceExhausted
+	}, time.Second, 10*time.Millisecond)
+
+	// ストリームが終了すると枠が空く
+	cancel()
+	require.Eventually(t, func() bool {
+		return capabilities() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerMux(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-mux-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	server, err := NewMuxServer(&Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+	}, serverTLSConfig)
+	require.NoError(t, err)
+	go func() {
+		server.ServeTLS(l, "", "")
+	}()
+	defer server.Close()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:   config.CAFile,
+		KeyFile:  config.RootClientKeyFile,
+		CertFile: config.RootClientCertFile,
+	})
+	require.NoError(t, err)
+
+	// gRPCのクライアントはクライアント証明書で認可される
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	produce, err := api.NewLogClient(conn).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	// 同じアドレスでJSONのHTTPサーバにも接続できる
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig}}
+	res, err := client.Post(
+		"https://"+l.Addr().String()+"/",
+		"application/json",
+		strings.NewReader(`{"record":{"value":"aGVsbG8gd29ybGQ="}}`),
+	)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var body ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Equal(t, uint64(0), body.Offset)
+}
+
+func TestServerAuthorizationCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-auth-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// ポリシーを書き換えられるよう、一時ディレクトリにコピーする
+	policy := filepath.Join(dir, "policy.csv")
+	b, err := os.ReadFile(config.ACLPolicyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(policy, b, 0644))
+	authorizer, err := auth.New(config.ACLModelFile, policy)
+	require.NoError(t, err)
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer teardown()
+
+	produce := func() error {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce())
+
+	// 読み込み直すまでは、同じ接続ではキャッシュした判定が使われる
+	require.NoError(t, os.WriteFile(policy, []byte("p, root, *, consume\n"), 0644))
+	require.NoError(t, produce())
+
+	require.NoError(t, authorizer.Reload())
+	require.Equal(t, codes.PermissionDenied, status.Code(produce()))
+}
+
+// 保存量の上限に達したサブジェクトは拒否されるが、別のサブジェクトは書き込めて、セグメントを削除すると再び書き込めるか
+func TestServerQuota(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// nobodyにも書き込みを許可する
+	policy := filepath.Join(dir, "policy.csv")
+	b, err := os.ReadFile(config.ACLPolicyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(policy, append(b, "p, nobody, *, produce\n"...), 0644))
+	authorizer, err := auth.New(config.ACLModelFile, policy)
+	require.NoError(t, err)
+
+	accountant, err := quota.New(filepath.Join(dir, "quota.json"), 250)
+	require.NoError(t, err)
+	defer accountant.Close()
+
+	var clog *log.Log
+	root, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+		c.Quota = accountant
+		// レコードごとにセグメントを切り替え、削除したセグメントの分を使用量から差し引く
+		clog = c.CommitLog.(*log.Log)
+		clog.Config.OnSegmentsRemoved = accountant.Release
+		lc := clog.Config
+		lc.Segment.MaxRecords = 1
+		require.NoError(t, clog.UpdateConfig(lc))
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func(client api.LogClient, expected uint64) error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:         &api.Record{Value: bytes.Repeat([]byte("a"), 100)},
+			ExpectedOffset: expected,
+		})
+		return err
+	}
+
+	// 上限に達したrootは拒否される
+	require.NoError(t, produce(root, 0))
+	require.NoError(t, produce(root, 0))
+	require.Equal(t, codes.ResourceExhausted, status.Code(produce(root, 0)))
+
+	// nobodyは影響を受けず、書き込めなかったリクエストは使用量に数えない
+	require.NoError(t, produce(nobody, 0))
+	used := accountant.Usage("nobody")
+	require.Equal(t, codes.FailedPrecondition, status.Code(produce(nobody, 1)))
+	require.Equal(t, used, accountant.Usage("nobody"))
+
+	// rootが書き込んだセグメントを削除すると、rootは再び書き込める
+	require.NoError(t, clog.Truncate(1))
+	require.Equal(t, uint64(0), accountant.Usage("root"))
+	require.Equal(t, used, accountant.Usage("nobody"))
+	require.NoError(t, produce(root, 0))
+}
+
+func TestServerCommitOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := offsets.New(filepath.Join(dir, "offsets.json"))
+	require.NoError(t, err)
+	client, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.Offsets = store
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = client.CommittedOffset(ctx, &api.CommittedOffsetRequest{Group: "billing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 7})
+	require.NoError(t, err)
+	res, err := client.CommittedOffset(ctx, &api.CommittedOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+
+	// 戻す方向のコミットはforceを指定した場合のみ受け付ける
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 2})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 2, Force: true})
+	require.NoError(t, err)
+	res, err = client.CommittedOffset(ctx, &api.CommittedOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	// consumeの権限がないユーザはコミットできない
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 9})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 保存先が設定されていないサーバではUnimplemented
+	client, _, _, teardown2 := setupTest(t, nil)
+	defer teardown2()
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestServerConsumeStreamNewOnly(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	produce := func(value string) uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		return res.Offset
+	}
+
+	// 購読を開始する直前の書き込みは届かない
+	produce("before")
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{NewOnly: true})
+	require.NoError(t, err)
+	// ヘッダーを受け取った時点で購読は開始している
+	_, err = stream.Header()
+	require.NoError(t, err)
+	offset := produce("after")
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, offset, res.Record.Offset)
+	require.Equal(t, []byte("after"), res.Record.Value)
+
+	// reverseとは組み合わせられない
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{NewOnly: true, Reverse: true, EndOffset: 1})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// failingLog すべての操作でerrを返すログ
+type failingLog struct {
+	err error
+}
+
+func (l failingLog) Append(*api.Record) (uint64, error)           { return 0, l.err }
+func (l failingLog) AppendAt(*api.Record, uint64) (uint64, error) { return 0, l.err }
+func (l failingLog) Read(uint64) (*api.Record, error)             { return nil, l.err }
+
+func TestServerErrorMapping(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err    error
+		code   codes.Code
+		reason string
+	}{
+		"disk full": {
+			err:    api.ErrDiskFull{Err: syscall.ENOSPC},
+			code:   codes.ResourceExhausted,
+			reason: "DISK_FULL",
+		},
+		"read-only filesystem": {
+			err:    api.ErrReadOnlyFilesystem{Err: syscall.EROFS},
+			code:   codes.FailedPrecondition,
+			reason: "READ_ONLY_FILESYSTEM",
+		},
+		"circuit open": {
+			err:    api.ErrCircuitOpen{Err: api.ErrDiskFull{Err: syscall.ENOSPC}},
+			code:   codes.Unavailable,
+			reason: "CIRCUIT_OPEN",
+		},
+		"closed log": {
+			err:    api.ErrLogClosed{Dir: "/tmp/log"},
+			code:   codes.Unavailable,
+			reason: "LOG_CLOSED",
+		},
+		"read scan limit": {
+			err:    api.ErrReadScanLimit{Offset: 10, Max: 4},
+			code:   codes.Internal,
+			reason: "READ_SCAN_LIMIT",
+		},
+		"highest mismatch": {
+			err:    api.ErrHighestMismatch{Expected: 1, Actual: 2},
+			code:   codes.Aborted,
+			reason: "HIGHEST_MISMATCH",
+		},
+		"too many topics": {
+			err:    api.ErrTooManyTopics{Topic: "refunds", Max: 2},
+			code:   codes.ResourceExhausted,
+			reason: "TOO_MANY_TOPICS",
+		},
+		"corrupt segment": {
+			err:    api.ErrOffsetUnavailable{Offset: 3},
+			code:   codes.DataLoss,
+			reason: "OFFSET_UNAVAILABLE",
+		},
+		"unhealthy index": {
+			err:    api.ErrIndexUnhealthy{Path: "0.index", Size: 12, Mapped: 1024},
+			code:   codes.DataLoss,
+			reason: "INDEX_UNHEALTHY",
+		},
+		"wrapped typed error": {
+			err:    fmt.Errorf("append: %w", api.ErrDiskFull{Err: syscall.ENOSPC}),
+			code:   codes.ResourceExhausted,
+			reason: "DISK_FULL",
+		},
+		"untyped error": {
+			err:  errors.New("boom"),
+			code: codes.Internal,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, _, _, teardown := setupTest(t, func(c *Config) {
+				c.CommitLog = failingLog{err: tc.err}
+			})
+			defer teardown()
+
+			ctx := context.Background()
+			_, produceErr := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			_, consumeErr := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+			for _, err := range []error{produceErr, consumeErr} {
+				st := status.Convert(err)
+				require.Equal(t, tc.code, st.Code())
+				require.Equal(t, tc.reason, errorInfoReason(st))
+			}
+		})
+	}
+
+	// 実際のログで発生するエラーも同じように変換される。領域を確保したストアに収まらないレコードは書き込めない
+	dir, err := os.MkdirTemp("", "server-preallocate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lc := log.Config{}
+	lc.Segment.PreallocateStore = true
+	preallocated, err := log.NewLog(dir, lc)
+	require.NoError(t, err)
+	defer preallocated.Close()
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = preallocated
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 2048)},
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Equal(t, "RECORD_TOO_LARGE", errorInfoReason(st))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 10})
+	st = status.Convert(err)
+	require.Equal(t, codes.OutOfRange, st.Code())
+	// 既に詳細を持つエラーはそのまま返す
+	require.Len(t, st.Details(), 1)
+	require.IsType(t, &errdetails.LocalizedMessage{}, st.Details()[0])
+}
+
+// errorInfoReason ステータスの詳細に含まれるErrorInfoの理由を返す
+func errorInfoReason(st *status.Status) string {
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestServerProduceSync(t *testing.T) {
+	client, nobody, config, teardown := setupTest(t, nil)
+	defer teardown()
+
+	ctx := context.Background()
+	want := &api.Record{Value: []byte("hello world")}
+	res, err := client.ProduceSync(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	// INFO: Closeせずに同じディレクトリを読み込み専用で開き、同期したレコードがファイルから読み出せることを確かめる
+	clog := config.CommitLog.(*log.Log)
+	reopened, err := log.NewLog(clog.Dir, log.Config{ReadOnly: true})
+	require.NoError(t, err)
+	defer reopened.Close()
+	got, err := reopened.Read(res.Offset)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+
+	// Produceと同じ権限で認可する
+	_, err = nobody.ProduceSync(ctx, &api.ProduceRequest{Record: want})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerCompressedRecord(t *testing.T) {
+	client, _, config, teardown := setupTest(t, nil)
+	defer teardown()
+
+	// クライアントで圧縮した値
+	want := []byte("hello world hello world hello world")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(want)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	compressed := buf.Bytes()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: compressed, Compressed: true},
+	})
+	require.NoError(t, err)
+
+	// サーバは圧縮されたまま保存する
+	clog := config.CommitLog.(*log.Log)
+	var stored bytes.Buffer
+	_, err = io.Copy(&stored, clog.Reader())
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(stored.Bytes(), compressed))
+
+	// 圧縮されたまま返し、クライアントで展開できる
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.True(t, consume.Record.Compressed)
+	require.Equal(t, api.Codec_CODEC_NONE, consume.Record.Codec)
+	require.Equal(t, compressed, consume.Record.Value)
+	zr, err := gzip.NewReader(bytes.NewReader(consume.Record.Value))
+	require.NoError(t, err)
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// サーバの圧縮とは併用できない
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: compressed, Compressed: true, Codec: api.Codec_CODEC_GZIP},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerProduceStats(t *testing.T) {
+	client, _, config, teardown := setupTest(t, nil)
+	defer teardown()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+	// 指定しない場合は返さない
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	require.Nil(t, res.Stats)
+
+	clog := config.CommitLog.(*log.Log)
+	for i := 1; i < 5; i++ {
+		res, err = client.Produce(ctx, &api.ProduceRequest{Record: record, IncludeStats: true})
+		require.NoError(t, err)
+		require.Equal(t, res.Offset+1, res.Stats.NextOffset)
+
+		stats := clog.Stats()
+		require.Equal(t, uint64(stats.Segments), res.Stats.Segments)
+		require.Equal(t, stats.TotalBytes, res.Stats.TotalBytes)
+		require.NotZero(t, res.Stats.DiskFree)
+	}
+	// 追加したレコードの分だけ大きくなる
+	res2, err := client.ProduceSync(ctx, &api.ProduceRequest{Record: record, IncludeStats: true})
+	require.NoError(t, err)
+	require.Greater(t, res2.Stats.TotalBytes, res.Stats.TotalBytes)
+
+	// 状態を返せないログではUnimplementedを返す
+	client, _, _, teardown2 := setupTest(t, func(c *Config) {
+		c.CommitLog = failingLog{}
+	})
+	defer teardown2()
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, IncludeStats: true})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestServerMaxFollowStreams(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxFollowStreams = 2
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 上限までのフォローするストリームは受け付ける
+	var streams []api.Log_ConsumeStreamClient
+	for i := 0; i < 2; i++ {
+		stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Follow: true})
+		require.NoError(t, err)
+		streams = append(streams, stream)
+	}
+
+	// 上限を超えたストリームは拒否される
+	require.Eventually(t, func() bool {
+		stream, err := consumeStream(ctx, client, &api.ConsumeRequest{NewOnly: true})
+		if err != nil {
+			return false
+		}
+		_, err = stream.Recv()
+		return status.Code(err) == codes.ResourceExhausted
+	}, time.Second, 10*time.Millisecond)
+
+	// フォローしない読み出しは影響を受けない
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, res.Record.Offset)
+
+	// 既存のフォローするストリームは引き続きレコードを受け取れる
+	for _, stream := range streams {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, produce.Offset, res.Record.Offset)
+	}
+}
+
+func TestServerFollowerSyncedOffset(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+		c.Metrics = metrics
+		c.Follower = true
+	})
+	defer teardown()
+
+	// 2件を同期し、3件目は同期していない状態にする
+	clog := config.CommitLog.(*log.Log)
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			require.NoError(t, clog.Sync())
+		}
+		_, err := clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(2), clog.SyncedOffset())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for off := uint64(0); off < 2; off++ {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+	}
+
+	// 同期済みのオフセット以降は読み出せない
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	st := status.Convert(err)
+	require.Equal(t, codes.Unavailable, st.Code())
+	require.Equal(t, "OFFSET_NOT_SYNCED", errorInfoReason(st))
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 1, EndOffset: 2, Reverse: true})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// ログの末尾より後ろはこれまで通り範囲外になる
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// フォローするストリームは、同期されるまで待ってから返す
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{Offset: 2, Follow: true})
+	require.NoError(t, err)
+	require.NoError(t, clog.Sync())
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(config.Metrics.consumerLag) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerConsumerLag(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		require.NoError(t, err)
+		c.Metrics = metrics
+		// ackするまで次のレコードを送らないことで、コンシューマを遅らせる
+		c.MaxUnackedRecords = 1
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produce := func() {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	lag := func() float64 {
+		return testutil.ToFloat64(config.Metrics.consumerLag.WithLabelValues("1", "root", ""))
+	}
+
+	produce()
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Follow: true})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	require.Eventually(t, func() bool { return lag() == 0 }, time.Second, 10*time.Millisecond)
+
+	// コンシューマより先に追加すると、その差が遅れになる
+	for i := 0; i < 3; i++ {
+		produce()
+	}
+	require.Eventually(t, func() bool { return lag() == 3 }, time.Second, 10*time.Millisecond)
+
+	// 送信が進むと遅れは縮む
+	require.NoError(t, stream.Send(&api.ConsumeStreamRequest{
+		Message: &api.ConsumeStreamRequest_Ack{Ack: &api.ConsumeAck{Offset: 0}},
+	}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+	require.Eventually(t, func() bool { return lag() == 2 }, time.Second, 10*time.Millisecond)
+
+	// ストリームが終了すると、そのストリームの遅れは取り除かれる
+	cancel()
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(config.Metrics.consumerLag) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// 呼び出し側が作成したサーバに、他のサービスと並べてLogサービスを登録できるか
+func TestServerRegisterLogServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-register-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	// 呼び出し側のサーバ全体のインターセプターは、Logサービスのインターセプターの外側で呼び出される
+	var calls int32
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(serverTLSConfig)),
+		grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return handler(ctx, req)
+		}),
+	)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	require.NoError(t, RegisterLogServer(server, &Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+	}))
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	dial := func(certPath, keyPath string) *grpc.ClientConn {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CAFile:   config.CAFile,
+			KeyFile:  keyPath,
+			CertFile: certPath,
+		})
+		require.NoError(t, err)
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		require.NoError(t, err)
+		return conn
+	}
+	rootConn := dial(config.RootClientCertFile, config.RootClientKeyFile)
+	defer rootConn.Close()
+	nobodyConn := dial(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	defer nobodyConn.Close()
+
+	ctx := context.Background()
+	client := api.NewLogClient(rootConn)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// ストリームにもLogサービスのインターセプターが適用される
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	// Logサービスの認可は他のサービスに影響しない
+	_, err = api.NewLogClient(nobodyConn).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	check, err := healthpb.NewHealthClient(nobodyConn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check.Status)
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// 途中のセグメントが失われたログでは、GetMetadataが残っている2つの範囲を返すか
+func TestServerGetMetadata(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-metadata-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 1つのセグメントに2件ずつ、[0, 6)のレコードを書き込む
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Close())
+
+	// [2, 4)のセグメントを削除して開き直す
+	for _, ext := range []string{".store", ".index"} {
+		require.NoError(t, os.Remove(filepath.Join(dir, "2"+ext)))
+	}
+	clog, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	client, nobody, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	res, err := client.GetMetadata(ctx, &api.GetMetadataRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowestOffset)
+	require.Equal(t, uint64(6), res.NextOffset)
+	require.Empty(t, res.Ranges)
+
+	res, err = client.GetMetadata(ctx, &api.GetMetadataRequest{IncludeRanges: true})
+	require.NoError(t, err)
+	require.Len(t, res.Ranges, 2)
+	require.Equal(t, uint64(0), res.Ranges[0].Start)
+	require.Equal(t, uint64(2), res.Ranges[0].Length)
+	require.Equal(t, uint64(4), res.Ranges[1].Start)
+	require.Equal(t, uint64(2), res.Ranges[1].Length)
+
+	_, err = nobody.GetMetadata(ctx, &api.GetMetadataRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// ReplicateSegmentsで受け取ったセグメントのファイルから、同じレコードを読み出せるレプリカを作成できるか
+func TestServerReplicateSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-replicate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 1つのセグメントに2件ずつ書き込み、[6, 7)はアクティブセグメントに残る
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	for i := 0; i < 7; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record #%d", i))})
+		require.NoError(t, err)
+	}
+
+	rootClient, nobody, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	replicaDir, err := os.MkdirTemp("", "server-replica-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(replicaDir)
+
+	// 途中のセグメントから受け取り、続きから受け取り直す
+	next, err := client.ReplicateSegments(ctx, rootClient, &api.ReplicateSegmentsRequest{FromBaseOffset: 2}, replicaDir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), next)
+	next, err = client.ReplicateSegments(ctx, rootClient, &api.ReplicateSegmentsRequest{FromBaseOffset: 0}, replicaDir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), next)
+
+	replica, err := log.NewLog(replicaDir, c)
+	require.NoError(t, err)
+	defer replica.Close()
+	for off := uint64(0); off < 6; off++ {
+		want, err := clog.Read(off)
+		require.NoError(t, err)
+		got, err := replica.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got), "offset %d: want %v, got %v", off, want, got)
+	}
+	_, err = replica.Read(6)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// レプリカには続きのレコードを追加できる
+	off, err := replica.Append(&api.Record{Value: []byte("record #6")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// replicateの権限がない場合は拒否する
+	_, err = client.ReplicateSegments(ctx, nobody, &api.ReplicateSegmentsRequest{}, t.TempDir(), c)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// MaxStreamDurationを超えて開いているストリームが、DeadlineExceededで終了するか
+func TestServerMaxStreamDuration(t *testing.T) {
+	const maxDuration = 100 * time.Millisecond
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxStreamDuration = maxDuration
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	start := time.Now()
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = produce.Recv()
+	require.NoError(t, err)
+
+	// 何も送信しなくても、上限に達すると終了する
+	_, err = produce.Recv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), maxDuration)
+
+	// 新しいレコードを待ち続けるストリームも同様に終了する
+	consume, err := consumeStream(ctx, client, &api.ConsumeRequest{Follow: true})
+	require.NoError(t, err)
+	res, err := consume.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	_, err = consume.Recv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+// to_offsetまで書き込まれるのを待って返し、to_offsetで終了するか
+func TestServerConsumeStreamToOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-to-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	client, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func(value string) {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	produce("hello world")
+
+	// まだ書き込まれていないオフセット3まで要求する
+	to := uint64(3)
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{ToOffset: &to})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	for i := 0; i < 5; i++ {
+		produce("hello world")
+	}
+	for _, want := range []uint64{1, 2, 3} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// 待っている間に読み出すはずのレコードが削除されると、OutOfRangeで終了する
+	to = 10
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{
+		ToOffset:      &to,
+		ValueContains: []byte("goodbye"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, clog.Truncate(3))
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// end_offsetとは併用できない
+	stream, err = consumeStream(ctx, client, &api.ConsumeRequest{ToOffset: &to, EndOffset: 10})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerEvents(t *testing.T) {
+	bus := events.NewBus()
+	dir, err := os.MkdirTemp("", "server-events-test")
+	require.NoError(t, err)
+	c := log.Config{Events: bus}
+	c.Segment.MaxRecords = 2
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	client, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+		c.EventBus = bus
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caps, err := client.Capabilities(ctx, &api.CapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Contains(t, caps.Features, FeatureEvents)
+
+	stream, err := client.Events(ctx, &api.EventsRequest{
+		Kinds: []string{events.SegmentRolled, events.AuthDenied},
+	})
+	require.NoError(t, err)
+	// ヘッダーを受け取った時点で購読が始まっている
+	_, err = stream.Header()
+	require.NoError(t, err)
+
+	// 1つのセグメントには2件までしか書き込めないので、3件目でセグメントが切り替わる
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	e, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, events.SegmentRolled, e.Kind)
+	require.Equal(t, "2", e.Attrs["base_offset"])
+	require.Equal(t, "0", e.Attrs["sealed_base_offset"])
+	require.Equal(t, "record_count", e.Attrs["cause"])
+	require.NotZero(t, e.Timestamp)
+
+	// 許可されていないサブジェクトは購読できず、その拒否もイベントになる
+	denied, err := nobody.Events(ctx, &api.EventsRequest{})
+	require.NoError(t, err)
+	_, err = denied.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	e, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, events.AuthDenied, e.Kind)
+	require.Equal(t, eventsAction, e.Attrs["action"])
+
+	// 種類を指定していないイベントは送らない
+	require.NoError(t, clog.Truncate(2))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	e, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, events.SegmentRolled, e.Kind)
+	require.Equal(t, "4", e.Attrs["base_offset"])
+}
+
+func TestServerConnections(t *testing.T) {
+	client, nobody, config, teardown := setupTest(t, func(c *Config) {
+		c.Connections = NewConnectionTracker()
+	})
+	defer teardown()
+
+	// サブジェクトはRPCの認証で決まるので、それぞれのクライアントから呼び出しておく
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := client.Capabilities(ctx, &api.CapabilitiesRequest{})
+	require.NoError(t, err)
+	_, err = nobody.Capabilities(ctx, &api.CapabilitiesRequest{})
+	require.NoError(t, err)
+
+	conns := config.Connections.Connections()
+	require.Len(t, conns, 2)
+	subjects := []string{conns[0].Subject, conns[1].Subject}
+	require.ElementsMatch(t, []string{"root", "nobody"}, subjects)
+	for _, c := range conns {
+		require.NotEmpty(t, c.Addr)
+		require.False(t, c.ConnectedAt.IsZero())
+		require.Zero(t, c.ActiveStreams)
+	}
+
+	// 処理中のストリームを数える
+	_, err = consumeStream(ctx, client, &api.ConsumeRequest{Follow: true})
+	require.NoError(t, err)
+	activeStreams := func(subject string) int {
+		for _, c := range config.Connections.Connections() {
+			if c.Subject == subject {
+				return c.ActiveStreams
+			}
+		}
+		return -1
+	}
+	require.Eventually(t, func() bool {
+		return activeStreams("root") == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, activeStreams("nobody"))
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return activeStreams("root") == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerProduceDeadLetter(t *testing.T) {
+	client, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.DeadLetterTopic = "orders-dead-letter"
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for _, value := range []string{"order-1", "order-2"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), Key: []byte("customer-1"), SchemaVersion: 2},
+			Topic:  "orders",
+		})
+		require.NoError(t, err)
+	}
+
+	// 読み出したレコードの処理に失敗したので、デッドレターとして書き込む
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1, Topic: "orders"})
+	require.NoError(t, err)
+	produce, err := client.ProduceDeadLetter(ctx, &api.ProduceDeadLetterRequest{
+		Record:      consume.Record,
+		SourceTopic: "orders",
+		Error:       "payment declined",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	want := &api.DeadLetter{SourceTopic: "orders", SourceOffset: 1, Error: "payment declined"}
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "orders-dead-letter"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order-2"), res.Record.Value)
+	require.Equal(t, []byte("customer-1"), res.Record.Key)
+	require.Equal(t, uint32(2), res.Record.SchemaVersion)
+	require.NotZero(t, res.Record.Timestamp)
+	require.True(t, proto.Equal(want, res.Record.DeadLetter))
+
+	// ストリームでも同じヘッダーを読み出せる
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Topic: "orders-dead-letter", EndOffset: 1})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, proto.Equal(want, res.Record.DeadLetter))
+
+	// デッドレターのトピックへの書き込みとして認可する
+	_, err = nobody.ProduceDeadLetter(ctx, &api.ProduceDeadLetterRequest{Record: consume.Record})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.ProduceDeadLetter(ctx, &api.ProduceDeadLetterRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerConsumeLagFloor(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.ConsumeLagFloor = 2
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produce := func() uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		return res.Offset
+	}
+
+	// 最大のオフセットが2なので、読み出せるのは0まで
+	for i := 0; i < 3; i++ {
+		produce()
+	}
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	stream, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 0, EndOffset: 1, Reverse: true})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// レコードを追加すると、末尾から離れたレコードが読み出せるようになる
+	produce()
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+
+	// フォローするストリームは、読み出せるようになるまで待つ
+	follow, err := consumeStream(ctx, client, &api.ConsumeRequest{Offset: 1, Follow: true})
+	require.NoError(t, err)
+	res, err = follow.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+
+	newOnly, err := consumeStream(ctx, client, &api.ConsumeRequest{NewOnly: true})
+	require.NoError(t, err)
+	_, err = newOnly.Header()
+	require.NoError(t, err)
+	received := make(chan uint64, 8)
+	go func() {
+		for {
+			res, err := newOnly.Recv()
+			if err != nil {
+				return
+			}
+			received <- res.Record.Offset
+		}
+	}()
+
+	for _, want := range []uint64{2, 3} {
+		produce()
+		res, err = follow.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+
+	// 購読後に追加した4と5は、それぞれ後ろに2件追加されるまで届かない
+	require.Never(t, func() bool {
+		return len(received) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	for _, want := range []uint64{4, 5} {
+		produce()
+		require.Equal(t, want, <-received)
+	}
+}
+
+func TestServerTopicMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	logMetrics, err := log.NewMetrics(reg)
+	require.NoError(t, err)
+	dir, err := os.MkdirTemp("", "server-topic-metrics-test")
+	require.NoError(t, err)
+	topics, err := log.NewLogManager(dir, log.Config{Metrics: logMetrics})
+	require.NoError(t, err)
+	topics.MaxTopics = 2
+	defer topics.Remove()
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for topic, n := range map[string]int{"orders": 2, "payments": 1} {
+		for i := 0; i < n; i++ {
+			_, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+				Topic:  topic,
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	// ログのメトリクスはトピックごとに分かれる
+	recordCounts := func() map[string]uint64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		counts := make(map[string]uint64)
+		for _, f := range families {
+			if f.GetName() != "proglog_record_size_bytes" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "topic" {
+						counts[l.GetValue()] = m.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+		}
+		return counts
+	}
+	require.Equal(t, map[string]uint64{"orders": 2, "payments": 1}, recordCounts())
+
+	// 上限を超えるトピックは作成せず、メトリクスのラベルも増えない
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "refunds",
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Equal(t, "TOO_MANY_TOPICS", errorInfoReason(st))
+	require.Equal(t, map[string]uint64{"orders": 2, "payments": 1}, recordCounts())
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"github.com/radish-miyazaki/proglog/internal/log"
+)
+
+// topicMetadataKey リクエストのフィールドの代わりにトピックを指定するためのメタデータのキー
+const topicMetadataKey = "x-topic"
+
+type topicContextKey struct{}
+
+// topicFromMetadata メタデータでトピックが指定されている場合は検証してコンテキストに格納する。
+// 指定されていない場合はそのまま返し、リクエストのフィールドかデフォルトのログ(Config.CommitLog)が使われる。
+// デフォルトのログがない場合、どちらでもトピックを指定しないリクエストはcommitLogがInvalidArgumentで拒否する
+func topicFromMetadata(ctx context.Context) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx, nil
+	}
+	values := md.Get(topicMetadataKey)
+	if len(values) == 0 {
+		return ctx, nil
+	}
+
+	topic := values[0]
+	if !log.ValidTopic(topic) {
+		return ctx, api.ErrInvalidTopic{Topic: topic}
+	}
+
+	return context.WithValue(ctx, topicContextKey{}, topic), nil
+}
+
+func topicUnaryServerInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, err := topicFromMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func topicStreamServerInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, err := topicFromMetadata(stream.Context())
+	if err != nil {
+		return err
+	}
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = ctx
+	return handler(srv, wrapped)
+}
+
+// requestTopic リクエストで指定されたトピックを返す。フィールドが空の場合はメタデータで指定されたトピックを使う
+func requestTopic(ctx context.Context, topic string) string {
+	if topic != "" {
+		return topic
+	}
+	topic, _ = ctx.Value(topicContextKey{}).(string)
+	return topic
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/radish-miyazaki/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watermarker ConsumeStreamで、watermark_interval_msごとにログの最大のオフセットを送る
+type watermarker struct {
+	interval time.Duration
+	log      offsetLog
+	// next 次にウォーターマークを送る時刻
+	next time.Time
+}
+
+// newWatermarker reqでウォーターマークが指定されていればwatermarkerを作成する。指定されていない場合はnilを返す
+func (s *grpcServer) newWatermarker(topic string, req *api.ConsumeRequest) (*watermarker, error) {
+	if req.WatermarkIntervalMs == 0 {
+		return nil, nil
+	}
+	clog, err := s.commitLog(topic)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := clog.(offsetLog)
+	if !ok {
+		return nil, status.New(codes.Unimplemented, "watermarks are not supported by the log").Err()
+	}
+	interval := time.Duration(req.WatermarkIntervalMs) * time.Millisecond
+	return &watermarker{interval: interval, log: l, next: time.Now().Add(interval)}, nil
+}
+
+// sendIfDue 前回から間隔が経っていればウォーターマークを送る。ログが空の場合は最大のオフセットがないので送らない。
+// INFO: ウォーターマークはレコードではないので、ackを待つレコードの数には含めない
+func (w *watermarker) sendIfDue(stream api.Log_ConsumeStreamServer) error {
+	if w == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(w.next) {
+		return nil
+	}
+	w.next = now.Add(w.interval)
+	next := w.log.NextOffset()
+	if next == 0 {
+		return nil
+	}
+	return stream.Send(&api.ConsumeResponse{
+		Watermark: &api.Watermark{HighestOffset: next - 1},
+	})
+}
+
+// waitContext 新しいレコードを待つ間も次のウォーターマークを送れるよう、次に送る時刻を期限とするコンテキストを返す
+func (w *watermarker) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if w == nil {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, w.next)
+}